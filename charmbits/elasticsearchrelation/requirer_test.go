@@ -0,0 +1,62 @@
+package elasticsearchrelation_test
+
+import (
+	"testing"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/charmbits/elasticsearchrelation"
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+type requirerSuite struct{}
+
+var _ = gc.Suite(&requirerSuite{})
+
+func (*requirerSuite) TestAddresses(c *gc.C) {
+	var req elasticsearchrelation.Requirer
+	var addrs []string
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			req.Register(r, "es")
+			r.RegisterHook("es-relation-changed", func() error {
+				addrs = req.Addresses()
+				return nil
+			})
+		},
+		Relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"rel0": {
+				// The host set by the remote charm is
+				// used in preference to the ingress address.
+				"elasticsearch/0": {
+					"host":            "es0.example.com",
+					"port":            "9300",
+					"ingress-address": "10.0.0.1",
+				},
+				"elasticsearch/1": {
+					"host":            "es1.example.com",
+					"ingress-address": "10.0.0.2",
+				},
+				// A unit that has not set its host
+				// is not ready yet.
+				"elasticsearch/2": {
+					"ingress-address": "10.0.0.3",
+				},
+			},
+		},
+		RelationIds: map[string][]hook.RelationId{
+			"es": {"rel0"},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("es-relation-changed", "rel0", "elasticsearch/0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(addrs, jc.DeepEquals, []string{"es0.example.com:9300", "es1.example.com:9200"})
+}
@@ -21,10 +21,11 @@ type providerState struct {
 
 // Provider represents the provider of an http relation.
 type Provider struct {
-	prov       simplerelation.Provider
-	state      providerState
-	ctxt       *hook.Context
-	allowHTTPS bool
+	prov         simplerelation.Provider
+	state        providerState
+	ctxt         *hook.Context
+	relationName string
+	allowHTTPS   bool
 }
 
 // Register registers everything necessary on r for running the provider
@@ -35,9 +36,12 @@ type Provider struct {
 // notifies that the port has changed by calling
 // changed.HTTPServerPortChanged.
 //
-// The port of the server is configured with the "server-port" charm
-// configuration option.
+// The port of the server is configured with the "http-port" charm
+// configuration option. If the port is out of range, the unit is
+// blocked until it is fixed. The hostname advertised on the relation
+// is the unit's ingress address for the relation's binding.
 func (p *Provider) Register(r *hook.Registry, relationName string, allowHTTPS bool) {
+	p.relationName = relationName
 	p.allowHTTPS = allowHTTPS
 	// TODO provide https relation?
 	p.prov.Register(r.Clone("http"), relationName, "http")
@@ -46,6 +50,7 @@ func (p *Provider) Register(r *hook.Registry, relationName string, allowHTTPS bo
 		Description: "Port for the HTTP server to listen on",
 		Default:     80,
 	})
+	r.RegisterConfigValidator("http-port", hook.IntRange(1, 65535))
 	if p.allowHTTPS {
 		r.RegisterConfig("https-certificate", charm.Option{
 			Type:        "string",
@@ -56,6 +61,8 @@ func (p *Provider) Register(r *hook.Registry, relationName string, allowHTTPS bo
 			Description: "Port for the HTTP server to listen on",
 			Default:     443,
 		})
+		r.RegisterConfigValidator("https-certificate", hook.ValidPEM())
+		r.RegisterConfigValidator("https-port", hook.IntRange(1, 65535))
 	}
 	r.RegisterHook("install", p.configChanged)
 	r.RegisterHook("config-changed", p.configChanged)
@@ -99,7 +106,7 @@ func (p *Provider) configChanged() error {
 			"port":     "",
 		})
 	}
-	addr, err := p.ctxt.PrivateAddress()
+	addr, err := p.ctxt.IngressAddress(p.relationName)
 	if err != nil {
 		return errgo.Mask(err)
 	}
@@ -133,9 +140,10 @@ func (p *Provider) configurePort(openedPort *int, configKey string) error {
 	if err != nil {
 		return errgo.Notef(err, "cannot get %s", configKey)
 	}
-	if port <= 0 || port >= 65535 {
-		p.ctxt.Logf("ignoring invalid %s %v", configKey, port)
-		// TODO status-set appropriately if/when status-set is implemented
+	if port == 0 {
+		// The port has not been set. Out of range
+		// values are rejected by the config validator,
+		// so we will not see them here.
 		return nil
 	}
 	if port == *openedPort {
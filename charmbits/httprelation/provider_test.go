@@ -106,6 +106,24 @@ func (s *providerSuite) TestOpensPortWhenConfigChanged(c *gc.C) {
 	})
 }
 
+func (s *providerSuite) TestInvalidPortBlocks(c *gc.C) {
+	ctxt := &context{
+		state: make(hooktest.MemState),
+		config: map[string]interface{}{
+			"http-port": 70000,
+		},
+	}
+	rec := ctxt.runHook(c, "config-changed", "", "", func(p *httprelation.Provider, r *hook.Registry) {
+		r.RegisterHook("*", func() error {
+			c.Error("hook called with invalid configuration")
+			return nil
+		})
+	})
+	c.Assert(rec, jc.DeepEquals, [][]string{
+		{"status-set", "blocked", "invalid configuration: http-port (value 70000 out of range [1, 65535])"},
+	})
+}
+
 type context struct {
 	withHTTPS   bool
 	relations   map[hook.RelationId]map[hook.UnitId]map[string]string
@@ -0,0 +1,52 @@
+package mongodbrelation_test
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/charmbits/mongodbrelation"
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type requirerSuite struct{}
+
+var _ = gc.Suite(&requirerSuite{})
+
+func (*requirerSuite) TestAddresses(c *gc.C) {
+	var req mongodbrelation.Requirer
+	var addrs []string
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			req.Register(r, "mongodb")
+			r.RegisterHook("mongodb-relation-changed", func() error {
+				addrs = req.Addresses()
+				return nil
+			})
+		},
+		Relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"rel0": {
+				// The hostname set by the remote charm is
+				// used in preference to the ingress address.
+				"mongodb/0": {
+					"hostname":        "mongo0.example.com",
+					"port":            "27017",
+					"ingress-address": "10.0.0.1",
+				},
+				// A unit that has not set its hostname
+				// is not ready yet.
+				"mongodb/1": {
+					"ingress-address": "10.0.0.2",
+				},
+			},
+		},
+		RelationIds: map[string][]hook.RelationId{
+			"mongodb": {"rel0"},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("mongodb-relation-changed", "rel0", "mongodb/0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(addrs, jc.DeepEquals, []string{"mongo0.example.com:27017"})
+}
@@ -0,0 +1,342 @@
+package pebble
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// Client is a client for the Pebble API, served
+// over a unix socket.
+type Client struct {
+	socketPath string
+	client     *http.Client
+}
+
+// NewClient returns a client that talks to the Pebble
+// instance listening on the given unix socket.
+func NewClient(socketPath string) *Client {
+	return &Client{
+		socketPath: socketPath,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Layer holds a Pebble configuration layer.
+type Layer struct {
+	Summary     string              `yaml:"summary,omitempty"`
+	Description string              `yaml:"description,omitempty"`
+	Services    map[string]*Service `yaml:"services,omitempty"`
+}
+
+// Service holds the configuration of a service in a Pebble layer.
+type Service struct {
+	Summary     string `yaml:"summary,omitempty"`
+	Description string `yaml:"description,omitempty"`
+
+	// Override specifies how the service is combined with a
+	// service of the same name in an earlier layer; either
+	// "merge" or "replace".
+	Override string `yaml:"override"`
+
+	Command string `yaml:"command,omitempty"`
+
+	// Startup specifies whether the service is started
+	// automatically; either "enabled" or "disabled".
+	Startup string `yaml:"startup,omitempty"`
+
+	Environment map[string]string `yaml:"environment,omitempty"`
+	User        string            `yaml:"user,omitempty"`
+	Group       string            `yaml:"group,omitempty"`
+	WorkingDir  string            `yaml:"working-dir,omitempty"`
+}
+
+// ServiceInfo holds the status of a service as reported by Pebble.
+type ServiceInfo struct {
+	Name    string `json:"name"`
+	Startup string `json:"startup"`
+
+	// Current holds the current state of the service,
+	// for example "active" or "inactive".
+	Current string `json:"current"`
+}
+
+// AddLayer adds the given layer to the Pebble configuration with the
+// given label. If combine is true and a layer with the same label
+// already exists, the new layer is combined with it; otherwise it is
+// an error for the label to exist already.
+//
+// Services are not started or restarted by AddLayer; use Replan
+// or Restart for that.
+func (c *Client) AddLayer(label string, layer *Layer, combine bool) error {
+	data, err := yaml.Marshal(layer)
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal layer")
+	}
+	req := struct {
+		Action  string `json:"action"`
+		Combine bool   `json:"combine"`
+		Label   string `json:"label"`
+		Format  string `json:"format"`
+		Layer   string `json:"layer"`
+	}{
+		Action:  "add",
+		Combine: combine,
+		Label:   label,
+		Format:  "yaml",
+		Layer:   string(data),
+	}
+	if err := c.doJSON("POST", "/v1/layers", nil, req, nil); err != nil {
+		return errgo.Notef(err, "cannot add layer %q", label)
+	}
+	return nil
+}
+
+// Push writes the given content to the file at the given path in the
+// container, creating any parent directories, and gives it the given
+// permissions.
+func (c *Client) Push(path string, content io.Reader, perm os.FileMode) error {
+	type fileInfo struct {
+		Path        string `json:"path"`
+		MakeDirs    bool   `json:"make-dirs"`
+		Permissions string `json:"permissions"`
+	}
+	meta, err := json.Marshal(struct {
+		Action string     `json:"action"`
+		Files  []fileInfo `json:"files"`
+	}{
+		Action: "write",
+		Files: []fileInfo{{
+			Path:        path,
+			MakeDirs:    true,
+			Permissions: fmt.Sprintf("%03o", perm.Perm()),
+		}},
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Disposition", `form-data; name="request"`)
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := part.Write(meta); err != nil {
+		return errgo.Mask(err)
+	}
+	part, err = mw.CreateFormFile("files", path)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := io.Copy(part, content); err != nil {
+		return errgo.Notef(err, "cannot read content for %q", path)
+	}
+	if err := mw.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	var results []struct {
+		Path  string     `json:"path"`
+		Error *respError `json:"error"`
+	}
+	if err := c.do("POST", "/v1/files", nil, mw.FormDataContentType(), &body, &results); err != nil {
+		return errgo.Notef(err, "cannot push %q", path)
+	}
+	for _, r := range results {
+		if r.Error != nil {
+			return errgo.Notef(r.Error, "cannot push %q", path)
+		}
+	}
+	return nil
+}
+
+// Start starts the services with the given names
+// and waits for them to start.
+func (c *Client) Start(names ...string) error {
+	return c.serviceAction("start", names)
+}
+
+// Stop stops the services with the given names
+// and waits for them to stop.
+func (c *Client) Stop(names ...string) error {
+	return c.serviceAction("stop", names)
+}
+
+// Restart restarts the services with the given names
+// and waits for them to start.
+func (c *Client) Restart(names ...string) error {
+	return c.serviceAction("restart", names)
+}
+
+// Replan starts any enabled services that are not running and
+// restarts any whose configuration has changed.
+func (c *Client) Replan() error {
+	return c.serviceAction("replan", nil)
+}
+
+// Services returns the status of the services with the given
+// names, or of all services if no names are given.
+func (c *Client) Services(names ...string) ([]ServiceInfo, error) {
+	q := make(url.Values)
+	if len(names) > 0 {
+		q.Set("names", strings.Join(names, ","))
+	}
+	var infos []ServiceInfo
+	if err := c.doJSON("GET", "/v1/services", q, nil, &infos); err != nil {
+		return nil, errgo.Notef(err, "cannot get services")
+	}
+	return infos, nil
+}
+
+// SystemInfo checks that Pebble is responding and returns its version.
+func (c *Client) SystemInfo() (version string, err error) {
+	var info struct {
+		Version string `json:"version"`
+	}
+	if err := c.doJSON("GET", "/v1/system-info", nil, nil, &info); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return info.Version, nil
+}
+
+// serviceAction performs the given action on the
+// services and waits for the resulting change.
+func (c *Client) serviceAction(action string, names []string) error {
+	req := struct {
+		Action   string   `json:"action"`
+		Services []string `json:"services"`
+	}{
+		Action:   action,
+		Services: names,
+	}
+	resp, err := c.request("POST", "/v1/services", nil, "application/json", jsonBody(req))
+	if err != nil {
+		return errgo.Notef(err, "cannot %s services %v", action, names)
+	}
+	if resp.Type != "async" {
+		return errgo.Newf("cannot %s services %v: unexpected response type %q", action, names, resp.Type)
+	}
+	var change struct {
+		Status string `json:"status"`
+		Ready  bool   `json:"ready"`
+		Err    string `json:"err"`
+	}
+	if err := c.doJSON("GET", "/v1/changes/"+resp.Change+"/wait", nil, nil, &change); err != nil {
+		return errgo.Notef(err, "cannot wait for %s of services %v", action, names)
+	}
+	if change.Err != "" {
+		return errgo.Newf("cannot %s services %v: %s", action, names, change.Err)
+	}
+	return nil
+}
+
+// response holds a response from the Pebble API.
+type response struct {
+	Type       string          `json:"type"`
+	StatusCode int             `json:"status-code"`
+	Status     string          `json:"status"`
+	Change     string          `json:"change"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// respError holds an error returned by the Pebble API.
+type respError struct {
+	Message string `json:"message"`
+	Kind    string `json:"kind"`
+}
+
+func (e *respError) Error() string {
+	return e.Message
+}
+
+// jsonBody returns a reader that reads the JSON encoding
+// of v, or nil if v is nil.
+func jsonBody(v interface{}) io.Reader {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return bytes.NewReader(data)
+}
+
+func (c *Client) doJSON(method, path string, query url.Values, req, result interface{}) error {
+	return c.do(method, path, query, "application/json", jsonBody(req), result)
+}
+
+// do makes a synchronous request to the Pebble API and unmarshals
+// the result into result if it is not nil.
+func (c *Client) do(method, path string, query url.Values, contentType string, body io.Reader, result interface{}) error {
+	resp, err := c.request(method, path, query, contentType, body)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if resp.Type != "sync" {
+		return errgo.Newf("unexpected response type %q", resp.Type)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return errgo.Notef(err, "cannot unmarshal result")
+	}
+	return nil
+}
+
+// request makes a request to the Pebble API and
+// returns the decoded response.
+func (c *Client) request(method, path string, query url.Values, contentType string, body io.Reader) (*response, error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     "localhost",
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	httpResp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot connect to pebble at %s", c.socketPath)
+	}
+	defer httpResp.Body.Close()
+	var resp response
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, errgo.Notef(err, "cannot decode response from %s %s", method, path)
+	}
+	if resp.Type == "error" {
+		var rerr respError
+		if err := json.Unmarshal(resp.Result, &rerr); err != nil || rerr.Message == "" {
+			return nil, errgo.Newf("%s %s failed with status %q", method, path, resp.Status)
+		}
+		return nil, &rerr
+	}
+	return &resp, nil
+}
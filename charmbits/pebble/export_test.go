@@ -0,0 +1,3 @@
+package pebble
+
+var ContainerDir = &containerDir
@@ -0,0 +1,89 @@
+// The pebble package provides support for sidecar charms running on
+// Kubernetes. It registers a workload container and provides a client
+// for the Pebble instance that manages the services running in it.
+package pebble
+
+import (
+	"path/filepath"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+)
+
+// containerDir holds the directory in the charm container
+// that holds the Pebble socket for each workload container.
+var containerDir = "/charm/containers"
+
+// Container represents a workload container
+// in a Kubernetes sidecar charm.
+type Container struct {
+	// Ready, if not nil, is called in the <name>-pebble-ready hook,
+	// when Pebble is first available in the container, typically
+	// after the container has been (re)started. It will usually
+	// add a layer describing the workload and start its services.
+	Ready func() error
+
+	name   string
+	ctxt   *hook.Context
+	client *Client
+	state  localState
+}
+
+type localState struct {
+	// Ready records whether a pebble-ready hook
+	// has run for the container.
+	Ready bool
+}
+
+// Register registers the container with the given name and details
+// with r (see hook.Registry.RegisterContainer) and registers
+// its pebble-ready hook.
+func (ctr *Container) Register(r *hook.Registry, name string, details charm.Container) {
+	r.RegisterContainer(name, details)
+	ctr.name = name
+	r.RegisterContext(ctr.setContext, &ctr.state)
+	r.RegisterHook(name+"-pebble-ready", ctr.pebbleReady)
+}
+
+func (ctr *Container) setContext(ctxt *hook.Context) error {
+	ctr.ctxt = ctxt
+	ctr.client = NewClient(filepath.Join(containerDir, ctr.name, "pebble.socket"))
+	return nil
+}
+
+// Name returns the name of the container.
+func (ctr *Container) Name() string {
+	return ctr.name
+}
+
+// Client returns a client for the container's Pebble instance.
+func (ctr *Container) Client() *Client {
+	return ctr.client
+}
+
+// CanConnect reports whether the container's Pebble instance
+// can be reached. It returns false if no pebble-ready hook
+// has run for the container yet.
+func (ctr *Container) CanConnect() bool {
+	if !ctr.state.Ready {
+		return false
+	}
+	if _, err := ctr.client.SystemInfo(); err != nil {
+		ctr.ctxt.Logf("cannot connect to pebble in %s container: %v", ctr.name, err)
+		return false
+	}
+	return true
+}
+
+func (ctr *Container) pebbleReady() error {
+	ctr.state.Ready = true
+	if ctr.Ready == nil {
+		return nil
+	}
+	if err := ctr.Ready(); err != nil {
+		return errgo.Notef(err, "cannot set up %s container", ctr.name)
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package pebble_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/juju/charm/v9"
+	"github.com/juju/charm/v9/resource"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/mever/gocharm/v2/charmbits/pebble"
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+type pebbleSuite struct {
+	dir    string
+	server *fakePebble
+}
+
+var _ = gc.Suite(&pebbleSuite{})
+
+func (s *pebbleSuite) SetUpTest(c *gc.C) {
+	s.dir = c.MkDir()
+	*pebble.ContainerDir = s.dir
+	s.server = newFakePebble(c, filepath.Join(s.dir, "workload", "pebble.socket"))
+}
+
+func (s *pebbleSuite) TearDownTest(c *gc.C) {
+	s.server.Close()
+}
+
+func (s *pebbleSuite) TestRegister(c *gc.C) {
+	r := hook.NewRegistry()
+	var ctr pebble.Container
+	ctr.Register(r, "workload", charm.Container{
+		Resource: "workload-image",
+	})
+	c.Assert(r.RegisteredContainers(), jc.DeepEquals, map[string]charm.Container{
+		"workload": {Resource: "workload-image"},
+	})
+	c.Assert(r.RegisteredResources(), jc.DeepEquals, map[string]resource.Meta{
+		"workload-image": {
+			Name:        "workload-image",
+			Type:        resource.TypeContainerImage,
+			Description: "OCI image for the workload container",
+		},
+	})
+	c.Assert(r.RegisteredHooks(), jc.DeepEquals, []string{"workload-pebble-ready"})
+}
+
+func (s *pebbleSuite) TestPebbleReady(c *gc.C) {
+	var ctr pebble.Container
+	ctr.Ready = func() error {
+		client := ctr.Client()
+		err := client.AddLayer("workload", &pebble.Layer{
+			Summary: "workload layer",
+			Services: map[string]*pebble.Service{
+				"server": {
+					Override: "replace",
+					Command:  "/bin/server --port 8080",
+					Startup:  "enabled",
+				},
+			},
+		}, true)
+		if err != nil {
+			return err
+		}
+		err = client.Push("/etc/server/config.json", strings.NewReader(`{"debug": true}`), 0640)
+		if err != nil {
+			return err
+		}
+		return client.Start("server")
+	}
+	var canConnect []bool
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			ctr.Register(r, "workload", charm.Container{})
+			r.RegisterHook("*", func() error {
+				canConnect = append(canConnect, ctr.CanConnect())
+				return nil
+			})
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	err = runner.RunHook("workload-pebble-ready", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(canConnect, jc.DeepEquals, []bool{false, true})
+
+	c.Assert(s.server.layers, gc.HasLen, 1)
+	var layer pebble.Layer
+	err = yaml.Unmarshal([]byte(s.server.layers["workload"]), &layer)
+	c.Assert(err, gc.IsNil)
+	c.Assert(layer.Services["server"].Command, gc.Equals, "/bin/server --port 8080")
+
+	c.Assert(s.server.files, jc.DeepEquals, map[string]string{
+		"/etc/server/config.json": `{"debug": true}`,
+	})
+	c.Assert(s.server.perms["/etc/server/config.json"], gc.Equals, "640")
+
+	infos, err := ctr.Client().Services()
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, jc.DeepEquals, []pebble.ServiceInfo{{
+		Name:    "server",
+		Startup: "enabled",
+		Current: "active",
+	}})
+
+	err = ctr.Client().Stop("server")
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.server.services["server"], gc.Equals, "inactive")
+}
+
+func (s *pebbleSuite) TestErrors(c *gc.C) {
+	client := pebble.NewClient(s.server.socketPath)
+	err := client.Start("unknown")
+	c.Assert(err, gc.ErrorMatches, `cannot start services \[unknown\]: service "unknown" not found`)
+
+	err = client.AddLayer("foo", &pebble.Layer{}, false)
+	c.Assert(err, gc.IsNil)
+	err = client.AddLayer("foo", &pebble.Layer{}, false)
+	c.Assert(err, gc.ErrorMatches, `cannot add layer "foo": layer "foo" already exists`)
+
+	client = pebble.NewClient(filepath.Join(s.dir, "nowhere.socket"))
+	_, err = client.SystemInfo()
+	c.Assert(err, gc.ErrorMatches, `cannot connect to pebble at .*`)
+}
+
+// fakePebble is a minimal in-process implementation of the
+// Pebble API.
+type fakePebble struct {
+	c          *gc.C
+	socketPath string
+	listener   net.Listener
+
+	mu       sync.Mutex
+	layers   map[string]string
+	files    map[string]string
+	perms    map[string]string
+	services map[string]string
+	changes  map[string]string
+}
+
+func newFakePebble(c *gc.C, socketPath string) *fakePebble {
+	err := os.MkdirAll(filepath.Dir(socketPath), 0755)
+	c.Assert(err, gc.IsNil)
+	l, err := net.Listen("unix", socketPath)
+	c.Assert(err, gc.IsNil)
+	p := &fakePebble{
+		c:          c,
+		socketPath: socketPath,
+		listener:   l,
+		layers:     make(map[string]string),
+		files:      make(map[string]string),
+		perms:      make(map[string]string),
+		services:   make(map[string]string),
+		changes:    make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/system-info", p.serveSystemInfo)
+	mux.HandleFunc("/v1/layers", p.serveLayers)
+	mux.HandleFunc("/v1/files", p.serveFiles)
+	mux.HandleFunc("/v1/services", p.serveServices)
+	mux.HandleFunc("/v1/changes/", p.serveChanges)
+	go http.Serve(l, mux)
+	return p
+}
+
+func (p *fakePebble) Close() {
+	p.listener.Close()
+}
+
+func (p *fakePebble) serveSystemInfo(w http.ResponseWriter, req *http.Request) {
+	writeResult(w, map[string]string{"version": "1.0.0"})
+}
+
+func (p *fakePebble) serveLayers(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Action  string `json:"action"`
+		Combine bool   `json:"combine"`
+		Label   string `json:"label"`
+		Format  string `json:"format"`
+		Layer   string `json:"layer"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.layers[body.Label]; ok && !body.Combine {
+		writeError(w, fmt.Sprintf("layer %q already exists", body.Label))
+		return
+	}
+	var layer pebble.Layer
+	if err := yaml.Unmarshal([]byte(body.Layer), &layer); err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	for name, svc := range layer.Services {
+		p.services[name] = "inactive"
+		if svc.Startup == "" {
+			svc.Startup = "disabled"
+		}
+	}
+	p.layers[body.Label] = body.Layer
+	writeResult(w, true)
+}
+
+func (p *fakePebble) serveFiles(w http.ResponseWriter, req *http.Request) {
+	mr, err := req.MultipartReader()
+	if err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	var meta struct {
+		Action string `json:"action"`
+		Files  []struct {
+			Path        string `json:"path"`
+			Permissions string `json:"permissions"`
+		} `json:"files"`
+	}
+	type result struct {
+		Path string `json:"path"`
+	}
+	var results []result
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		switch part.FormName() {
+		case "request":
+			if err := json.NewDecoder(part).Decode(&meta); err != nil {
+				writeError(w, err.Error())
+				return
+			}
+		case "files":
+			data, err := ioutil.ReadAll(part)
+			if err != nil {
+				writeError(w, err.Error())
+				return
+			}
+			// Part.FileName strips the directory, so
+			// parse the header directly as Pebble does.
+			_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+			path := params["filename"]
+			p.files[path] = string(data)
+			for _, f := range meta.Files {
+				if f.Path == path {
+					p.perms[path] = f.Permissions
+				}
+			}
+			results = append(results, result{Path: path})
+		}
+	}
+	writeResult(w, results)
+}
+
+func (p *fakePebble) serveServices(w http.ResponseWriter, req *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if req.Method == "GET" {
+		infos := []pebble.ServiceInfo{}
+		for name, current := range p.services {
+			infos = append(infos, pebble.ServiceInfo{
+				Name:    name,
+				Startup: "enabled",
+				Current: current,
+			})
+		}
+		writeResult(w, infos)
+		return
+	}
+	var body struct {
+		Action   string   `json:"action"`
+		Services []string `json:"services"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, err.Error())
+		return
+	}
+	changeErr := ""
+	for _, name := range body.Services {
+		if _, ok := p.services[name]; !ok {
+			changeErr = fmt.Sprintf("service %q not found", name)
+			break
+		}
+		if body.Action == "stop" {
+			p.services[name] = "inactive"
+		} else {
+			p.services[name] = "active"
+		}
+	}
+	id := fmt.Sprint(len(p.changes) + 1)
+	p.changes[id] = changeErr
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":        "async",
+		"status-code": http.StatusAccepted,
+		"status":      "Accepted",
+		"change":      id,
+	})
+}
+
+func (p *fakePebble) serveChanges(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v1/changes/"), "/wait")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changeErr, ok := p.changes[id]
+	if !ok {
+		writeError(w, fmt.Sprintf("change %q not found", id))
+		return
+	}
+	status := "Done"
+	if changeErr != "" {
+		status = "Error"
+	}
+	writeResult(w, map[string]interface{}{
+		"id":     id,
+		"status": status,
+		"ready":  true,
+		"err":    changeErr,
+	})
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":        "sync",
+		"status-code": http.StatusOK,
+		"status":      "OK",
+		"result":      result,
+	})
+}
+
+func writeError(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":        "error",
+		"status-code": http.StatusBadRequest,
+		"status":      "Bad Request",
+		"result": map[string]string{
+			"message": message,
+		},
+	})
+}
@@ -0,0 +1,360 @@
+// The secret package provides access to Juju secrets. It keeps track of
+// the secrets owned and consumed by the unit, so that they can be
+// referred to by label, and handles the secret hooks.
+package secret
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+)
+
+// ErrNotFound is returned as the cause of errors
+// when a secret label is not known.
+var ErrNotFound = errgo.New("secret not found")
+
+// Secrets represents the Juju secrets used by a charm.
+type Secrets struct {
+	// UnitOwned specifies that secrets created with Add are owned
+	// by the unit rather than by the application. Only the leader
+	// can create and change secrets owned by the application;
+	// they are recorded in the leader state so that a new
+	// leader can continue to manage them.
+	UnitOwned bool
+
+	// Changed, if not nil, is called in a secret-changed hook
+	// with the label of the secret that has changed, after the
+	// unit has started tracking the secret's latest revision.
+	Changed func(label string) error
+
+	// Rotate, if not nil, is called in a secret-rotate hook with the
+	// label of the owned secret that should be rotated.
+	Rotate func(label string) error
+
+	// Expired, if not nil, is called in a secret-expired hook with the
+	// label and revision of the owned secret revision that has
+	// expired. If it is nil, the expired revision is removed.
+	Expired func(label string, revision int) error
+
+	ctxt     *hook.Context
+	state    localState
+	appState appState
+}
+
+type localState struct {
+	// Owned maps the label of each secret created
+	// by the unit and owned by the unit to the secret's id.
+	Owned map[string]string
+
+	// Consumed maps the label of each secret consumed
+	// by the unit to the secret's id.
+	Consumed map[string]string
+}
+
+type appState struct {
+	// Owned maps the label of each secret owned
+	// by the application to the secret's id.
+	Owned map[string]string
+}
+
+// Register registers the secret hooks with r. It also registers
+// leader state with r (see hook.Registry.RegisterLeaderState).
+func (s *Secrets) Register(r *hook.Registry) {
+	r.RegisterContext(s.setContext, &s.state)
+	r.RegisterLeaderState(&s.appState)
+	r.RegisterHook("secret-changed", s.secretChanged)
+	r.RegisterHook("secret-rotate", s.secretRotate)
+	r.RegisterHook("secret-expired", s.secretExpired)
+	r.RegisterHook("secret-remove", s.secretRemove)
+}
+
+func (s *Secrets) setContext(ctxt *hook.Context) error {
+	s.ctxt = ctxt
+	if s.state.Owned == nil {
+		s.state.Owned = make(map[string]string)
+	}
+	if s.state.Consumed == nil {
+		s.state.Consumed = make(map[string]string)
+	}
+	if s.appState.Owned == nil {
+		s.appState.Owned = make(map[string]string)
+	}
+	return nil
+}
+
+// Add creates a new secret with the given label and content and
+// returns its id. The id can be passed to other applications (for
+// example in relation data) after granting them access with Grant.
+// Unless UnitOwned is set, the unit must be the leader.
+func (s *Secrets) Add(label string, content map[string]string) (string, error) {
+	if _, err := s.ownedId(label); err == nil {
+		return "", errgo.Newf("secret %q already exists", label)
+	}
+	owned := s.state.Owned
+	owner := "unit"
+	if !s.UnitOwned {
+		isLeader, err := s.ctxt.IsLeader()
+		if err != nil {
+			return "", errgo.Mask(err)
+		}
+		if !isLeader {
+			return "", errgo.Newf("cannot add secret %q: only the leader can add secrets owned by the application", label)
+		}
+		owned = s.appState.Owned
+		owner = "application"
+	}
+	args := []string{"--label", label, "--owner", owner}
+	args = append(args, contentArgs(content)...)
+	out, err := s.ctxt.Runner.Run("secret-add", args...)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot add secret %q", label)
+	}
+	id := strings.TrimSpace(string(out))
+	owned[label] = id
+	return id, nil
+}
+
+// Set creates a new revision of the owned secret with
+// the given label, holding the given content.
+func (s *Secrets) Set(label string, content map[string]string) error {
+	id, err := s.ownedId(label)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	args := append([]string{id}, contentArgs(content)...)
+	if _, err := s.ctxt.Runner.Run("secret-set", args...); err != nil {
+		return errgo.Notef(err, "cannot set secret %q", label)
+	}
+	return nil
+}
+
+// Remove removes the owned secret with the given label,
+// including all its revisions.
+func (s *Secrets) Remove(label string) error {
+	id, err := s.ownedId(label)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	if _, err := s.ctxt.Runner.Run("secret-remove", id); err != nil {
+		return errgo.Notef(err, "cannot remove secret %q", label)
+	}
+	delete(s.state.Owned, label)
+	delete(s.appState.Owned, label)
+	return nil
+}
+
+// Consume starts tracking the secret with the given id, which has
+// usually been obtained from relation data, and gives it the given
+// label. It returns the current content of the secret. The secret can
+// subsequently be retrieved with Get.
+func (s *Secrets) Consume(id, label string) (map[string]string, error) {
+	var content map[string]string
+	if err := s.ctxt.RunJSON(&content, "secret-get", id, "--label", label, "--format", "json"); err != nil {
+		return nil, errgo.Notef(err, "cannot get secret %q", id)
+	}
+	s.state.Consumed[label] = id
+	return content, nil
+}
+
+// Get returns the content of the secret with the given label, which
+// must have been created with Add or consumed with Consume.
+//
+// For consumed secrets, this returns the content of the revision that
+// the unit is tracking, which is only changed to the latest revision
+// when the secret-changed hook runs for the secret, so the content will
+// not change under the charm's feet between hooks. The content of an
+// owned secret is always the latest revision.
+func (s *Secrets) Get(label string) (map[string]string, error) {
+	var args []string
+	if id, err := s.ownedId(label); err == nil {
+		args = []string{id}
+	} else if _, ok := s.state.Consumed[label]; ok {
+		args = []string{"--label", label}
+	} else {
+		return nil, errgo.WithCausef(nil, ErrNotFound, "secret %q not found", label)
+	}
+	var content map[string]string
+	if err := s.ctxt.RunJSON(&content, "secret-get", append(args, "--format", "json")...); err != nil {
+		return nil, errgo.Notef(err, "cannot get secret %q", label)
+	}
+	return content, nil
+}
+
+// Revision returns the latest revision of the owned
+// secret with the given label.
+func (s *Secrets) Revision(label string) (int, error) {
+	id, err := s.ownedId(label)
+	if err != nil {
+		return 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	var info map[string]struct {
+		Revision int `json:"revision"`
+	}
+	if err := s.ctxt.RunJSON(&info, "secret-info-get", id, "--format", "json"); err != nil {
+		return 0, errgo.Notef(err, "cannot get information on secret %q", label)
+	}
+	for _, secretInfo := range info {
+		return secretInfo.Revision, nil
+	}
+	return 0, errgo.Newf("no information found for secret %q", label)
+}
+
+// Grant grants access to the owned secret with the given label to the
+// application at the other end of the relation with the given id. If
+// unit is not empty, access is granted only to that unit.
+func (s *Secrets) Grant(label string, relationId hook.RelationId, unit hook.UnitId) error {
+	return s.grantOrRevoke("secret-grant", label, relationId, unit)
+}
+
+// Revoke revokes access to the owned secret with the given label that
+// was granted with Grant.
+func (s *Secrets) Revoke(label string, relationId hook.RelationId, unit hook.UnitId) error {
+	return s.grantOrRevoke("secret-revoke", label, relationId, unit)
+}
+
+func (s *Secrets) grantOrRevoke(cmd string, label string, relationId hook.RelationId, unit hook.UnitId) error {
+	id, err := s.ownedId(label)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	args := []string{id, "-r", string(relationId)}
+	if unit != "" {
+		args = append(args, "--unit", string(unit))
+	}
+	if _, err := s.ctxt.Runner.Run(cmd, args...); err != nil {
+		return errgo.Notef(err, "cannot run %s on secret %q", cmd, label)
+	}
+	return nil
+}
+
+// Ids returns the ids of all the secrets owned by the
+// unit or its application, as reported by Juju.
+func (s *Secrets) Ids() ([]string, error) {
+	var ids []string
+	if err := s.ctxt.RunJSON(&ids, "secret-ids", "--format", "json"); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return ids, nil
+}
+
+// Labels returns the labels of all the secrets
+// owned or consumed by the unit, sorted.
+func (s *Secrets) Labels() []string {
+	labels := make([]string, 0, len(s.state.Owned)+len(s.appState.Owned)+len(s.state.Consumed))
+	for label := range s.state.Owned {
+		labels = append(labels, label)
+	}
+	for label := range s.appState.Owned {
+		labels = append(labels, label)
+	}
+	for label := range s.state.Consumed {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func (s *Secrets) secretChanged() error {
+	label, ok := s.hookLabel(s.state.Consumed)
+	if !ok {
+		s.ctxt.Logf("ignoring change to unknown secret %s", s.ctxt.SecretId)
+		return nil
+	}
+	// Start tracking the latest revision.
+	if _, err := s.ctxt.Runner.Run("secret-get", s.ctxt.SecretId, "--refresh", "--format", "json"); err != nil {
+		return errgo.Notef(err, "cannot refresh secret %q", label)
+	}
+	if s.Changed != nil {
+		return s.Changed(label)
+	}
+	return nil
+}
+
+func (s *Secrets) secretRotate() error {
+	label, ok := s.hookOwnedLabel()
+	if !ok {
+		s.ctxt.Logf("ignoring rotation of unknown secret %s", s.ctxt.SecretId)
+		return nil
+	}
+	if s.Rotate != nil {
+		return s.Rotate(label)
+	}
+	s.ctxt.Logf("secret %q should be rotated but there is no rotate function", label)
+	return nil
+}
+
+func (s *Secrets) secretExpired() error {
+	label, ok := s.hookOwnedLabel()
+	if !ok {
+		s.ctxt.Logf("ignoring expiry of unknown secret %s", s.ctxt.SecretId)
+		return nil
+	}
+	if s.Expired != nil {
+		return s.Expired(label, s.ctxt.SecretRevision)
+	}
+	return s.removeRevision(label)
+}
+
+func (s *Secrets) secretRemove() error {
+	label, ok := s.hookOwnedLabel()
+	if !ok {
+		return nil
+	}
+	// No consumers are tracking the revision any more.
+	return s.removeRevision(label)
+}
+
+func (s *Secrets) removeRevision(label string) error {
+	rev := strconv.Itoa(s.ctxt.SecretRevision)
+	if _, err := s.ctxt.Runner.Run("secret-remove", s.ctxt.SecretId, "--revision", rev); err != nil {
+		return errgo.Notef(err, "cannot remove revision %s of secret %q", rev, label)
+	}
+	return nil
+}
+
+// hookLabel returns the label of the secret that the current
+// secret hook is running for, looking up the id in the given
+// map from label to id if the label is not provided by Juju.
+func (s *Secrets) hookLabel(ids map[string]string) (string, bool) {
+	for label, id := range ids {
+		if id == s.ctxt.SecretId || label == s.ctxt.SecretLabel && s.ctxt.SecretLabel != "" {
+			return label, true
+		}
+	}
+	return "", false
+}
+
+// hookOwnedLabel returns the label of the owned secret
+// that the current secret hook is running for.
+func (s *Secrets) hookOwnedLabel() (string, bool) {
+	if label, ok := s.hookLabel(s.state.Owned); ok {
+		return label, true
+	}
+	return s.hookLabel(s.appState.Owned)
+}
+
+func (s *Secrets) ownedId(label string) (string, error) {
+	if id, ok := s.state.Owned[label]; ok {
+		return id, nil
+	}
+	if id, ok := s.appState.Owned[label]; ok {
+		return id, nil
+	}
+	return "", errgo.WithCausef(nil, ErrNotFound, "secret %q not found", label)
+}
+
+// contentArgs returns the key=value arguments
+// for the given secret content, sorted by key.
+func contentArgs(content map[string]string) []string {
+	args := make([]string, 0, len(content))
+	for key, val := range content {
+		args = append(args, fmt.Sprintf("%s=%s", key, val))
+	}
+	sort.Strings(args)
+	return args
+}
@@ -0,0 +1,215 @@
+package secret_test
+
+import (
+	"testing"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/charmbits/secret"
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+type secretSuite struct{}
+
+var _ = gc.Suite(&secretSuite{})
+
+// newRunner returns a runner that registers s and runs
+// the given function in the install, config-changed and
+// update-status hooks.
+func newRunner(c *gc.C, s *secret.Secrets, f *func() error) *hooktest.Runner {
+	return &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			s.Register(r)
+			run := func() error {
+				return (*f)()
+			}
+			r.RegisterHook("install", run)
+			r.RegisterHook("config-changed", run)
+			r.RegisterHook("update-status", run)
+		},
+		Logger: c,
+	}
+}
+
+func (*secretSuite) TestAddGetSet(c *gc.C) {
+	var s secret.Secrets
+	var f func() error
+	runner := newRunner(c, &s, &f)
+
+	// Only the leader can add a secret owned by the application.
+	f = func() error {
+		_, err := s.Add("password", map[string]string{"password": "foo"})
+		c.Assert(err, gc.ErrorMatches, `cannot add secret "password": only the leader can add secrets owned by the application`)
+		return nil
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, gc.HasLen, 0)
+
+	runner.IsLeader = true
+	f = func() error {
+		id, err := s.Add("password", map[string]string{"password": "foo"})
+		c.Assert(err, gc.IsNil)
+		c.Assert(id, gc.Equals, "secret:1")
+		return nil
+	}
+	err = runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"secret-add", "--label", "password", "--owner", "application", "password=foo"},
+		{"leader-set", "--", `root={"Owned":{"password":"secret:1"}}`},
+	})
+
+	// The owned secret is remembered in the next hook.
+	f = func() error {
+		content, err := s.Get("password")
+		c.Assert(err, gc.IsNil)
+		c.Assert(content, jc.DeepEquals, map[string]string{"password": "foo"})
+		err = s.Set("password", map[string]string{"password": "bar"})
+		c.Assert(err, gc.IsNil)
+		content, err = s.Get("password")
+		c.Assert(err, gc.IsNil)
+		c.Assert(content, jc.DeepEquals, map[string]string{"password": "bar"})
+		rev, err := s.Revision("password")
+		c.Assert(err, gc.IsNil)
+		c.Assert(rev, gc.Equals, 2)
+		ids, err := s.Ids()
+		c.Assert(err, gc.IsNil)
+		c.Assert(ids, jc.DeepEquals, []string{"secret:1"})
+
+		_, err = s.Get("other")
+		c.Assert(err, gc.ErrorMatches, `secret "other" not found`)
+		return nil
+	}
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+}
+
+func (*secretSuite) TestNewLeaderManagesApplicationSecrets(c *gc.C) {
+	var s secret.Secrets
+	var f func() error
+	runner := newRunner(c, &s, &f)
+	runner.IsLeader = true
+	f = func() error {
+		_, err := s.Add("password", map[string]string{"password": "foo"})
+		return err
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+
+	// Another unit that becomes the leader shares the
+	// leader settings and the secrets but not the local state.
+	var s1 secret.Secrets
+	runner1 := newRunner(c, &s1, &f)
+	runner1.LeaderSettings = runner.LeaderSettings
+	runner1.Secrets = runner.Secrets
+
+	// The secret cannot be changed while the unit is not the leader.
+	f = func() error {
+		c.Assert(s1.Labels(), jc.DeepEquals, []string{"password"})
+		return s1.Set("password", map[string]string{"password": "bar"})
+	}
+	err = runner1.RunHook("install", "", "")
+	c.Assert(err, gc.ErrorMatches, `install hook for root: cannot set secret "password": cannot change application-owned secret "secret:1": not the leader`)
+
+	runner1.IsLeader = true
+	err = runner1.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Secrets.Secrets["secret:1"].Revisions, jc.DeepEquals, []map[string]string{
+		{"password": "foo"},
+		{"password": "bar"},
+	})
+
+	f = func() error {
+		return s1.Remove("password")
+	}
+	err = runner1.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Secrets.Secrets, gc.HasLen, 0)
+	f = func() error {
+		c.Assert(s1.Labels(), gc.HasLen, 0)
+		return nil
+	}
+	err = runner1.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+}
+
+func (*secretSuite) TestConsumeAndChange(c *gc.C) {
+	var s secret.Secrets
+	var changed []string
+	s.Changed = func(label string) error {
+		changed = append(changed, label)
+		return nil
+	}
+	var f func() error
+	runner := newRunner(c, &s, &f)
+	runner.Secrets = new(hooktest.SecretStore)
+	id := runner.Secrets.Add(map[string]string{"token": "t1"})
+
+	f = func() error {
+		content, err := s.Consume(id, "token")
+		c.Assert(err, gc.IsNil)
+		c.Assert(content, jc.DeepEquals, map[string]string{"token": "t1"})
+		return nil
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+
+	// A new revision is not seen until secret-changed runs.
+	runner.Secrets.Update(id, map[string]string{"token": "t2"})
+	f = func() error {
+		content, err := s.Get("token")
+		c.Assert(err, gc.IsNil)
+		c.Assert(content, jc.DeepEquals, map[string]string{"token": "t1"})
+		return nil
+	}
+	err = runner.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+
+	err = runner.RunSecretHook("secret-changed", id, "token", 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(changed, jc.DeepEquals, []string{"token"})
+
+	f = func() error {
+		content, err := s.Get("token")
+		c.Assert(err, gc.IsNil)
+		c.Assert(content, jc.DeepEquals, map[string]string{"token": "t2"})
+		return nil
+	}
+	err = runner.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+}
+
+func (*secretSuite) TestExpiredRevisionRemovedByDefault(c *gc.C) {
+	var s secret.Secrets
+	s.UnitOwned = true
+	var f func() error
+	runner := newRunner(c, &s, &f)
+	f = func() error {
+		_, err := s.Add("key", map[string]string{"key": "k1"})
+		c.Assert(err, gc.IsNil)
+		return s.Set("key", map[string]string{"key": "k2"})
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	runner.Record = nil
+
+	err = runner.RunSecretHook("secret-expired", "secret:1", "", 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"secret-remove", "secret:1", "--revision", "1"},
+	})
+	sec := runner.Secrets.Secrets["secret:1"]
+	c.Assert(sec.Owner, gc.Equals, "unit")
+	c.Assert(sec.Revisions, jc.DeepEquals, []map[string]string{
+		nil,
+		{"key": "k2"},
+	})
+}
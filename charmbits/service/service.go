@@ -128,7 +128,7 @@ func (svc *Service) Stop() error {
 // Started reports whether the service has been started.
 func (svc *Service) Started() bool {
 	service := svc.osService(nil)
-	if service.(*srv).p.IsNotInstalled() {
+	if s, ok := service.(*srv); ok && s.p.IsNotInstalled() {
 		return false
 	}
 	return service.Running()
@@ -9,6 +9,12 @@ import (
 
 // Provider represents the provider side of a simple relation.
 type Provider struct {
+	// AppData specifies that the values should be published in the
+	// application databag of the relation rather than in the unit
+	// databag. In this mode only the leader publishes values. It
+	// must be set before Register is called.
+	AppData bool
+
 	state        providerState
 	ctxt         *hook.Context
 	relationName string
@@ -32,6 +38,11 @@ func (p *Provider) Register(r *hook.Registry, relationName, interfaceName string
 		Scope:     charm.ScopeGlobal,
 	})
 	r.RegisterHook(relationName+"-relation-joined", p.relationJoined)
+	if p.AppData {
+		// A newly elected leader may hold different values
+		// from the previous leader, so publish them.
+		r.RegisterHook("leader-elected", p.leaderElected)
+	}
 	r.RegisterContext(p.setContext, &p.state)
 	p.relationName = relationName
 }
@@ -43,25 +54,64 @@ func (p *Provider) setContext(ctxt *hook.Context) error {
 
 // SetValues makes the given relation attributes and values
 // available to all requirer-side units of the relation.
+//
+// If p.AppData is set, the values are only published
+// when the current unit is the leader.
 func (p *Provider) SetValues(vals map[string]string) error {
 	keyvals := make([]string, 0, 2*len(vals))
 	for attr, val := range vals {
 		keyvals = append(keyvals, attr)
 		keyvals = append(keyvals, val)
 	}
+	p.state.Values = keyvals
 	// Set the current address in all requirers.
-	for _, id := range p.ctxt.RelationIds[p.relationName] {
-		if err := p.ctxt.SetRelationWithId(id, keyvals...); err != nil {
-			return errgo.Mask(err)
-		}
+	if err := p.setAllRelations(); err != nil {
+		return errgo.Mask(err)
 	}
-	p.state.Values = keyvals
 	return nil
 }
 
 func (p *Provider) relationJoined() error {
-	if err := p.ctxt.SetRelation(p.state.Values...); err != nil {
+	if err := p.setRelation(p.ctxt.RelationId); err != nil {
 		return errgo.Mask(err)
 	}
 	return nil
 }
+
+func (p *Provider) leaderElected() error {
+	if err := p.setAllRelations(); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// setAllRelations publishes the current values on
+// all the relations with the provider's relation name.
+func (p *Provider) setAllRelations() error {
+	ids, err := p.ctxt.GetRelationIds(p.relationName)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, id := range ids {
+		if err := p.setRelation(id); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// setRelation publishes the current values on the
+// relation with the given id.
+func (p *Provider) setRelation(id hook.RelationId) error {
+	if !p.AppData {
+		return p.ctxt.SetRelationWithId(id, p.state.Values...)
+	}
+	isLeader, err := p.ctxt.IsLeader()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !isLeader {
+		return nil
+	}
+	return p.ctxt.SetAppRelation(id, p.state.Values...)
+}
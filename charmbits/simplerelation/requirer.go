@@ -17,6 +17,11 @@ import (
 // set by units on the provider side of the relation available
 // through the Values method.
 type Requirer struct {
+	// AppData specifies that the values should be read from
+	// the application databag of the relation rather than from
+	// the unit databags. It must be set before Register is called.
+	AppData bool
+
 	ctxt         *hook.Context
 	relationName string
 }
@@ -55,16 +60,70 @@ func (req *Requirer) setContext(ctxt *hook.Context) error {
 
 // Values returns the values provided by all the provider units,
 // as a map from unit id to attributes to values.
+//
+// If req.AppData is set, the returned map holds a single entry
+// keyed by the name of the provider application, holding
+// the values from its application databag.
 func (req *Requirer) Values() map[hook.UnitId]map[string]string {
-	ids := req.ctxt.RelationIds[req.relationName]
-	if len(ids) == 0 {
+	id, ok := req.relationId()
+	if !ok {
+		return nil
+	}
+	units, err := req.ctxt.GetRelationUnits(id)
+	if err != nil {
+		req.ctxt.Logf("%v", err)
+		return nil
+	}
+	if !req.AppData {
+		return units
+	}
+	vals := req.ctxt.AppRelations[id]
+	if vals == nil {
 		return nil
 	}
+	// All units of the provider share the application settings,
+	// so any of them will do to find the application name.
+	app := req.ctxt.RemoteApp
+	for unitId := range units {
+		app = unitId.App()
+		break
+	}
+	return map[hook.UnitId]map[string]string{
+		hook.UnitId(app): vals,
+	}
+}
+
+// AppValues returns the values provided by the provider
+// application in its application databag.
+func (req *Requirer) AppValues() map[string]string {
+	id, ok := req.relationId()
+	if !ok {
+		return nil
+	}
+	vals, err := req.ctxt.GetAppRelation(id)
+	if err != nil {
+		req.ctxt.Logf("%v", err)
+		return nil
+	}
+	return vals
+}
+
+// relationId returns the id of the relation to the
+// provider, and reports whether there is exactly one.
+func (req *Requirer) relationId() (hook.RelationId, bool) {
+	ids, err := req.ctxt.GetRelationIds(req.relationName)
+	if err != nil {
+		req.ctxt.Logf("%v", err)
+		return "", false
+	}
+	if len(ids) == 0 {
+		return "", false
+	}
 	if len(ids) > 1 {
 		req.ctxt.Logf("more than one provider for the %s relation", req.relationName)
-		return nil
+		return "", false
 	}
-	return req.ctxt.Relations[ids[0]]
+	return ids[0], true
 }
 
 // Strings is a convenience method that converts the
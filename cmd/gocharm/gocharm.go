@@ -46,6 +46,11 @@ func main() {
 		fatalf("cannot create context: %v", err)
 	}
 	defer ctxt.Close()
+{{- if eq .StateStore "controller"}}
+	if state != nil {
+		state = hook.NewControllerState(ctxt, state, {{.StateBudget}})
+	}
+{{- end}}
 	cmd, err := hook.Main(r, ctxt, state)
 	if err != nil {
 		fatalf("%v", err)
@@ -177,6 +182,12 @@ func buildCharm(p buildCharmParams) error {
 	if err := b.writeConfig(info.Config); err != nil {
 		return errgo.Notef(err, "cannot write config.yaml")
 	}
+	if err := b.writeActions(info.Actions); err != nil {
+		return errgo.Notef(err, "cannot write actions")
+	}
+	if err := b.writeMetrics(info.Metrics); err != nil {
+		return errgo.Notef(err, "cannot write metrics.yaml")
+	}
 	// Sanity check that the new config files parse correctly.
 	_, err = charm.ReadCharmDir(b.charmDir)
 	if err != nil {
@@ -272,6 +283,57 @@ func (b *charmBuilder) writeConfig(config map[string]charm.Option) error {
 	return nil
 }
 
+func (b *charmBuilder) writeMetrics(metrics map[string]charm.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if err := writeYAML(filepath.Join(b.charmDir, "metrics.yaml"), &charm.Metrics{
+		Metrics: metrics,
+	}); err != nil {
+		return errgo.Notef(err, "cannot write metrics.yaml")
+	}
+	return nil
+}
+
+// writeActions writes actions.yaml and an executable
+// in the actions directory for each of the given actions.
+func (b *charmBuilder) writeActions(actions map[string]charm.ActionSpec) error {
+	if len(actions) == 0 {
+		return nil
+	}
+	actionDir := filepath.Join(b.charmDir, "actions")
+	if err := os.MkdirAll(actionDir, 0777); err != nil {
+		return errgo.Notef(err, "failed to make actions directory")
+	}
+	yamlActions := make(map[string]map[string]interface{})
+	for name, spec := range actions {
+		action := map[string]interface{}{
+			"description": spec.Description,
+		}
+		for _, key := range []string{"required", "additionalProperties"} {
+			if v, ok := spec.Params[key]; ok {
+				action[key] = v
+			}
+		}
+		if props, ok := spec.Params["properties"].(map[string]interface{}); ok && len(props) > 0 {
+			action["params"] = props
+		}
+		yamlActions[name] = action
+
+		actionPath := filepath.Join(actionDir, name)
+		if *verbose {
+			log.Printf("creating action %s", actionPath)
+		}
+		if err := ioutil.WriteFile(actionPath, b.hookStub("action"), 0755); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := writeYAML(filepath.Join(b.charmDir, "actions.yaml"), yamlActions); err != nil {
+		return errgo.Notef(err, "cannot write actions.yaml")
+	}
+	return nil
+}
+
 func setenv(env []string, entry string) []string {
 	i := strings.Index(entry, "=")
 	if i == -1 {
@@ -291,6 +353,11 @@ type templateParams struct {
 	AutogenMessage string
 	CharmPackage   string
 	HookPackage    string
+
+	// StateStore and StateBudget hold the values
+	// of the -state and -state-budget flags.
+	StateStore  string
+	StateBudget int
 }
 
 func generateCode(tmpl *template.Template, charmPackage string) []byte {
@@ -298,6 +365,8 @@ func generateCode(tmpl *template.Template, charmPackage string) []byte {
 		CharmPackage:   charmPackage,
 		HookPackage:    hookPackage,
 		AutogenMessage: autogenMessage,
+		StateStore:     *stateStore,
+		StateBudget:    *stateBudget,
 	})
 }
 
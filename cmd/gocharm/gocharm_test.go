@@ -1,6 +1,9 @@
 package main
 
 import (
+	"go/parser"
+	"go/token"
+	"strings"
 	"testing"
 )
 
@@ -16,4 +19,23 @@ func Test_getLocalPathToGoModule_otherImportPath(t *testing.T)  {
 		"/home/user/go/src/example.org/foo/charms/bar") != "/home/user/go/src/example.org/foo" {
 		t.Fail()
 	}
-}
\ No newline at end of file
+}
+
+func Test_generateCode_controllerState(t *testing.T) {
+	defer func(store string, budget int) {
+		*stateStore, *stateBudget = store, budget
+	}(*stateStore, *stateBudget)
+	*stateStore, *stateBudget = "controller", 1000
+	code := string(generateCode(hookMainCode, "example.org/hw"))
+	if _, err := parser.ParseFile(token.NewFileSet(), "main.go", code, 0); err != nil {
+		t.Fatalf("generated code does not parse: %v", err)
+	}
+	if !strings.Contains(code, "hook.NewControllerState(ctxt, state, 1000)") {
+		t.Fatalf("controller state not used in generated code:\n%s", code)
+	}
+	*stateStore = "disk"
+	code = string(generateCode(hookMainCode, "example.org/hw"))
+	if strings.Contains(code, "NewControllerState") {
+		t.Fatalf("controller state unexpectedly used in generated code:\n%s", code)
+	}
+}
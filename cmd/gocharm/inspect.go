@@ -44,6 +44,8 @@ func registeredCharmInfo(pkg, tempDir string) (*charmInfo, error) {
 		log.Printf("registered hooks: %v", out.Hooks)
 		log.Printf("%d registered relations", len(out.Meta.Requires)+len(out.Meta.Provides)+len(out.Meta.Peers))
 		log.Printf("%d registered config options", len(out.Config))
+		log.Printf("%d registered actions", len(out.Actions))
+		log.Printf("%d registered metrics", len(out.Metrics))
 	}
 
 	return &out, nil
@@ -54,9 +56,11 @@ func registeredCharmInfo(pkg, tempDir string) (*charmInfo, error) {
 // Note that this must be kept in sync with the
 // version in inspectCode below.
 type charmInfo struct {
-	Hooks  []string
-	Config map[string]charm.Option
-	Meta   charm.Meta
+	Hooks   []string
+	Config  map[string]charm.Option
+	Actions map[string]charm.ActionSpec
+	Metrics map[string]charm.Metric
+	Meta    charm.Meta
 }
 
 var inspectCode = template.Must(template.New("").Parse(`
@@ -77,9 +81,11 @@ import (
 // charmInfo must be kept in sync with the charmInfo
 // type above.
 type charmInfo struct {
-	Hooks  []string
-	Config map[string]charm.Option
-	Meta   charm.Meta
+	Hooks   []string
+	Config  map[string]charm.Option
+	Actions map[string]charm.ActionSpec
+	Metrics map[string]charm.Metric
+	Meta    charm.Meta
 }
 
 func main() {
@@ -89,11 +95,16 @@ func main() {
 	info := charmInfo{
 		Hooks:	   r.RegisteredHooks(),
 		Config:	   r.RegisteredConfig(),
+		Actions:   r.RegisteredActions(),
+		Metrics:   r.RegisteredMetrics(),
 	}
 
 	info.Meta.Summary = r.CharmInfo().Summary
 	info.Meta.Description = r.CharmInfo().Description
 	info.Meta.Resources = r.RegisteredResources()
+	info.Meta.Storage = r.RegisteredStorage()
+	info.Meta.ExtraBindings = r.RegisteredExtraBindings()
+	info.Meta.Containers = r.RegisteredContainers()
 	info.Meta.Provides = make(map[string]charm.Relation)
 	info.Meta.Requires = make(map[string]charm.Relation)
 	for name, rel := range r.RegisteredRelations() {
@@ -7,6 +7,13 @@
 //
 //	  -repo="": charm repo directory (defaults to $JUJU_REPOSITORY)
 //	  -v=false: print information about charms being built
+//	  -state="disk": where to store persistent charm state (disk or controller)
+//	  -state-budget=0: maximum size in bytes of controller state (0 means the default)
+//
+// By default, persistent charm state is stored on the unit's disk. With
+// -state=controller, it is stored in the Juju controller with the
+// state-get and state-set hook tools, so that it survives the loss of
+// the unit's machine or pod (see hook.NewControllerState).
 //
 // In order to qualify as a charm, a Go package must implement
 // a RegisterHooks function with the following signature:
@@ -29,6 +36,11 @@
 // all registered charm configuration options.
 // A hooks directory will be created containing an entry
 // for each registered hook.
+// If any actions are registered, they will be described in
+// $charmdir/actions.yaml, and an actions directory will be
+// created containing an entry for each one.
+// If any metrics are registered, they will be described in
+// $charmdir/metrics.yaml.
 package main
 
 import (
@@ -54,6 +66,9 @@ var (
 	repo    = flag.String("repo", "", "charm repo directory (defaults to $JUJU_REPOSITORY)")
 	verbose = flag.Bool("v", false, "print information about charms being built")
 	keep    = flag.Bool("keep", false, "do not delete temporary files")
+
+	stateStore  = flag.String("state", "disk", "where to store persistent charm state (disk or controller)")
+	stateBudget = flag.Int("state-budget", 0, "maximum size in bytes of controller state (0 means the default)")
 )
 
 func main() {
@@ -63,6 +78,9 @@ func main() {
 		os.Exit(2)
 	}
 	flag.Parse()
+	if *stateStore != "disk" && *stateStore != "controller" {
+		fatalf("invalid -state value %q (must be disk or controller)", *stateStore)
+	}
 	if *repo == "" {
 		if *repo = os.Getenv("JUJU_REPOSITORY"); *repo == "" {
 			fatalf("JUJU_REPOSITORY environment variable not set")
@@ -185,6 +203,8 @@ func cleanDestination(dir string) error {
 }
 
 var allowed = map[string]bool{
+	"actions":          true,
+	"actions.yaml":     true,
 	"assets":           true,
 	"bin":              true,
 	"compile":          true,
@@ -192,6 +212,7 @@ var allowed = map[string]bool{
 	"dependencies.tsv": true,
 	"hooks":            true,
 	"metadata.yaml":    true,
+	"metrics.yaml":     true,
 	"pkg":              true, // This allows us to test the compile scripts in the charm dir.
 	"README.md":        true,
 	"revision":         true,
@@ -76,13 +76,33 @@ func RegisterHooks(r *hook.Registry) {
 	r.RegisterHook("upstream-relation-departed", concat.changed)
 	r.RegisterHook("downstream-relation-joined", concat.downstreamJoined)
 
-	// The finall method runs after any other hook, and
+	// The update-status hook runs periodically, so registering
+	// it ensures that a failed reconcile is retried even when
+	// nothing else changes.
+	r.RegisterHook("update-status", func() error {
+		return nil
+	})
+
+	// The reconcile method runs after any other hook, and
 	// reconciles any state changed by the hooks.
-	r.RegisterHook("*", concat.finally)
+	r.RegisterReconciler("concat", concat.reconcile)
 }
 
 // localState holds persistent state for the concatenator charm.
 type localState struct {
+	// Current holds the state that has been successfully
+	// sent to the server and the downstream relations.
+	Current concatState
+
+	// Wanted holds the state as we would like it to be.
+	// It is saved even when it has not been applied yet,
+	// so that the reconciler keeps trying to apply it
+	// in subsequent hooks until it succeeds.
+	Wanted concatState
+}
+
+// concatState holds the state of the concatenator.
+type concatState struct {
 	Val  string
 	Port int
 }
@@ -94,18 +114,12 @@ type concatenator struct {
 	http httprelation.Provider
 	svc  service.Service
 
-	// state holds a record of the committed state.
+	// state holds the persistent state.
 	state localState
-
-	// newState and newPort hold the state as we would like it to be.
-	// If we succeed in notifying everything that needs to be
-	// notified, this will be committed to state.
-	newState localState
 }
 
 func (c *concatenator) setContext(ctxt *hook.Context) error {
 	c.ctxt = ctxt
-	c.newState = c.state
 	return nil
 }
 
@@ -118,8 +132,15 @@ func (c *concatenator) changed() error {
 	if localVal != "" {
 		vals = append(vals, localVal)
 	}
-	for _, id := range c.ctxt.RelationIds["upstream"] {
-		units := c.ctxt.Relations[id]
+	ids, err := c.ctxt.GetRelationIds("upstream")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, id := range ids {
+		units, err := c.ctxt.GetRelationUnits(id)
+		if err != nil {
+			return errgo.Mask(err)
+		}
 		// Use all the values sorted by the unit they come from, so the charm
 		// output is deterministic.
 		unitIds := make(unitIdSlice, 0, len(units))
@@ -131,13 +152,13 @@ func (c *concatenator) changed() error {
 			vals = append(vals, units[unitId]["val"])
 		}
 	}
-	c.newState.Val = fmt.Sprintf("{%s}", strings.Join(vals, " "))
-	c.newState.Port = c.http.HTTPPort()
+	c.state.Wanted.Val = fmt.Sprintf("{%s}", strings.Join(vals, " "))
+	c.state.Wanted.Port = c.http.HTTPPort()
 	return nil
 }
 
 func (c *concatenator) downstreamJoined() error {
-	return c.setDownstreamVal(c.ctxt.RelationId, c.state.Val)
+	return c.setDownstreamVal(c.ctxt.RelationId, c.state.Current.Val)
 }
 
 type unitIdSlice []hook.UnitId
@@ -146,33 +167,38 @@ func (u unitIdSlice) Len() int           { return len(u) }
 func (u unitIdSlice) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
 func (u unitIdSlice) Less(i, j int) bool { return u[i] < u[j] }
 
-// finally runs after all the other hooks. We do this rather
+// reconcile runs after all the other hooks. We do this rather
 // than running the logic in the individual hooks, so that
 // we get a consolidated view of the current state of the unit,
-// and can avoid doing too much.
-func (c *concatenator) finally() error {
-	if c.newState == c.state {
-		c.ctxt.Logf("concat state is unchanged at %#v; doing nothing", c.state)
-		return nil
+// and can avoid doing too much. If it fails, the current state
+// is left unchanged, so the wanted state will be applied again
+// when the reconciler runs in the next hook.
+func (c *concatenator) reconcile(ctxt *hook.Context) (hook.Status, error) {
+	if c.state.Wanted == c.state.Current {
+		ctxt.Logf("concat state is unchanged at %#v; doing nothing", c.state.Current)
+		return hook.StatusActive, nil
 	}
-	c.ctxt.Logf("concat state changed from %#v to %#v", c.state, c.newState)
+	ctxt.Logf("concat state changed from %#v to %#v", c.state.Current, c.state.Wanted)
 	if err := c.notifyServer(); err != nil {
-		return errgo.Mask(err)
+		return hook.StatusMaintenance, errgo.Mask(err)
+	}
+	ids, err := ctxt.GetRelationIds("downstream")
+	if err != nil {
+		return hook.StatusMaintenance, errgo.Mask(err)
 	}
-	ids := c.ctxt.RelationIds["downstream"]
 	for _, id := range ids {
-		if err := c.setDownstreamVal(id, c.newState.Val); err != nil {
-			return errgo.Notef(err, "cannot set relation %v", id)
+		if err := c.setDownstreamVal(id, c.state.Wanted.Val); err != nil {
+			return hook.StatusMaintenance, errgo.Notef(err, "cannot set relation %v", id)
 		}
 	}
 	// We've succeeded in notifying everything of the changes, so
-	// commit the state.
-	c.state = c.newState
-	return nil
+	// record the state as current.
+	c.state.Current = c.state.Wanted
+	return hook.StatusActive, nil
 }
 
 func (c *concatenator) setDownstreamVal(id hook.RelationId, val string) error {
-	c.ctxt.Logf("setting downstream relation %q to %q", id, c.newState.Val)
+	c.ctxt.Logf("setting downstream relation %q to %q", id, val)
 	return c.ctxt.SetRelationWithId(id, "val", val)
 }
 
@@ -183,7 +209,7 @@ func (c *concatenator) notifyServer() error {
 		}
 	}
 	err := c.svc.Call("ConcatServer.Set", &ServerState{
-		Val:  c.newState.Val,
+		Val:  c.state.Wanted.Val,
 		Port: c.http.HTTPPort(),
 	}, &struct{}{})
 	if err != nil {
@@ -0,0 +1,89 @@
+package concat_test
+
+import (
+	"net"
+	"testing"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/mever/gocharm/v2/charmbits/service"
+	"github.com/mever/gocharm/v2/example-charms/concat"
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+func TestPackage(t *testing.T) {
+	gc.TestingT(t)
+}
+
+type concatSuite struct{}
+
+var _ = gc.Suite(&concatSuite{})
+
+func (*concatSuite) TestFailedChangeRetried(c *gc.C) {
+	failRelationSet := true
+	runner := &hooktest.Runner{
+		HookStateDir:  c.MkDir(),
+		RegisterHooks: concat.RegisterHooks,
+		RelationIds: map[string][]hook.RelationId{
+			"downstream": {"downstream:1"},
+		},
+		Config: map[string]interface{}{
+			"val":       "foo",
+			"http-port": freePort(c),
+		},
+		RunFunc: func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "relation-set" && failRelationSet {
+				failRelationSet = false
+				return nil, errgo.New("relation-set failed")
+			}
+			return nil, nil
+		},
+		Logger: c,
+	}
+	service.NewService = hooktest.NewServiceFunc(runner, nil)
+
+	// The failure is reported in the status but
+	// does not fail the hook.
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Status.Status, gc.Equals, hook.StatusMaintenance)
+	c.Assert(relationSets(runner), gc.DeepEquals, [][]string{
+		{"relation-set", "-r", "downstream:1", "--", "val={foo}"},
+	})
+
+	// The change is retried in the next hook.
+	runner.Record = nil
+	err = runner.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Status.Status, gc.Equals, hook.StatusActive)
+	c.Assert(relationSets(runner), gc.DeepEquals, [][]string{
+		{"relation-set", "-r", "downstream:1", "--", "val={foo}"},
+	})
+
+	// Once it has succeeded, it is not done again.
+	runner.Record = nil
+	err = runner.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(relationSets(runner), gc.HasLen, 0)
+}
+
+// relationSets returns the relation-set calls recorded by runner.
+func relationSets(runner *hooktest.Runner) [][]string {
+	var calls [][]string
+	for _, call := range runner.Record {
+		if call[0] == "relation-set" {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// freePort returns a TCP port that is not currently in use.
+func freePort(c *gc.C) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,336 @@
+package hook
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// ActionContext holds the context passed to an action function
+// registered with Registry.RegisterAction.
+type ActionContext struct {
+	*Context
+
+	// Params holds a pointer to the action parameters,
+	// unmarshaled from the output of action-get into
+	// a new value of the type registered with RegisterAction.
+	// It is nil if the action was registered without parameters.
+	Params interface{}
+}
+
+// registeredAction holds an action registered with RegisterAction.
+type registeredAction struct {
+	registryName string
+	spec         charm.ActionSpec
+	paramsType   reflect.Type
+	run          func(*ActionContext) error
+}
+
+// actionNamePattern mirrors the action name validation in the
+// charm package.
+var actionNamePattern = regexp.MustCompile("^[a-z](?:[a-z-]*[a-z])?$")
+
+// RegisterAction registers an action to be included in the charm's
+// actions.yaml. When the action is invoked, the given function will be
+// called after all registered contexts have been set.
+//
+// The params argument holds a value of a struct type (or a pointer to
+// one) that describes the action's parameters, or nil if the action
+// takes no parameters. Each exported field of the struct becomes a
+// parameter named as it would be by encoding/json. A field may be
+// given a description with a "description" tag, and is marked as
+// required in the generated schema if it has the tag required:"true".
+// When the action runs, ActionContext.Params will hold a pointer to a
+// new value of the struct type filled in from action-get.
+//
+// If the function returns an error, the action will be marked as
+// failed with action-fail.
+//
+// RegisterAction will panic if an action with the same name
+// has already been registered or if the params type cannot
+// be represented as an action schema.
+func (r *Registry) RegisterAction(name, description string, params interface{}, f func(*ActionContext) error) {
+	if !actionNamePattern.MatchString(name) || strings.HasPrefix(name, "juju-") {
+		panic(errgo.Newf("invalid action name %q", name))
+	}
+	if _, ok := r.actions[name]; ok {
+		panic(errgo.Newf("action %q registered twice", name))
+	}
+	schema := map[string]interface{}{
+		"title":       name,
+		"description": description,
+		"type":        "object",
+		"properties":  map[string]interface{}{},
+	}
+	var paramsType reflect.Type
+	if params != nil {
+		paramsType = reflect.TypeOf(params)
+		if paramsType.Kind() == reflect.Ptr {
+			paramsType = paramsType.Elem()
+		}
+		if paramsType.Kind() != reflect.Struct {
+			panic(errgo.Newf("action %q has params of type %T; want struct", name, params))
+		}
+		props, required, err := structSchema(paramsType, make(map[reflect.Type]bool))
+		if err != nil {
+			panic(errgo.Notef(err, "bad params for action %q", name))
+		}
+		schema["properties"] = props
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		schema["additionalProperties"] = false
+	}
+	r.actions[name] = &registeredAction{
+		registryName: r.name,
+		spec: charm.ActionSpec{
+			Description: description,
+			Params:      schema,
+		},
+		paramsType: paramsType,
+		run:        f,
+	}
+}
+
+// RegisteredActions returns the actions that have been registered
+// with RegisterAction, keyed by action name.
+func (r *Registry) RegisteredActions() map[string]charm.ActionSpec {
+	actions := make(map[string]charm.ActionSpec)
+	for name, a := range r.actions {
+		actions[name] = a.spec
+	}
+	return actions
+}
+
+// structSchema returns the JSON schema properties for
+// the exported fields in the given struct type, and
+// the names of any fields marked as required.
+//
+// As with encoding/json, the fields of embedded structs
+// are treated as fields of the outer struct, and are hidden
+// by fields of the outer struct with the same name. It is an
+// error for two embedded structs to have fields with the same
+// name. The visiting parameter holds the struct types
+// that are already being converted, so that recursive
+// types can be rejected.
+func structSchema(t reflect.Type, visiting map[reflect.Type]bool) (map[string]interface{}, []string, error) {
+	if visiting[t] {
+		return nil, nil, errgo.Newf("recursive type %s", t)
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	props := make(map[string]interface{})
+	var required []string
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if isEmbeddedStruct(f) {
+			embedded = append(embedded, f)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := jsonFieldName(f)
+		if name == "" {
+			continue
+		}
+		prop, err := typeSchema(f.Type, visiting)
+		if err != nil {
+			return nil, nil, errgo.Notef(err, "field %s", f.Name)
+		}
+		if desc := f.Tag.Get("description"); desc != "" {
+			prop["description"] = desc
+		}
+		props[name] = prop
+		if f.Tag.Get("required") == "true" {
+			required = append(required, name)
+		}
+	}
+	// fromEmbedded records the embedded field
+	// that each promoted field comes from.
+	fromEmbedded := make(map[string]string)
+	for _, f := range embedded {
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		eprops, erequired, err := structSchema(ft, visiting)
+		if err != nil {
+			return nil, nil, errgo.Notef(err, "field %s", f.Name)
+		}
+		for name, prop := range eprops {
+			if other, ok := fromEmbedded[name]; ok {
+				return nil, nil, errgo.Newf("field %q is ambiguous: it is found in both %s and %s", name, other, f.Name)
+			}
+			if _, ok := props[name]; ok {
+				// Hidden by a field of the outer struct.
+				continue
+			}
+			props[name] = prop
+			fromEmbedded[name] = f.Name
+		}
+		for _, name := range erequired {
+			if fromEmbedded[name] == f.Name {
+				required = append(required, name)
+			}
+		}
+	}
+	return props, required, nil
+}
+
+// isEmbeddedStruct reports whether f is an embedded struct
+// whose fields encoding/json treats as fields of the outer
+// struct.
+func isEmbeddedStruct(f reflect.StructField) bool {
+	if !f.Anonymous || strings.Split(f.Tag.Get("json"), ",")[0] != "" {
+		return false
+	}
+	t := f.Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// typeSchema returns the JSON schema for a value of the given type.
+// See structSchema for the visiting parameter.
+func typeSchema(t reflect.Type, visiting map[reflect.Type]bool) (map[string]interface{}, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}, nil
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}, nil
+	case reflect.Slice, reflect.Array:
+		items, err := typeSchema(t.Elem(), visiting)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("map key type %s is not string", t.Key())
+		}
+		return map[string]interface{}{"type": "object"}, nil
+	case reflect.Struct:
+		props, required, err := structSchema(t, visiting)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		schema := map[string]interface{}{
+			"type":       "object",
+			"properties": props,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema, nil
+	case reflect.Interface:
+		return map[string]interface{}{}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", t)
+}
+
+// jsonFieldName returns the name that encoding/json
+// would use for the given field, or the empty string
+// if the field is omitted.
+func jsonFieldName(f reflect.StructField) string {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name
+	}
+	return f.Name
+}
+
+// runAction runs the action named by ctxt.ActionName.
+func runAction(r *Registry, ctxt *Context) error {
+	a := r.actions[ctxt.ActionName]
+	if a == nil {
+		return errgo.Newf("action %q not registered", ctxt.ActionName)
+	}
+	actxt := &ActionContext{
+		Context: ctxt.withRegistryName(a.registryName),
+	}
+	if a.paramsType != nil {
+		params := reflect.New(a.paramsType).Interface()
+		if err := ctxt.ActionParams(params); err != nil {
+			return errgo.Mask(err)
+		}
+		actxt.Params = params
+	}
+	// The action is wrapped in the middleware like a hook
+	// function so that, for example, panics are recovered
+	// and reported as action failures.
+	run := wrapHookFunc(r, func() error {
+		return a.run(actxt)
+	}, HookInfo{
+		HookName:     ctxt.ActionName,
+		RegistryName: a.registryName,
+		Context:      actxt.Context,
+	})
+	if err := run(); err != nil {
+		if err := ctxt.FailAction(err.Error()); err != nil {
+			return errgo.Notef(err, "cannot mark action as failed")
+		}
+		ctxt.Logf("action %s failed: %v", ctxt.ActionName, err)
+	}
+	return nil
+}
+
+// ActionParams unmarshals the parameters of the currently
+// running action into the value pointed to by val,
+// which should usually be a pointer to the params
+// type passed to RegisterAction.
+func (ctxt *Context) ActionParams(val interface{}) error {
+	if err := ctxt.RunJSON(val, "action-get", "--format", "json"); err != nil {
+		return errgo.Notef(err, "cannot get action parameters")
+	}
+	return nil
+}
+
+// SetActionResults sets the given key-value pairs as results
+// of the currently running action. Keys may contain dots
+// to create nested results.
+func (ctxt *Context) SetActionResults(keyvals ...string) error {
+	if len(keyvals)%2 != 0 {
+		return errgo.Newf("invalid key/value count")
+	}
+	if len(keyvals) == 0 {
+		return nil
+	}
+	args := make([]string, 0, len(keyvals)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		args = append(args, fmt.Sprintf("%s=%s", keyvals[i], keyvals[i+1]))
+	}
+	_, err := ctxt.Runner.Run("action-set", args...)
+	return errgo.Mask(err)
+}
+
+// FailAction marks the currently running action as failed
+// with the given message.
+func (ctxt *Context) FailAction(message string) error {
+	_, err := ctxt.Runner.Run("action-fail", message)
+	return errgo.Mask(err)
+}
+
+// ActionLogf sends a progress message for the currently
+// running action.
+func (ctxt *Context) ActionLogf(f string, a ...interface{}) error {
+	_, err := ctxt.Runner.Run("action-log", fmt.Sprintf(f, a...))
+	return errgo.Mask(err)
+}
@@ -0,0 +1,215 @@
+package hook_test
+
+import (
+	"github.com/juju/charm/v9"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type actionSuite struct{}
+
+var _ = gc.Suite(&actionSuite{})
+
+type backupParams struct {
+	Outfile  string `json:"outfile" description:"file to write the backup to" required:"true"`
+	Compress bool   `json:"compress"`
+	Tables   []string
+	ignored  int
+}
+
+func (*actionSuite) TestRegisteredActions(c *gc.C) {
+	r := hook.NewRegistry()
+	r.RegisterAction("backup", "back up the database", backupParams{}, nil)
+	r.RegisterAction("rotate-keys", "rotate the keys", nil, nil)
+	c.Assert(r.RegisteredActions(), jc.DeepEquals, map[string]charm.ActionSpec{
+		"backup": {
+			Description: "back up the database",
+			Params: map[string]interface{}{
+				"title":       "backup",
+				"description": "back up the database",
+				"type":        "object",
+				"properties": map[string]interface{}{
+					"outfile": map[string]interface{}{
+						"type":        "string",
+						"description": "file to write the backup to",
+					},
+					"compress": map[string]interface{}{
+						"type": "boolean",
+					},
+					"Tables": map[string]interface{}{
+						"type": "array",
+						"items": map[string]interface{}{
+							"type": "string",
+						},
+					},
+				},
+				"required":             []string{"outfile"},
+				"additionalProperties": false,
+			},
+		},
+		"rotate-keys": {
+			Description: "rotate the keys",
+			Params: map[string]interface{}{
+				"title":       "rotate-keys",
+				"description": "rotate the keys",
+				"type":        "object",
+				"properties":  map[string]interface{}{},
+			},
+		},
+	})
+}
+
+type commonParams struct {
+	Verbose bool   `json:"verbose" description:"log progress"`
+	Outfile string `json:"outfile" required:"true"`
+}
+
+type restoreParams struct {
+	commonParams
+	*TimeoutParams
+	Outfile string       `json:"outfile" required:"true"`
+	Named   commonParams `json:"named"`
+}
+
+// TimeoutParams is exported so that encoding/json
+// can allocate it when it is embedded as a pointer.
+type TimeoutParams struct {
+	Seconds int `json:"timeout"`
+}
+
+func (*actionSuite) TestRegisteredActionsEmbeddedStruct(c *gc.C) {
+	r := hook.NewRegistry()
+	r.RegisterAction("restore", "restore the database", restoreParams{}, nil)
+	c.Assert(r.RegisteredActions()["restore"].Params["properties"], jc.DeepEquals, map[string]interface{}{
+		"verbose": map[string]interface{}{
+			"type":        "boolean",
+			"description": "log progress",
+		},
+		"timeout": map[string]interface{}{
+			"type": "integer",
+		},
+		"outfile": map[string]interface{}{
+			"type": "string",
+		},
+		"named": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"verbose": map[string]interface{}{
+					"type":        "boolean",
+					"description": "log progress",
+				},
+				"outfile": map[string]interface{}{
+					"type": "string",
+				},
+			},
+			"required": []string{"outfile"},
+		},
+	})
+	// The outfile field of the outer struct hides the
+	// one in the embedded struct, so it is required once.
+	c.Assert(r.RegisteredActions()["restore"].Params["required"], jc.DeepEquals, []string{"outfile"})
+}
+
+type ambiguousParams struct {
+	logParams
+	levelParams
+}
+
+type logParams struct {
+	Level string
+}
+
+type levelParams struct {
+	Level int
+}
+
+type recursiveParams struct {
+	Name string
+	Next *recursiveParams
+}
+
+func (*actionSuite) TestRegisterActionPanics(c *gc.C) {
+	r := hook.NewRegistry()
+	c.Assert(func() {
+		r.RegisterAction("Backup", "", nil, nil)
+	}, gc.PanicMatches, `invalid action name "Backup"`)
+	c.Assert(func() {
+		r.RegisterAction("backup", "", 0, nil)
+	}, gc.PanicMatches, `action "backup" has params of type int; want struct`)
+	c.Assert(func() {
+		r.RegisterAction("backup", "", struct{ C chan int }{}, nil)
+	}, gc.PanicMatches, `bad params for action "backup": field C: unsupported type chan int`)
+	c.Assert(func() {
+		r.RegisterAction("backup", "", ambiguousParams{}, nil)
+	}, gc.PanicMatches, `bad params for action "backup": field "Level" is ambiguous: it is found in both logParams and levelParams`)
+	c.Assert(func() {
+		r.RegisterAction("backup", "", recursiveParams{}, nil)
+	}, gc.PanicMatches, `bad params for action "backup": field Next: recursive type hook_test.recursiveParams`)
+	r.RegisterAction("backup", "", nil, nil)
+	c.Assert(func() {
+		r.RegisterAction("backup", "", nil, nil)
+	}, gc.PanicMatches, `action "backup" registered twice`)
+}
+
+func (*actionSuite) TestRunAction(c *gc.C) {
+	var gotParams *backupParams
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			var ctxt *hook.Context
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("*", func() error {
+				c.Errorf("wildcard hook called for action")
+				return nil
+			})
+			r.RegisterAction("backup", "", &backupParams{}, func(actxt *hook.ActionContext) error {
+				c.Check(ctxt, gc.NotNil)
+				gotParams = actxt.Params.(*backupParams)
+				return actxt.SetActionResults("path", gotParams.Outfile)
+			})
+			r.RegisterAction("fail", "", nil, func(actxt *hook.ActionContext) error {
+				return errgo.New("something went wrong")
+			})
+			r.Clone("sub").RegisterAction("panic", "", nil, func(actxt *hook.ActionContext) error {
+				panic("oops")
+			})
+		},
+		ActionParams: map[string]interface{}{
+			"outfile": "/tmp/backup",
+		},
+		Logger: c,
+	}
+	err := runner.RunAction("backup")
+	c.Assert(err, gc.IsNil)
+	c.Assert(gotParams, jc.DeepEquals, &backupParams{
+		Outfile: "/tmp/backup",
+	})
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"action-set", "path=/tmp/backup"},
+	})
+
+	runner.Record = nil
+	err = runner.RunAction("fail")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"action-fail", "fail hook for root: something went wrong"},
+	})
+
+	// A panic in an action is recovered and fails the action.
+	runner.Record = nil
+	err = runner.RunAction("panic")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"action-fail", "panic hook for root.sub: panic: oops"},
+	})
+
+	err = runner.RunAction("unknown")
+	c.Assert(err, gc.ErrorMatches, `action "unknown" not registered`)
+}
@@ -0,0 +1,284 @@
+package hook
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/juju/charm/v9/hooks"
+)
+
+// Change holds the old and new values of a configuration option
+// or relation setting that has changed. A nil Old value means that
+// the value was not previously set; a nil New value means that it
+// has been removed. Configuration values are as decoded from JSON;
+// relation settings are always strings.
+type Change struct {
+	Old interface{}
+	New interface{}
+}
+
+// changeCache holds the values used to calculate changes
+// for the duration of a hook.
+type changeCache struct {
+	// configLoaded records whether oldConfig and
+	// newConfig have been set.
+	configLoaded bool
+	oldConfig    map[string]interface{}
+	newConfig    map[string]interface{}
+
+	// oldRelations holds the settings last seen for
+	// each relation unit that has been asked about.
+	oldRelations map[RelationId]map[UnitId]map[string]string
+
+	// newRelations holds the current settings for each
+	// relation unit that has been asked about. A nil
+	// entry records that the unit has departed.
+	newRelations map[RelationId]map[UnitId]map[string]string
+}
+
+// commit records the values seen by the current hook in st as the
+// last-seen values. It is called only when the hook has completed
+// successfully, so that a failed hook sees the same changes when
+// it is retried.
+func (c *changeCache) commit(st *hookState) {
+	if c.configLoaded {
+		st.Config = c.newConfig
+	}
+	for id, units := range c.newRelations {
+		for unit, settings := range units {
+			if settings == nil {
+				delete(st.Relations[id], unit)
+				if len(st.Relations[id]) == 0 {
+					delete(st.Relations, id)
+				}
+				continue
+			}
+			if st.Relations == nil {
+				st.Relations = make(map[RelationId]map[UnitId]map[string]string)
+			}
+			if st.Relations[id] == nil {
+				st.Relations[id] = make(map[UnitId]map[string]string)
+			}
+			st.Relations[id][unit] = settings
+		}
+	}
+}
+
+// forgetRelations removes the last-seen settings that can no longer
+// be asked about from st: those of the departing unit in a
+// relation-departed hook, and those of the whole relation in a
+// relation-broken hook.
+func forgetRelations(st *hookState, ctxt *Context) {
+	if ctxt.RelationId == "" {
+		return
+	}
+	switch {
+	case strings.HasSuffix(ctxt.HookName, "-"+string(hooks.RelationDeparted)):
+		delete(st.Relations[ctxt.RelationId], ctxt.RemoteUnit)
+		if len(st.Relations[ctxt.RelationId]) == 0 {
+			delete(st.Relations, ctxt.RelationId)
+		}
+	case strings.HasSuffix(ctxt.HookName, "-"+string(hooks.RelationBroken)):
+		delete(st.Relations, ctxt.RelationId)
+	}
+}
+
+// ChangedConfig returns all the configuration options that have
+// changed since a hook last asked about configuration changes (with
+// ChangedConfig or ConfigChanged), keyed by option name. The first time
+// it is called, all options that have a value are reported as changed.
+//
+// Within a single hook, all calls return the same result, so several
+// components can each react to the same changes.
+//
+// If the configuration cannot be retrieved, the error is logged
+// and ChangedConfig returns nil.
+func (ctxt *Context) ChangedConfig() map[string]Change {
+	if err := ctxt.loadConfigChanges(); err != nil {
+		ctxt.Logf("cannot determine configuration changes: %v", err)
+		return nil
+	}
+	return diffValues(ctxt.cache.changes.oldConfig, ctxt.cache.changes.newConfig)
+}
+
+// ConfigChanged reports whether any of the configuration options with
+// the given keys have changed, as reported by ChangedConfig. If no keys
+// are given, it reports whether any option has changed. If the
+// changes cannot be determined, it logs the error and returns true.
+func (ctxt *Context) ConfigChanged(keys ...string) bool {
+	if err := ctxt.loadConfigChanges(); err != nil {
+		ctxt.Logf("cannot determine configuration changes: %v", err)
+		return true
+	}
+	return anyChanged(ctxt.ChangedConfig(), keys)
+}
+
+// ChangedRelation returns all the settings of the given unit in the
+// given relation that have changed since a hook last asked about
+// changes to that relation unit (with ChangedRelation or
+// RelationChanged), keyed by setting name. If the unit has departed,
+// all its settings are reported as removed. The last-seen settings are
+// forgotten at the end of the relation-departed hook for the unit and
+// the relation-broken hook for the relation.
+//
+// Within a single hook, all calls return the same result.
+//
+// If the relation settings cannot be retrieved, the error is logged
+// and ChangedRelation returns nil.
+func (ctxt *Context) ChangedRelation(id RelationId, unit UnitId) map[string]Change {
+	old, current, err := ctxt.loadRelationChanges(id, unit)
+	if err != nil {
+		ctxt.Logf("cannot determine relation changes: %v", err)
+		return nil
+	}
+	return diffValues(stringMap(old), stringMap(current))
+}
+
+// RelationChanged reports whether any of the settings with the given
+// keys of the given unit in the given relation have changed, as
+// reported by ChangedRelation. If no keys are given, it reports whether
+// any setting has changed. If the changes cannot be determined, it logs
+// the error and returns true.
+func (ctxt *Context) RelationChanged(id RelationId, unit UnitId, keys ...string) bool {
+	if _, _, err := ctxt.loadRelationChanges(id, unit); err != nil {
+		ctxt.Logf("cannot determine relation changes: %v", err)
+		return true
+	}
+	return anyChanged(ctxt.ChangedRelation(id, unit), keys)
+}
+
+// changes returns the change cache for the current hook,
+// creating it if necessary. It returns a fresh cache, not shared
+// with any other context, when the context has not been
+// created by Main.
+func (ctxt *Context) changes() *changeCache {
+	if ctxt.cache == nil {
+		ctxt.cache = new(contextCache)
+	}
+	if ctxt.cache.changes == nil {
+		ctxt.cache.changes = new(changeCache)
+	}
+	if ctxt.cache.hookState == nil {
+		ctxt.cache.hookState = new(hookState)
+	}
+	return ctxt.cache.changes
+}
+
+// loadConfigChanges makes sure that the old and new configuration
+// values are available in the change cache. The new values are
+// saved as the last-seen configuration if the hook succeeds.
+func (ctxt *Context) loadConfigChanges() error {
+	changes := ctxt.changes()
+	if changes.configLoaded {
+		return nil
+	}
+	config := ctxt.cache.config
+	if config == nil {
+		if err := ctxt.GetAllConfig(&config); err != nil {
+			return err
+		}
+	}
+	newConfig := make(map[string]interface{})
+	for key, data := range config {
+		var val interface{}
+		if err := json.Unmarshal(data, &val); err != nil {
+			return err
+		}
+		if val != nil {
+			newConfig[key] = val
+		}
+	}
+	changes.oldConfig = ctxt.cache.hookState.Config
+	changes.newConfig = newConfig
+	changes.configLoaded = true
+	return nil
+}
+
+// loadRelationChanges returns the settings last seen for the given
+// relation unit and its current settings. The current settings are
+// saved as the last-seen settings if the hook succeeds.
+func (ctxt *Context) loadRelationChanges(id RelationId, unit UnitId) (old, current map[string]string, err error) {
+	units, err := ctxt.GetRelationUnits(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	current = units[unit]
+	changes := ctxt.changes()
+	if old, ok := changes.oldRelations[id][unit]; ok {
+		return old, current, nil
+	}
+	old = ctxt.cache.hookState.Relations[id][unit]
+	if changes.oldRelations == nil {
+		changes.oldRelations = make(map[RelationId]map[UnitId]map[string]string)
+		changes.newRelations = make(map[RelationId]map[UnitId]map[string]string)
+	}
+	if changes.oldRelations[id] == nil {
+		changes.oldRelations[id] = make(map[UnitId]map[string]string)
+		changes.newRelations[id] = make(map[UnitId]map[string]string)
+	}
+	if old == nil {
+		// Make sure that we can tell that we have
+		// already looked at this unit.
+		old = make(map[string]string)
+	}
+	changes.oldRelations[id][unit] = old
+
+	if _, ok := units[unit]; !ok {
+		changes.newRelations[id][unit] = nil
+		return old, current, nil
+	}
+	saved := make(map[string]string)
+	for key, val := range current {
+		saved[key] = val
+	}
+	changes.newRelations[id][unit] = saved
+	return old, current, nil
+}
+
+// diffValues returns the changes between the old and new values.
+func diffValues(old, new map[string]interface{}) map[string]Change {
+	changed := make(map[string]Change)
+	for key, oldVal := range old {
+		newVal := new[key]
+		if !reflect.DeepEqual(oldVal, newVal) {
+			changed[key] = Change{
+				Old: oldVal,
+				New: newVal,
+			}
+		}
+	}
+	for key, newVal := range new {
+		if _, ok := old[key]; !ok {
+			changed[key] = Change{
+				New: newVal,
+			}
+		}
+	}
+	return changed
+}
+
+// anyChanged reports whether any of the given keys
+// are present in changed. If there are no keys, it
+// reports whether anything has changed.
+func anyChanged(changed map[string]Change, keys []string) bool {
+	if len(keys) == 0 {
+		return len(changed) > 0
+	}
+	for _, key := range keys {
+		if _, ok := changed[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// stringMap converts a map of relation settings
+// to a form suitable for passing to diffValues.
+func stringMap(m map[string]string) map[string]interface{} {
+	r := make(map[string]interface{}, len(m))
+	for key, val := range m {
+		r[key] = val
+	}
+	return r
+}
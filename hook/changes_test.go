@@ -0,0 +1,220 @@
+package hook_test
+
+import (
+	"errors"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type changesSuite struct{}
+
+var _ = gc.Suite(&changesSuite{})
+
+func (*changesSuite) TestConfigChanges(c *gc.C) {
+	var ctxt *hook.Context
+	var changes []map[string]hook.Change
+	var portChanged []bool
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("config-changed", func() error {
+				changes = append(changes, ctxt.ChangedConfig())
+				portChanged = append(portChanged, ctxt.ConfigChanged("port"))
+				return nil
+			})
+		},
+		Config: map[string]interface{}{
+			"port": 80,
+			"name": "foo",
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+
+	// A hook that does not ask about changes does
+	// not affect the result of the next hook that does.
+	runner.Config["name"] = "bar"
+	err = runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+
+	delete(runner.Config, "name")
+	runner.Config["port"] = 8080
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(changes, jc.DeepEquals, []map[string]hook.Change{{
+		"port": {New: 80.0},
+		"name": {New: "foo"},
+	}, {
+		"name": {Old: "foo", New: "bar"},
+	}, {
+		"port": {Old: 80.0, New: 8080.0},
+		"name": {Old: "bar"},
+	}, {}})
+	c.Assert(portChanged, jc.DeepEquals, []bool{true, false, true, false})
+	c.Assert(runner.Record, gc.HasLen, 0)
+}
+
+func (*changesSuite) TestChangesSeenAgainAfterFailedHook(c *gc.C) {
+	var ctxt *hook.Context
+	var changes []map[string]hook.Change
+	hookErr := errors.New("cannot configure")
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("config-changed", func() error {
+				changes = append(changes, ctxt.ChangedConfig())
+				return nil
+			})
+			r.RegisterHook("config-changed", func() error {
+				return hookErr
+			})
+		},
+		Config: map[string]interface{}{
+			"port": 80,
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.ErrorMatches, "config-changed hook for root: cannot configure")
+
+	// The retried hook sees the same changes.
+	hookErr = nil
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(changes, jc.DeepEquals, []map[string]hook.Change{{
+		"port": {New: 80.0},
+	}, {
+		"port": {New: 80.0},
+	}, {}})
+}
+
+func (*changesSuite) TestRelationChanges(c *gc.C) {
+	var ctxt *hook.Context
+	var changes []map[string]hook.Change
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("db-relation-changed", func() error {
+				changes = append(changes, ctxt.ChangedRelation(ctxt.RelationId, ctxt.RemoteUnit))
+				c.Check(ctxt.RelationChanged(ctxt.RelationId, ctxt.RemoteUnit, "password"), gc.Equals, false)
+				return nil
+			})
+			r.RegisterHook("db-relation-departed", func() error {
+				changes = append(changes, ctxt.ChangedRelation(ctxt.RelationId, ctxt.RemoteUnit))
+				return nil
+			})
+		},
+		RelationIds: map[string][]hook.RelationId{
+			"db": {"db:0"},
+		},
+		Relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"db:0": {
+				"postgresql/0": {"host": "10.0.0.1"},
+			},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("db-relation-changed", "db:0", "postgresql/0")
+	c.Assert(err, gc.IsNil)
+
+	runner.Relations["db:0"]["postgresql/0"]["host"] = "10.0.0.2"
+	err = runner.RunHook("db-relation-changed", "db:0", "postgresql/0")
+	c.Assert(err, gc.IsNil)
+
+	delete(runner.Relations["db:0"], "postgresql/0")
+	err = runner.RunHook("db-relation-departed", "db:0", "postgresql/0")
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(changes, jc.DeepEquals, []map[string]hook.Change{{
+		"host": {New: "10.0.0.1"},
+	}, {
+		"host": {Old: "10.0.0.1", New: "10.0.0.2"},
+	}, {
+		"host": {Old: "10.0.0.2"},
+	}})
+}
+
+func (*changesSuite) TestRelationChangesForgottenWhenUnitDeparts(c *gc.C) {
+	var ctxt *hook.Context
+	var changes []map[string]hook.Change
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("db-relation-changed", func() error {
+				changes = append(changes, ctxt.ChangedRelation(ctxt.RelationId, ctxt.RemoteUnit))
+				return nil
+			})
+			r.RegisterHook("db-relation-departed", nop)
+			r.RegisterHook("db-relation-broken", nop)
+		},
+		RelationIds: map[string][]hook.RelationId{
+			"db": {"db:0"},
+		},
+		Relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"db:0": {
+				"postgresql/0": {"host": "10.0.0.1"},
+				"postgresql/1": {"host": "10.0.0.2"},
+			},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("db-relation-changed", "db:0", "postgresql/0")
+	c.Assert(err, gc.IsNil)
+	err = runner.RunHook("db-relation-changed", "db:0", "postgresql/1")
+	c.Assert(err, gc.IsNil)
+
+	// The settings of a departed unit are forgotten even
+	// when nothing asks about them, so a unit that joins
+	// again with the same settings sees them as new.
+	err = runner.RunHook("db-relation-departed", "db:0", "postgresql/0")
+	c.Assert(err, gc.IsNil)
+	err = runner.RunHook("db-relation-changed", "db:0", "postgresql/0")
+	c.Assert(err, gc.IsNil)
+
+	// All the settings of a broken relation are forgotten.
+	err = runner.RunHook("db-relation-broken", "db:0", "")
+	c.Assert(err, gc.IsNil)
+	err = runner.RunHook("db-relation-changed", "db:0", "postgresql/1")
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(changes, jc.DeepEquals, []map[string]hook.Change{{
+		"host": {New: "10.0.0.1"},
+	}, {
+		"host": {New: "10.0.0.2"},
+	}, {
+		"host": {New: "10.0.0.1"},
+	}, {
+		"host": {New: "10.0.0.2"},
+	}})
+}
@@ -0,0 +1,54 @@
+package hook
+
+import (
+	"os"
+
+	"github.com/juju/charm/v9/hooks"
+	"gopkg.in/errgo.v1"
+)
+
+// RegisterStateCleanup arranges for all the unit's persistent state to
+// be removed at the end of the named hook, which must be "stop" or
+// "remove". Without this, the state of a removed unit is left behind,
+// and a unit later deployed with the same name will inherit it.
+//
+// The state is removed only when all the functions registered for the
+// hook (and all the reconcilers) have run successfully, so that a
+// failed hook can be retried with its state intact. This happens even
+// when the configuration is invalid (see RegisterConfigValidator). The
+// state held in the PersistentState passed to Main is deleted and the
+// unit's state directory (see Context.StateDir) is removed along with
+// everything in it, as is the key file used for encrypted state fields
+// (see RegisterStateEncryption). Leader state (see RegisterLeaderState)
+// is shared by the whole application, so it is not removed.
+//
+// RegisterStateCleanup may be called on any registry, but it will panic
+// if it is called for both hooks.
+func (r *Registry) RegisterStateCleanup(hookName string) {
+	if hookName != string(hooks.Stop) && hookName != string(hooks.Remove) {
+		panic(errgo.Newf("invalid state cleanup hook %q", hookName))
+	}
+	if r.stateCleanupHook != "" && r.stateCleanupHook != hookName {
+		panic(errgo.Newf("state cleanup registered for both %q and %q", r.stateCleanupHook, hookName))
+	}
+	r.stateCleanupHook = hookName
+}
+
+// cleanUpState removes all the persistent state.
+func cleanUpState(ctxt *Context, state PersistentState) error {
+	names, err := state.List()
+	if err != nil {
+		return errgo.Notef(err, "cannot list state")
+	}
+	for _, name := range names {
+		if err := state.Delete(name); err != nil {
+			return errgo.Notef(err, "cannot delete state for %s", name)
+		}
+	}
+	if ctxt.HookStateDir != "" {
+		if err := os.RemoveAll(ctxt.StateDir()); err != nil {
+			return errgo.Notef(err, "cannot remove state directory")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package hook_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type cleanupSuite struct{}
+
+var _ = gc.Suite(&cleanupSuite{})
+
+func (*cleanupSuite) TestStateCleanup(c *gc.C) {
+	stopErr := errors.New("cannot stop")
+	var stateDir string
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterStateCleanup("stop")
+			sub := r.Clone("sub")
+			var ctxt *hook.Context
+			var st struct {
+				Count int
+			}
+			sub.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, &st)
+			sub.RegisterHook("install", func() error {
+				st.Count++
+				stateDir = ctxt.StateDir()
+				if err := os.MkdirAll(stateDir, 0700); err != nil {
+					return err
+				}
+				return ioutil.WriteFile(filepath.Join(stateDir, "log"), nil, 0600)
+			})
+			sub.RegisterHook("stop", func() error {
+				return stopErr
+			})
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	names, err := runner.State.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, jc.DeepEquals, []string{"root.sub"})
+
+	// The state is kept when the stop hook fails.
+	err = runner.RunHook("stop", "", "")
+	c.Assert(err, gc.ErrorMatches, "stop hook for root.sub: cannot stop")
+	names, err = runner.State.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, jc.DeepEquals, []string{"root.sub"})
+	_, err = os.Stat(stateDir)
+	c.Assert(err, gc.IsNil)
+
+	stopErr = nil
+	err = runner.RunHook("stop", "", "")
+	c.Assert(err, gc.IsNil)
+	names, err = runner.State.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.HasLen, 0)
+	_, err = os.Stat(filepath.Dir(stateDir))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+}
+
+func (*cleanupSuite) TestCleanupHookRegistered(c *gc.C) {
+	r := hook.NewRegistry()
+	r.Clone("sub").RegisterStateCleanup("remove")
+	hook.RegisterMainHooks(r)
+	hooks := r.RegisteredHooks()
+	sort.Strings(hooks)
+	c.Assert(hooks, jc.DeepEquals, []string{"install", "remove", "start"})
+
+	c.Assert(func() {
+		r.RegisterStateCleanup("stop")
+	}, gc.PanicMatches, `state cleanup registered for both "remove" and "stop"`)
+	c.Assert(func() {
+		r.RegisterStateCleanup("install")
+	}, gc.PanicMatches, `invalid state cleanup hook "install"`)
+}
@@ -0,0 +1,165 @@
+package hook
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// configStruct holds a struct registered with RegisterConfigStruct.
+type configStruct struct {
+	registryName string
+	val          reflect.Value
+	fields       []configField
+}
+
+// configField holds a configuration option
+// held in a field of a config struct.
+type configField struct {
+	name string
+
+	// index holds the index of the field within the struct.
+	index int
+
+	// defaultVal holds the default value of the field.
+	defaultVal reflect.Value
+}
+
+// RegisterConfigStruct registers a configuration option for each field
+// in the struct pointed to by ptr that has a "config" tag, and arranges
+// for the struct to be filled in with the current configuration values
+// before any hooks or context setters are called.
+//
+// The "config" tag holds the name of the option. The option's default
+// value is taken from the "default" tag, which must be present, and
+// its description from the "description" tag. For example:
+//
+//	type config struct {
+//		Port int    `config:"port" default:"80" description:"Port to listen on"`
+//		Name string `config:"name" default:"" description:"Name of the site"`
+//	}
+//
+// A tagged field may be of any string, bool, int or float type.
+// Fields without a "config" tag are ignored.
+//
+// RegisterConfigStruct panics if a default value is missing or cannot
+// be parsed as the field's type, if a field type is not supported,
+// if an option name is used twice, or if any option is already
+// registered with different details.
+func (r *Registry) RegisterConfigStruct(ptr interface{}) {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		panic(errgo.Newf("config struct value is not pointer to struct but type %T", ptr))
+	}
+	v = v.Elem()
+	t := v.Type()
+	cs := configStruct{
+		registryName: r.name,
+		val:          v,
+	}
+	opts := make(map[string]charm.Option)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("config")
+		if name == "" || name == "-" {
+			continue
+		}
+		if field.PkgPath != "" {
+			panic(errgo.Newf("config option %q is in unexported field %s", name, field.Name))
+		}
+		if _, ok := opts[name]; ok {
+			panic(errgo.Newf("config option %q registered twice in %s", name, t))
+		}
+		defaultStr, ok := field.Tag.Lookup("default")
+		if !ok {
+			panic(errgo.Newf("config option %q has no default value", name))
+		}
+		optType, defaultVal, err := parseConfigDefault(field.Type, defaultStr)
+		if err != nil {
+			panic(errgo.Notef(err, "bad config option %q in field %s", name, field.Name))
+		}
+		opts[name] = charm.Option{
+			Type:        optType,
+			Description: field.Tag.Get("description"),
+			Default:     defaultVal.Interface(),
+		}
+		if defaultVal.Type() != field.Type {
+			defaultVal = defaultVal.Convert(field.Type)
+		}
+		cs.fields = append(cs.fields, configField{
+			name:       name,
+			index:      i,
+			defaultVal: defaultVal,
+		})
+	}
+	for _, f := range cs.fields {
+		r.RegisterConfig(f.name, opts[f.name])
+	}
+	r.configStructs = append(r.configStructs, cs)
+}
+
+// parseConfigDefault parses the given default value as the given
+// field type. It returns the charm option type for the field and the
+// default value as it should appear in the charm.Option.
+func parseConfigDefault(t reflect.Type, s string) (string, reflect.Value, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return "string", reflect.ValueOf(s), nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return "", reflect.Value{}, errgo.Newf("cannot parse default value %q as bool", s)
+		}
+		return "boolean", reflect.ValueOf(b), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return "", reflect.Value{}, errgo.Newf("cannot parse default value %q as %s", s, t)
+		}
+		return "int", reflect.ValueOf(int(n)), nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return "", reflect.Value{}, errgo.Newf("cannot parse default value %q as %s", s, t)
+		}
+		return "float", reflect.ValueOf(f), nil
+	}
+	return "", reflect.Value{}, errgo.Newf("unsupported type %s", t)
+}
+
+// loadConfig returns all the current configuration values if
+// any config structs or validators have been registered.
+// Otherwise it returns nil without fetching anything.
+func loadConfig(r *Registry, ctxt *Context) (map[string]json.RawMessage, error) {
+	if len(r.configStructs) == 0 && len(r.configValidators) == 0 {
+		return nil, nil
+	}
+	var vals map[string]json.RawMessage
+	if err := ctxt.GetAllConfig(&vals); err != nil {
+		return nil, errgo.Notef(err, "cannot get configuration")
+	}
+	return vals, nil
+}
+
+// loadConfigStructs fills in all the structs registered with
+// RegisterConfigStruct from the given configuration values.
+// Options that are not set take their default values.
+func loadConfigStructs(r *Registry, config map[string]json.RawMessage) error {
+	for _, cs := range r.configStructs {
+		for _, f := range cs.fields {
+			fv := cs.val.Field(f.index)
+			data, ok := config[f.name]
+			if !ok || string(data) == "null" {
+				fv.Set(f.defaultVal)
+				continue
+			}
+			if err := json.Unmarshal(data, fv.Addr().Interface()); err != nil {
+				return errgo.Notef(err, "cannot unmarshal configuration option %q for %s", f.name, cs.registryName)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package hook_test
+
+import (
+	"github.com/juju/charm/v9"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type configSuite struct{}
+
+var _ = gc.Suite(&configSuite{})
+
+type testConfig struct {
+	Port    int     `config:"port" default:"80" description:"Port to listen on"`
+	Name    string  `config:"name" default:"" description:"Name of the site"`
+	Debug   bool    `config:"debug" default:"false"`
+	Ratio   float64 `config:"ratio" default:"0.5"`
+	Ignored string
+}
+
+func (*configSuite) TestRegisterConfigStruct(c *gc.C) {
+	r := hook.NewRegistry()
+	var cfg testConfig
+	r.RegisterConfigStruct(&cfg)
+	c.Assert(r.RegisteredConfig(), jc.DeepEquals, map[string]charm.Option{
+		"port": {
+			Type:        "int",
+			Description: "Port to listen on",
+			Default:     80,
+		},
+		"name": {
+			Type:        "string",
+			Description: "Name of the site",
+			Default:     "",
+		},
+		"debug": {
+			Type:    "boolean",
+			Default: false,
+		},
+		"ratio": {
+			Type:    "float",
+			Default: 0.5,
+		},
+	})
+}
+
+var registerConfigStructErrorTests = []struct {
+	about       string
+	val         interface{}
+	expectPanic string
+}{{
+	about:       "not a pointer",
+	val:         testConfig{},
+	expectPanic: `config struct value is not pointer to struct but type hook_test.testConfig`,
+}, {
+	about: "missing default",
+	val: &struct {
+		Port int `config:"port"`
+	}{},
+	expectPanic: `config option "port" has no default value`,
+}, {
+	about: "default type mismatch",
+	val: &struct {
+		Port int `config:"port" default:"eighty"`
+	}{},
+	expectPanic: `bad config option "port" in field Port: cannot parse default value "eighty" as int`,
+}, {
+	about: "unsupported type",
+	val: &struct {
+		Ports []int `config:"ports" default:""`
+	}{},
+	expectPanic: `bad config option "ports" in field Ports: unsupported type \[\]int`,
+}, {
+	about: "duplicate name",
+	val: &struct {
+		Port1 int `config:"port" default:"80"`
+		Port2 int `config:"port" default:"80"`
+	}{},
+	expectPanic: `config option "port" registered twice in .*`,
+}, {
+	about: "conflicting registration",
+	val: &struct {
+		Port int `config:"http-port" default:"8080"`
+	}{},
+	expectPanic: `configuration option "http-port" is already registered with different details .*`,
+}}
+
+func (*configSuite) TestRegisterConfigStructErrors(c *gc.C) {
+	for i, test := range registerConfigStructErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		r := hook.NewRegistry()
+		r.RegisterConfig("http-port", charm.Option{
+			Type:    "int",
+			Default: 80,
+		})
+		c.Check(func() {
+			r.RegisterConfigStruct(test.val)
+		}, gc.PanicMatches, test.expectPanic)
+	}
+}
+
+func (*configSuite) TestConfigStructFilledBeforeHooks(c *gc.C) {
+	var cfg testConfig
+	var got []testConfig
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterConfigStruct(&cfg)
+			r.RegisterHook("config-changed", func() error {
+				got = append(got, cfg)
+				return nil
+			})
+		},
+		Config: map[string]interface{}{
+			"port":  8080,
+			"debug": true,
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	runner.Config = map[string]interface{}{
+		"name":  "foo",
+		"ratio": 1.5,
+	}
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(got, jc.DeepEquals, []testConfig{{
+		Port:  8080,
+		Debug: true,
+		Ratio: 0.5,
+	}, {
+		Port:  80,
+		Name:  "foo",
+		Ratio: 1.5,
+	}})
+	c.Assert(runner.Record, gc.HasLen, 0)
+}
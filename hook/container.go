@@ -0,0 +1,61 @@
+package hook
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/juju/charm/v9"
+	"github.com/juju/charm/v9/resource"
+	"gopkg.in/errgo.v1"
+)
+
+// RegisterContainer registers a workload container to be included in
+// the charm's metadata.yaml, for sidecar charms deployed on
+// Kubernetes. If a container is registered twice with the same name,
+// all of the details must also match.
+//
+// If ctr.Resource is not empty, it names the OCI image resource that
+// the container will run. If no resource with that name has been
+// registered, it is registered as an oci-image resource. Any storage
+// mounted by the container must already have been registered with
+// RegisterStorage.
+//
+// A hook that runs when the container's Pebble instance is ready can
+// be registered with RegisterHook using the name <name>-pebble-ready.
+// The charmbits/pebble package provides a convenient way to do this.
+func (r *Registry) RegisterContainer(name string, ctr charm.Container) {
+	if !workloadNamePattern.MatchString(name) {
+		panic(errgo.Newf("invalid container name %q", name))
+	}
+	old, ok := r.containers[name]
+	if ok {
+		if !reflect.DeepEqual(old, ctr) {
+			panic(errgo.Newf("container %q is already registered with different details (%#v)", name, old))
+		}
+		return
+	}
+	for _, m := range ctr.Mounts {
+		if _, ok := r.storage[m.Storage]; !ok {
+			panic(errgo.Newf("container %q mounts unregistered storage %q", name, m.Storage))
+		}
+	}
+	if ctr.Resource != "" {
+		res, ok := r.resources[ctr.Resource]
+		if !ok {
+			r.RegisterResource(resource.Meta{
+				Name:        ctr.Resource,
+				Type:        resource.TypeContainerImage,
+				Description: fmt.Sprintf("OCI image for the %s container", name),
+			})
+		} else if res.Type != resource.TypeContainerImage {
+			panic(errgo.Newf("container %q uses resource %q which is not an OCI image", name, ctr.Resource))
+		}
+	}
+	r.containers[name] = ctr
+}
+
+// RegisteredContainers returns the containers that have been
+// registered with RegisterContainer, keyed by container name.
+func (r *Registry) RegisteredContainers() map[string]charm.Container {
+	return r.containers
+}
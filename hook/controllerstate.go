@@ -0,0 +1,232 @@
+package hook
+
+import (
+	"encoding/json"
+
+	"gopkg.in/errgo.v1"
+)
+
+// DefaultControllerStateBudget holds the default maximum size in bytes
+// of the state stored by the PersistentState returned by
+// NewControllerState. It is well below the limit imposed by
+// the Juju controller, leaving room for other users of the
+// unit state.
+const DefaultControllerStateBudget = 64 * 1024
+
+// controllerStateKey holds the unit state key
+// under which all the state is stored.
+const controllerStateKey = "gocharm-state"
+
+// controllerState is an implementation of PersistentState that stores
+// the state in the Juju controller using the unit state hook tools.
+type controllerState struct {
+	ctxt     *Context
+	fallback PersistentState
+	budget   int
+
+	// useFallback records whether the unit state hook
+	// tools are unavailable, so fallback is used instead.
+	useFallback bool
+
+	// imported holds the disk state that the initial values were
+	// read from. Its files are removed once the values have
+	// been saved in the controller.
+	imported *diskState
+
+	// values holds all the state, keyed by name.
+	// It is nil until the state has been read.
+	values map[string][]byte
+}
+
+// NewControllerState returns an implementation of PersistentState that
+// stores state in the Juju controller with the state-get and state-set
+// hook tools, so that it survives the loss of the unit's machine or pod.
+// All the state is held under a single unit state key and saved in a
+// single operation, so the returned value also implements
+// TransactionalState.
+//
+// Saving state fails if the total size of the state would exceed
+// budget bytes; if budget is zero, DefaultControllerStateBudget is used.
+//
+// If the hook tools are not implemented by the running version of juju,
+// a warning is logged and the fallback state is used instead. When no
+// state has yet been stored in the controller, any state held in the
+// fallback is used as a starting point, so that a unit can switch from
+// disk state to controller state without losing state. Once that state
+// has been saved in the controller, the files holding it on disk are
+// removed.
+//
+// The state-delete hook tool is used to remove the unit
+// state key when all the state has been deleted.
+func NewControllerState(ctxt *Context, fallback PersistentState, budget int) PersistentState {
+	if budget <= 0 {
+		budget = DefaultControllerStateBudget
+	}
+	return &controllerState{
+		ctxt:     ctxt,
+		fallback: fallback,
+		budget:   budget,
+	}
+}
+
+// Save implements PersistentState.Save.
+func (s *controllerState) Save(name string, data []byte) error {
+	return s.SaveAll(map[string][]byte{
+		name: data,
+	})
+}
+
+// SaveAll implements TransactionalState.SaveAll.
+func (s *controllerState) SaveAll(values map[string][]byte) error {
+	if err := s.read(); err != nil {
+		return errgo.Mask(err)
+	}
+	if s.useFallback {
+		return errgo.Mask(commitState(s.fallback, values))
+	}
+	newValues := make(map[string][]byte)
+	for name, data := range s.values {
+		newValues[name] = data
+	}
+	for name, data := range values {
+		newValues[name] = data
+	}
+	if err := s.write(newValues); err != nil {
+		return errgo.Mask(err)
+	}
+	s.values = newValues
+	return errgo.Mask(s.removeImported())
+}
+
+// Load implements PersistentState.Load.
+func (s *controllerState) Load(name string) ([]byte, error) {
+	if err := s.read(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if s.useFallback {
+		return s.fallback.Load(name)
+	}
+	return s.values[name], nil
+}
+
+// Delete implements PersistentState.Delete.
+func (s *controllerState) Delete(name string) error {
+	if err := s.read(); err != nil {
+		return errgo.Mask(err)
+	}
+	if s.useFallback {
+		return s.fallback.Delete(name)
+	}
+	if _, ok := s.values[name]; !ok {
+		return nil
+	}
+	newValues := make(map[string][]byte)
+	for n, data := range s.values {
+		if n != name {
+			newValues[n] = data
+		}
+	}
+	if err := s.write(newValues); err != nil {
+		return errgo.Mask(err)
+	}
+	s.values = newValues
+	return errgo.Mask(s.removeImported())
+}
+
+// List implements PersistentState.List.
+func (s *controllerState) List() ([]string, error) {
+	if err := s.read(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if s.useFallback {
+		return s.fallback.List()
+	}
+	return sortedNames(s.values), nil
+}
+
+// read reads the state from the controller if it
+// has not already been read.
+func (s *controllerState) read() error {
+	if s.values != nil || s.useFallback {
+		return nil
+	}
+	var unitState map[string]string
+	if err := s.ctxt.RunJSON(&unitState, "state-get", "--format", "json"); err != nil {
+		if errgo.Cause(err) != ErrUnimplemented {
+			return errgo.Notef(err, "cannot get unit state")
+		}
+		s.ctxt.Logf("warning: unit state hook tools not available; storing state on disk instead")
+		s.useFallback = true
+		return nil
+	}
+	data, ok := unitState[controllerStateKey]
+	if !ok {
+		return s.readFallback()
+	}
+	var f diskStateFile
+	if err := json.Unmarshal([]byte(data), &f); err != nil {
+		return errgo.Notef(err, "invalid unit state")
+	}
+	if f.Values == nil {
+		f.Values = make(map[string][]byte)
+	}
+	s.values = f.Values
+	return nil
+}
+
+// readFallback reads the initial values from the fallback state.
+func (s *controllerState) readFallback() error {
+	s.values = make(map[string][]byte)
+	disk, ok := s.fallback.(*diskState)
+	if !ok {
+		return nil
+	}
+	if err := disk.read(); err != nil {
+		return errgo.Notef(err, "cannot read state from disk")
+	}
+	if len(disk.values) > 0 {
+		s.ctxt.Logf("moving state from disk to unit state")
+	}
+	s.imported = disk
+	for name, data := range disk.values {
+		s.values[name] = data
+	}
+	return nil
+}
+
+// removeImported removes the disk state files that the
+// initial values were read from. It should be called only
+// when the values have been written to the controller.
+func (s *controllerState) removeImported() error {
+	if s.imported == nil {
+		return nil
+	}
+	if err := s.imported.removeFiles(); err != nil {
+		return errgo.Notef(err, "cannot remove imported state")
+	}
+	s.imported = nil
+	return nil
+}
+
+// write stores the given values in the controller.
+func (s *controllerState) write(values map[string][]byte) error {
+	if len(values) == 0 {
+		if _, err := s.ctxt.Runner.Run("state-delete", controllerStateKey); err != nil {
+			return errgo.Notef(err, "cannot delete unit state")
+		}
+		return nil
+	}
+	data, err := json.Marshal(diskStateFile{
+		Values: values,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(data) > s.budget {
+		return errgo.Newf("state size %d exceeds budget of %d bytes", len(data), s.budget)
+	}
+	if _, err := s.ctxt.Runner.Run("state-set", controllerStateKey+"="+string(data)); err != nil {
+		return errgo.Notef(err, "cannot set unit state")
+	}
+	return nil
+}
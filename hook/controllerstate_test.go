@@ -0,0 +1,103 @@
+package hook_test
+
+import (
+	"io/ioutil"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type controllerStateSuite struct{}
+
+var _ = gc.Suite(&controllerStateSuite{})
+
+func (*controllerStateSuite) TestControllerState(c *gc.C) {
+	runner := &hooktest.Runner{
+		Logger: c,
+	}
+	ctxt := &hook.Context{
+		Runner: runner,
+	}
+	// Existing state on disk is moved to the controller.
+	dir := c.MkDir()
+	disk := hook.NewDiskState(dir)
+	err := disk.Save("root", []byte(`{"a":1}`))
+	c.Assert(err, gc.IsNil)
+
+	state := hook.NewControllerState(ctxt, disk, 0).(hook.TransactionalState)
+	data, err := state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"a":1}`)
+	err = state.SaveAll(map[string][]byte{
+		"root.db": []byte(`{"b":2}`),
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.UnitState["gocharm-state"], gc.Not(gc.Equals), "")
+
+	// Once saved in the controller, the state is removed from disk.
+	infos, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 0)
+
+	// The state is read back from the controller
+	// even when there is nothing on disk.
+	state = hook.NewControllerState(ctxt, hook.NewDiskState(c.MkDir()), 0).(hook.TransactionalState)
+	data, err = state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"a":1}`)
+	data, err = state.Load("root.db")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"b":2}`)
+}
+
+func (*controllerStateSuite) TestBudget(c *gc.C) {
+	runner := &hooktest.Runner{
+		Logger: c,
+	}
+	state := hook.NewControllerState(&hook.Context{Runner: runner}, hook.NewDiskState(c.MkDir()), 100)
+	err := state.Save("root", []byte(`"small"`))
+	c.Assert(err, gc.IsNil)
+	err = state.Save("root", make([]byte, 100))
+	c.Assert(err, gc.ErrorMatches, `state size [0-9]+ exceeds budget of 100 bytes`)
+
+	// The state in the controller is unchanged.
+	state = hook.NewControllerState(&hook.Context{Runner: runner}, hook.NewDiskState(c.MkDir()), 100)
+	data, err := state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `"small"`)
+}
+
+func (*controllerStateSuite) TestFallbackWhenUnimplemented(c *gc.C) {
+	runner := &hooktest.Runner{
+		Logger: c,
+	}
+	ctxt := &hook.Context{
+		Runner: noUnitStateRunner{runner},
+	}
+	dir := c.MkDir()
+	state := hook.NewControllerState(ctxt, hook.NewDiskState(dir), 0)
+	err := state.Save("root", []byte(`{"a":1}`))
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.UnitState, gc.HasLen, 0)
+
+	data, err := hook.NewDiskState(dir).Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"a":1}`)
+}
+
+// noUnitStateRunner is a hook.ToolRunner that behaves
+// as if the unit state hook tools were not implemented.
+type noUnitStateRunner struct {
+	*hooktest.Runner
+}
+
+func (r noUnitStateRunner) Run(cmd string, args ...string) ([]byte, error) {
+	switch cmd {
+	case "state-get", "state-set", "state-delete":
+		return nil, errgo.WithCausef(nil, hook.ErrUnimplemented, "no %s", cmd)
+	}
+	return r.Runner.Run(cmd, args...)
+}
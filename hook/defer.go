@@ -0,0 +1,266 @@
+package hook
+
+import (
+	"gopkg.in/errgo.v1"
+)
+
+// ErrDefer may be returned by a hook function, possibly as the
+// cause of an error, to defer the hook. See Context.Defer.
+var ErrDefer = errgo.New("hook deferred")
+
+// Defer defers the currently running hook function. The function will
+// be called again, with a context holding the same hook information
+// (for example the relation id and remote unit), at the start of the
+// next hook, before any functions for that hook run. This is useful
+// when a hook function cannot complete its work yet, for example
+// because a relation has not yet provided the required settings.
+//
+// Calling Defer is equivalent to returning ErrDefer from the
+// function, except that the function can carry on and return nil.
+// Other functions registered for the same hook are not affected.
+//
+// Deferred functions run in the order they were deferred. If a
+// deferred function defers again, it remains deferred in the same
+// position. A function is deferred only if the hook as a whole
+// succeeds, and deferring a function that is already deferred for the
+// same relation unit has no further effect. A deferred relation hook
+// function is discarded if its relation no longer exists. When
+// deferred functions run, all the registered context setters are first
+// called with the deferred hook's context, and afterwards they are
+// called again with the current hook's context.
+//
+// A deferred function is identified by its hook name and the registry
+// it was registered with, so it is still found if the charm is
+// upgraded and other registries register their functions in a
+// different order.
+func (ctxt *Context) Defer() {
+	if ctxt.cache != nil {
+		ctxt.cache.deferCurrent = true
+	}
+}
+
+// DeferredEvent holds a hook function call that has been deferred
+// with Context.Defer or ErrDefer, along with the hook information
+// it will be called with.
+type DeferredEvent struct {
+	// HookName holds the name of the hook that was deferred.
+	HookName string
+
+	// RegistryName holds the name of the registry
+	// that the deferred function was registered with.
+	RegistryName string
+
+	// Wildcard and Index identify the deferred function: it is
+	// function number Index of those registered with the registry
+	// for HookName, or for "*" if Wildcard is true. Index is zero
+	// unless the registry registers several functions for the hook.
+	Wildcard bool `json:",omitempty"`
+	Index    int  `json:",omitempty"`
+
+	RelationName   string     `json:",omitempty"`
+	RelationId     RelationId `json:",omitempty"`
+	RemoteUnit     UnitId     `json:",omitempty"`
+	RemoteApp      string     `json:",omitempty"`
+	DepartingUnit  UnitId     `json:",omitempty"`
+	StorageId      string     `json:",omitempty"`
+	WorkloadName   string     `json:",omitempty"`
+	SecretId       string     `json:",omitempty"`
+	SecretLabel    string     `json:",omitempty"`
+	SecretRevision int        `json:",omitempty"`
+	TargetSeries   string     `json:",omitempty"`
+}
+
+// DeferredEvents returns the deferred events held
+// in the given persistent state.
+//
+// This function is designed to be called by tests only.
+func DeferredEvents(state PersistentState) ([]DeferredEvent, error) {
+	st, _, err := loadHookState(state)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return st.Deferred, nil
+}
+
+// newDeferredEvent returns the deferred event for function
+// number i of the given functions, which are those
+// registered for the current hook or for "*".
+func newDeferredEvent(ctxt *Context, funcs []hookFunc, i int, wildcard bool) DeferredEvent {
+	f := funcs[i]
+	index := 0
+	for _, f1 := range funcs[:i] {
+		if f1.registryName == f.registryName {
+			index++
+		}
+	}
+	return DeferredEvent{
+		HookName:       ctxt.HookName,
+		RegistryName:   f.registryName,
+		Wildcard:       wildcard,
+		Index:          index,
+		RelationName:   ctxt.RelationName,
+		RelationId:     ctxt.RelationId,
+		RemoteUnit:     ctxt.RemoteUnit,
+		RemoteApp:      ctxt.RemoteApp,
+		DepartingUnit:  ctxt.DepartingUnit,
+		StorageId:      ctxt.StorageId,
+		WorkloadName:   ctxt.WorkloadName,
+		SecretId:       ctxt.SecretId,
+		SecretLabel:    ctxt.SecretLabel,
+		SecretRevision: ctxt.SecretRevision,
+		TargetSeries:   ctxt.TargetSeries,
+	}
+}
+
+// sameAs reports whether ev and ev1 are for the same
+// hook function and relation unit.
+func (ev *DeferredEvent) sameAs(ev1 *DeferredEvent) bool {
+	return ev.HookName == ev1.HookName &&
+		ev.RegistryName == ev1.RegistryName &&
+		ev.Wildcard == ev1.Wildcard &&
+		ev.Index == ev1.Index &&
+		ev.RelationId == ev1.RelationId &&
+		ev.RemoteUnit == ev1.RemoteUnit
+}
+
+// addDeferred returns events with the given new events
+// appended, omitting any that are already deferred.
+func addDeferred(events []DeferredEvent, newEvents []DeferredEvent) []DeferredEvent {
+outer:
+	for i := range newEvents {
+		for j := range events {
+			if events[j].sameAs(&newEvents[i]) {
+				continue outer
+			}
+		}
+		events = append(events, newEvents[i])
+	}
+	return events
+}
+
+// context returns a copy of ctxt holding
+// the hook information from the event.
+func (ev *DeferredEvent) context(ctxt *Context) *Context {
+	ctxt1 := *ctxt
+	ctxt1.HookName = ev.HookName
+	ctxt1.RelationName = ev.RelationName
+	ctxt1.RelationId = ev.RelationId
+	ctxt1.RemoteUnit = ev.RemoteUnit
+	ctxt1.RemoteApp = ev.RemoteApp
+	ctxt1.DepartingUnit = ev.DepartingUnit
+	ctxt1.StorageId = ev.StorageId
+	ctxt1.WorkloadName = ev.WorkloadName
+	ctxt1.SecretId = ev.SecretId
+	ctxt1.SecretLabel = ev.SecretLabel
+	ctxt1.SecretRevision = ev.SecretRevision
+	ctxt1.TargetSeries = ev.TargetSeries
+	return &ctxt1
+}
+
+// hookFunc returns the deferred hook function. It returns false
+// if the function is no longer registered, for example because
+// the charm has been upgraded.
+func (ev *DeferredEvent) hookFunc(r *Registry) (hookFunc, bool) {
+	name := ev.HookName
+	if ev.Wildcard {
+		name = "*"
+	}
+	index := 0
+	for _, f := range r.hooks[name] {
+		if f.registryName != ev.RegistryName {
+			continue
+		}
+		if index == ev.Index {
+			return f, true
+		}
+		index++
+	}
+	return hookFunc{}, false
+}
+
+// runHookFunc runs the given hook function wrapped in all
+// registered middleware, and reports whether it was deferred.
+func runHookFunc(r *Registry, ctxt *Context, f hookFunc) (deferred bool, err error) {
+	ctxt.cache.deferCurrent = false
+	run := wrapHookFunc(r, f.run, HookInfo{
+		HookName:     ctxt.HookName,
+		RegistryName: f.registryName,
+		Context:      ctxt,
+	})
+	if err := run(); err != nil {
+		if errgo.Cause(err) != ErrDefer {
+			return false, errgo.Mask(err, errgo.Any)
+		}
+		ctxt.Logf("%v", err)
+		return true, nil
+	}
+	return ctxt.cache.deferCurrent, nil
+}
+
+// runDeferred runs all the deferred events in st, leaving
+// st.Deferred holding the events that are still deferred. Events
+// for registries with invalid configuration remain deferred
+// without being run, and events for relations that no longer
+// exist are discarded.
+func runDeferred(r *Registry, ctxt *Context, st *hookState, invalid map[string]bool) (err error) {
+	if len(st.Deferred) == 0 {
+		return nil
+	}
+	events := st.Deferred
+	st.Deferred = nil
+	defer func() {
+		// Restore the current hook's context.
+		if setErr := setContexts(r, ctxt); setErr != nil && err == nil {
+			err = errgo.Mask(setErr)
+		}
+	}()
+	for i, ev := range events {
+		f, ok := ev.hookFunc(r)
+		if !ok {
+			ctxt.Logf("discarding deferred %s hook for %s: function no longer registered", ev.HookName, ev.RegistryName)
+			continue
+		}
+		if isInvalidRegistry(invalid, ev.RegistryName) {
+			st.Deferred = append(st.Deferred, ev)
+			continue
+		}
+		if ev.RelationId != "" {
+			ids, err := ctxt.GetRelationIds(ev.RelationName)
+			if err != nil {
+				st.Deferred = append(st.Deferred, events[i:]...)
+				return errgo.Mask(err)
+			}
+			if !containsRelationId(ids, ev.RelationId) {
+				ctxt.Logf("discarding deferred %s hook for %s: relation %s no longer exists", ev.HookName, ev.RegistryName, ev.RelationId)
+				continue
+			}
+		}
+		ctxt.Logf("running deferred %s hook for %s", ev.HookName, ev.RegistryName)
+		evCtxt := ev.context(ctxt)
+		if err := setContexts(r, evCtxt); err != nil {
+			st.Deferred = append(st.Deferred, events[i:]...)
+			return errgo.Mask(err)
+		}
+		deferred, err := runHookFunc(r, evCtxt, f)
+		if err != nil {
+			// Leave this and all the remaining events
+			// deferred so that they are tried again.
+			st.Deferred = append(st.Deferred, events[i:]...)
+			return errgo.NoteMask(err, "deferred", errgo.Any)
+		}
+		if deferred {
+			st.Deferred = append(st.Deferred, ev)
+		}
+	}
+	return nil
+}
+
+// containsRelationId reports whether ids contains id.
+func containsRelationId(ids []RelationId, id RelationId) bool {
+	for _, id1 := range ids {
+		if id1 == id {
+			return true
+		}
+	}
+	return false
+}
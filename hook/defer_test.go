@@ -0,0 +1,248 @@
+package hook_test
+
+import (
+	"fmt"
+
+	"github.com/juju/charm/v9"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type deferSuite struct{}
+
+var _ = gc.Suite(&deferSuite{})
+
+func (*deferSuite) TestDefer(c *gc.C) {
+	ready := false
+	var calls []string
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterRelation(charm.Relation{
+				Name:      "db",
+				Interface: "pgsql",
+				Role:      charm.RoleRequirer,
+			})
+			var ctxt *hook.Context
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("db-relation-joined", func() error {
+				calls = append(calls, fmt.Sprintf("joined %s %s", ctxt.RelationId, ctxt.RemoteUnit))
+				if !ready {
+					return hook.ErrDefer
+				}
+				return nil
+			})
+			r.Clone("sub").OnRelationJoined("db", func(ev *hook.RelationEvent) error {
+				calls = append(calls, "sub joined "+string(ev.Unit))
+				if !ready {
+					ev.Context.Defer()
+				}
+				return nil
+			})
+			r.RegisterHook("update-status", func() error {
+				calls = append(calls, "update-status "+ctxt.HookName)
+				return nil
+			})
+		},
+		RelationIds: map[string][]hook.RelationId{
+			"db": {"db:0"},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("db-relation-joined", "db:0", "postgresql/0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(calls, jc.DeepEquals, []string{
+		"joined db:0 postgresql/0",
+		"sub joined postgresql/0",
+	})
+	deferred, err := runner.Deferred()
+	c.Assert(err, gc.IsNil)
+	c.Assert(deferred, jc.DeepEquals, []hook.DeferredEvent{{
+		HookName:     "db-relation-joined",
+		RegistryName: "root",
+		RelationName: "db",
+		RelationId:   "db:0",
+		RemoteUnit:   "postgresql/0",
+		RemoteApp:    "postgresql",
+	}, {
+		HookName:     "db-relation-joined",
+		RegistryName: "root.sub",
+		RelationName: "db",
+		RelationId:   "db:0",
+		RemoteUnit:   "postgresql/0",
+		RemoteApp:    "postgresql",
+	}})
+
+	// Deferred events run before the current hook, with
+	// their original context, and remain deferred
+	// if they defer again.
+	calls = nil
+	err = runner.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(calls, jc.DeepEquals, []string{
+		"joined db:0 postgresql/0",
+		"sub joined postgresql/0",
+		"update-status update-status",
+	})
+	deferred1, err := runner.Deferred()
+	c.Assert(err, gc.IsNil)
+	c.Assert(deferred1, jc.DeepEquals, deferred)
+
+	// Step through the deferred events on their own.
+	ready = true
+	calls = nil
+	err = runner.RunDeferred()
+	c.Assert(err, gc.IsNil)
+	c.Assert(calls, jc.DeepEquals, []string{
+		"joined db:0 postgresql/0",
+		"sub joined postgresql/0",
+	})
+	deferred, err = runner.Deferred()
+	c.Assert(err, gc.IsNil)
+	c.Assert(deferred, gc.HasLen, 0)
+}
+
+func (*deferSuite) TestDeferredErrorKeepsEvents(c *gc.C) {
+	fail := true
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterHook("config-changed", func() error {
+				if fail {
+					return hook.ErrDefer
+				}
+				return fmt.Errorf("failed")
+			})
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	fail = false
+	err = runner.RunDeferred()
+	c.Assert(err, gc.ErrorMatches, `deferred: config-changed hook for root: failed`)
+	deferred, err := runner.Deferred()
+	c.Assert(err, gc.IsNil)
+	c.Assert(deferred, gc.HasLen, 1)
+}
+
+func (*deferSuite) TestDeferOnlyOnSuccess(c *gc.C) {
+	var hookErr error
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterHook("config-changed", func() error {
+				return hook.ErrDefer
+			})
+			r.RegisterHook("config-changed", func() error {
+				return hookErr
+			})
+		},
+		Logger: c,
+	}
+	// A failed hook defers nothing.
+	hookErr = fmt.Errorf("failed")
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.ErrorMatches, `config-changed hook for root: failed`)
+	deferred, err := runner.Deferred()
+	c.Assert(err, gc.IsNil)
+	c.Assert(deferred, gc.HasLen, 0)
+
+	// Deferring a function that is already
+	// deferred does not add another event.
+	hookErr = nil
+	for i := 0; i < 3; i++ {
+		err = runner.RunHook("config-changed", "", "")
+		c.Assert(err, gc.IsNil)
+	}
+	deferred, err = runner.Deferred()
+	c.Assert(err, gc.IsNil)
+	c.Assert(deferred, jc.DeepEquals, []hook.DeferredEvent{{
+		HookName:     "config-changed",
+		RegistryName: "root",
+	}})
+}
+
+func (*deferSuite) TestDeferredEventForBrokenRelationDiscarded(c *gc.C) {
+	var calls []string
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterRelation(charm.Relation{
+				Name:      "db",
+				Interface: "pgsql",
+				Role:      charm.RoleRequirer,
+			})
+			r.RegisterHook("db-relation-joined", func() error {
+				calls = append(calls, "joined")
+				return hook.ErrDefer
+			})
+			r.RegisterHook("update-status", nop)
+		},
+		RelationIds: map[string][]hook.RelationId{
+			"db": {"db:0"},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("db-relation-joined", "db:0", "postgresql/0")
+	c.Assert(err, gc.IsNil)
+
+	delete(runner.RelationIds, "db")
+	err = runner.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(calls, jc.DeepEquals, []string{"joined"})
+	deferred, err := runner.Deferred()
+	c.Assert(err, gc.IsNil)
+	c.Assert(deferred, gc.HasLen, 0)
+}
+
+func (*deferSuite) TestDeferredEventAfterRegistrationOrderChange(c *gc.C) {
+	upgraded := false
+	var calls []string
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			registerA := func() {
+				r.Clone("a").RegisterHook("config-changed", func() error {
+					calls = append(calls, "a")
+					return nil
+				})
+			}
+			if upgraded {
+				// The upgraded charm registers its
+				// functions in a different order.
+				registerA()
+			}
+			r.Clone("b").RegisterHook("config-changed", func() error {
+				calls = append(calls, "b")
+				if !upgraded {
+					return hook.ErrDefer
+				}
+				return nil
+			})
+			if !upgraded {
+				registerA()
+			}
+			r.RegisterHook("update-status", nop)
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(calls, jc.DeepEquals, []string{"b", "a"})
+
+	upgraded = true
+	calls = nil
+	err = runner.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(calls, jc.DeepEquals, []string{"b"})
+	deferred, err := runner.Deferred()
+	c.Assert(err, gc.IsNil)
+	c.Assert(deferred, gc.HasLen, 0)
+}
@@ -0,0 +1,845 @@
+package hook
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// encryptedPrefix prefixes all data encrypted by the hook package.
+const encryptedPrefix = "gocharm-encrypted:v1:"
+
+// EncryptionKeys holds the key material used to encrypt persistent
+// state. Each key may be any length; the actual encryption keys are
+// derived from it.
+type EncryptionKeys struct {
+	// Current holds the key used to encrypt state.
+	Current []byte
+
+	// Previous holds keys that were in use before the current one.
+	// State encrypted with a previous key can still be read, and
+	// is encrypted with the current key when it is next saved.
+	// Previous keys are removed once no state needs them.
+	Previous [][]byte
+}
+
+// KeySource provides the keys used to encrypt persistent state.
+// See KeyFile and SecretKey.
+type KeySource interface {
+	// Keys returns the current keys, creating
+	// a new key if there is none yet.
+	Keys(ctxt *Context) (EncryptionKeys, error)
+
+	// Rotate makes a new current key, keeping
+	// the old keys as previous keys.
+	Rotate(ctxt *Context) error
+
+	// Retire removes all the previous keys,
+	// leaving only the current key.
+	Retire(ctxt *Context) error
+}
+
+// RegisterStateEncryption arranges for all persistent local state to be
+// encrypted at rest with keys from the given source. The state is
+// encrypted with AES-GCM, which also detects any tampering with it,
+// including moving encrypted data from one name or field to another.
+// State saved before encryption was enabled is read as is and encrypted
+// when it is next saved.
+//
+// Without RegisterStateEncryption, individual fields of a state value
+// registered with RegisterContext can be encrypted by tagging them with
+// `encrypt:"true"`. Only fields of the top level struct may be tagged.
+// The keys for encrypted fields are held in a key file (see KeyFile)
+// named after the unit in the hook state directory, created with 0600
+// permissions when it is first needed, normally in the install hook.
+//
+// See Context.RotateStateKey for key rotation.
+//
+// RegisterStateEncryption will panic if it is called more than once.
+func (r *Registry) RegisterStateEncryption(keys KeySource) {
+	if keys == nil {
+		panic(errgo.New("nil key source passed to RegisterStateEncryption"))
+	}
+	if r.stateKeys != nil {
+		panic(errgo.New("RegisterStateEncryption called more than once"))
+	}
+	r.stateKeys = keys
+}
+
+// RotateStateKey makes a new current state encryption key (see
+// RegisterStateEncryption). All encrypted state is encrypted with the
+// new key when it is saved at the end of the current hook; the old key
+// remains available so that state can still be read if the hook fails.
+// At the end of the next hook that finds all the state encrypted with
+// the new key, the state is saved again, so that the previous
+// generation kept by the PersistentState (see NewDiskState) is
+// encrypted with the new key too, and the old key is removed.
+// It returns an error if no state is encrypted.
+func (ctxt *Context) RotateStateKey() error {
+	if ctxt.cache == nil || ctxt.cache.encryption == nil {
+		return errgo.New("no encrypted state")
+	}
+	return errgo.Mask(ctxt.cache.encryption.rotate(ctxt))
+}
+
+// KeyFile returns a KeySource that holds keys in the file with the
+// given path, which is relative to the hook state directory (see
+// Context.HookStateDir) unless it is absolute. The file is created
+// with a new random key and 0600 permissions if it does not exist.
+func KeyFile(path string) KeySource {
+	return &keyFile{
+		path: path,
+	}
+}
+
+// keyFile implements KeySource by holding keys in a file,
+// one hex-encoded key per line, the current key first.
+type keyFile struct {
+	// path holds the path to the file. If it is empty,
+	// the default key file for the unit is used.
+	path string
+}
+
+func (f *keyFile) filePath(ctxt *Context) string {
+	if f.path == "" {
+		return filepath.Join(ctxt.HookStateDir, ctxt.UUID+"-"+ctxt.UnitTag()+".key")
+	}
+	if filepath.IsAbs(f.path) {
+		return f.path
+	}
+	return filepath.Join(ctxt.HookStateDir, f.path)
+}
+
+// Keys implements KeySource.Keys.
+func (f *keyFile) Keys(ctxt *Context) (EncryptionKeys, error) {
+	keys, err := f.read(ctxt)
+	if err == nil || !os.IsNotExist(errgo.Cause(err)) {
+		return keys, errgo.Mask(err)
+	}
+	key, err := newKey()
+	if err != nil {
+		return EncryptionKeys{}, errgo.Mask(err)
+	}
+	keys = EncryptionKeys{
+		Current: key,
+	}
+	if err := f.write(ctxt, keys); err != nil {
+		return EncryptionKeys{}, errgo.Mask(err)
+	}
+	return keys, nil
+}
+
+// Rotate implements KeySource.Rotate.
+func (f *keyFile) Rotate(ctxt *Context) error {
+	keys, err := f.Keys(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	key, err := newKey()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(f.write(ctxt, rotatedKeys(keys, key)))
+}
+
+// Retire implements KeySource.Retire.
+func (f *keyFile) Retire(ctxt *Context) error {
+	keys, err := f.Keys(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(keys.Previous) == 0 {
+		return nil
+	}
+	return errgo.Mask(f.write(ctxt, EncryptionKeys{
+		Current: keys.Current,
+	}))
+}
+
+func (f *keyFile) read(ctxt *Context) (EncryptionKeys, error) {
+	data, err := ioutil.ReadFile(f.filePath(ctxt))
+	if err != nil {
+		return EncryptionKeys{}, errgo.Mask(err, os.IsNotExist)
+	}
+	keys, err := parseKeys(strings.Fields(string(data)))
+	if err != nil {
+		return EncryptionKeys{}, errgo.Notef(err, "invalid key file")
+	}
+	return keys, nil
+}
+
+func (f *keyFile) write(ctxt *Context, keys EncryptionKeys) error {
+	path := f.filePath(ctxt)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	data := strings.Join(formatKeys(keys), "\n") + "\n"
+	if err := writeFileSync(path+".tmp", []byte(data), 0600); err != nil {
+		return errgo.Notef(err, "cannot write key file")
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return errgo.Notef(err, "cannot write key file")
+	}
+	return nil
+}
+
+// SecretKey returns a KeySource that holds keys in the Juju secret
+// owned by the unit with the given label. The secret is created with a
+// new random key if Juju reports that it does not exist; any other
+// error is returned so that a new key cannot replace one that is still
+// needed. Secrets are available from Juju 3.0 onwards.
+func SecretKey(label string) KeySource {
+	return &secretKey{
+		label: label,
+	}
+}
+
+// secretKey implements KeySource by holding keys in a Juju secret.
+// The current key is held in the "key" attribute and the previous keys
+// are held in the "previous" attribute, separated by spaces.
+type secretKey struct {
+	label string
+}
+
+// Keys implements KeySource.Keys.
+func (s *secretKey) Keys(ctxt *Context) (EncryptionKeys, error) {
+	var content map[string]string
+	err := ctxt.RunJSON(&content, "secret-get", "--label", s.label, "--format", "json")
+	if err == nil {
+		keys, err := parseKeys(append([]string{content["key"]}, strings.Fields(content["previous"])...))
+		if err != nil {
+			return EncryptionKeys{}, errgo.Notef(err, "invalid key secret %q", s.label)
+		}
+		return keys, nil
+	}
+	if !isSecretNotFound(err) {
+		return EncryptionKeys{}, errgo.Notef(err, "cannot get key secret %q", s.label)
+	}
+	key, err := newKey()
+	if err != nil {
+		return EncryptionKeys{}, errgo.Mask(err)
+	}
+	if _, err := ctxt.Runner.Run("secret-add", "--label", s.label, "--owner", "unit", "key="+hex.EncodeToString(key)); err != nil {
+		return EncryptionKeys{}, errgo.Notef(err, "cannot create key secret %q", s.label)
+	}
+	return EncryptionKeys{
+		Current: key,
+	}, nil
+}
+
+// isSecretNotFound reports whether the given error from
+// a secret hook tool means that the secret does not exist.
+func isSecretNotFound(err error) bool {
+	return strings.Contains(err.Error(), "not found")
+}
+
+// Rotate implements KeySource.Rotate.
+func (s *secretKey) Rotate(ctxt *Context) error {
+	keys, err := s.Keys(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	key, err := newKey()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.set(ctxt, rotatedKeys(keys, key)))
+}
+
+// Retire implements KeySource.Retire.
+func (s *secretKey) Retire(ctxt *Context) error {
+	keys, err := s.Keys(ctxt)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if len(keys.Previous) == 0 {
+		return nil
+	}
+	return errgo.Mask(s.set(ctxt, EncryptionKeys{
+		Current: keys.Current,
+	}))
+}
+
+// set sets the content of the secret to the given keys.
+func (s *secretKey) set(ctxt *Context, keys EncryptionKeys) error {
+	var info map[string]json.RawMessage
+	if err := ctxt.RunJSON(&info, "secret-info-get", "--label", s.label, "--format", "json"); err != nil {
+		return errgo.Notef(err, "cannot get key secret %q", s.label)
+	}
+	if len(info) != 1 {
+		return errgo.Newf("unexpected info for key secret %q", s.label)
+	}
+	var id string
+	for id = range info {
+	}
+	formatted := formatKeys(keys)
+	if _, err := ctxt.Runner.Run("secret-set", id, "key="+formatted[0], "previous="+strings.Join(formatted[1:], " ")); err != nil {
+		return errgo.Notef(err, "cannot set key secret %q", s.label)
+	}
+	return nil
+}
+
+// newKey returns a new random key.
+func newKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errgo.Notef(err, "cannot generate key")
+	}
+	return key, nil
+}
+
+// rotatedKeys returns keys with key as the new
+// current key and the old current key as the
+// most recent previous key.
+func rotatedKeys(keys EncryptionKeys, key []byte) EncryptionKeys {
+	return EncryptionKeys{
+		Current:  key,
+		Previous: append([][]byte{keys.Current}, keys.Previous...),
+	}
+}
+
+// parseKeys parses the hex-encoded keys, the
+// current key first.
+func parseKeys(hexKeys []string) (EncryptionKeys, error) {
+	if len(hexKeys) == 0 || hexKeys[0] == "" {
+		return EncryptionKeys{}, errgo.New("no key found")
+	}
+	var keys EncryptionKeys
+	for i, h := range hexKeys {
+		key, err := hex.DecodeString(h)
+		if err != nil {
+			return EncryptionKeys{}, errgo.Notef(err, "invalid key")
+		}
+		if i == 0 {
+			keys.Current = key
+		} else {
+			keys.Previous = append(keys.Previous, key)
+		}
+	}
+	return keys, nil
+}
+
+// formatKeys returns the keys hex-encoded, the
+// current key first.
+func formatKeys(keys EncryptionKeys) []string {
+	hexKeys := []string{hex.EncodeToString(keys.Current)}
+	for _, key := range keys.Previous {
+		hexKeys = append(hexKeys, hex.EncodeToString(key))
+	}
+	return hexKeys
+}
+
+// stateCipher encrypts and decrypts state data.
+type stateCipher struct {
+	current  cipher.AEAD
+	previous []cipher.AEAD
+}
+
+// newStateCipher returns a stateCipher that uses the given keys.
+func newStateCipher(keys EncryptionKeys) (*stateCipher, error) {
+	if len(keys.Current) == 0 {
+		return nil, errgo.New("empty encryption key")
+	}
+	current, err := newAEAD(keys.Current)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	c := &stateCipher{
+		current: current,
+	}
+	for _, key := range keys.Previous {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		c.previous = append(c.previous, aead)
+	}
+	return c, nil
+}
+
+// newAEAD returns an AES-256-GCM AEAD using
+// a key derived from the given key material.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("gocharm state encryption"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return aead, nil
+}
+
+// encrypt returns data encrypted with the current key. The given
+// associated data is authenticated along with it, so the result can be
+// decrypted only with the same associated data.
+func (c *stateCipher) encrypt(data, ad []byte) ([]byte, error) {
+	nonce := make([]byte, c.current.NonceSize(), c.current.NonceSize()+len(data)+c.current.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errgo.Notef(err, "cannot generate nonce")
+	}
+	sealed := c.current.Seal(nonce, nonce, data, ad)
+	return []byte(encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// isEncrypted reports whether the given data
+// has been encrypted by stateCipher.encrypt.
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedPrefix))
+}
+
+// decrypt decrypts data returned by encrypt with the same associated
+// data. It also reports whether the data was encrypted with a previous
+// key, and so should be encrypted again with the current key.
+func (c *stateCipher) decrypt(data, ad []byte) (_ []byte, stale bool, _ error) {
+	sealed, err := base64.StdEncoding.DecodeString(string(data[len(encryptedPrefix):]))
+	if err != nil {
+		return nil, false, errgo.Notef(err, "invalid encrypted data")
+	}
+	for i, aead := range append([]cipher.AEAD{c.current}, c.previous...) {
+		if len(sealed) < aead.NonceSize() {
+			return nil, false, errgo.New("invalid encrypted data")
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if plain, err := aead.Open(nil, nonce, ciphertext, ad); err == nil {
+			return plain, i > 0, nil
+		}
+	}
+	return nil, false, errgo.New("cannot decrypt state: no matching key")
+}
+
+// encryptFields returns the JSON object in data, saved for the
+// registry with the given name, with the values of the given fields
+// encrypted. Each value is bound to the registry name and field name
+// (see fieldAD) so that it cannot be moved to another field.
+func (c *stateCipher) encryptFields(data []byte, registryName string, fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return data, nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil || obj == nil {
+		return data, nil
+	}
+	for _, name := range fields {
+		val, ok := obj[name]
+		if !ok {
+			continue
+		}
+		encrypted, err := c.encrypt(val, fieldAD(registryName, name))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		obj[name], err = json.Marshal(string(encrypted))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return json.Marshal(obj)
+}
+
+// decryptFields returns the JSON object in data, saved for the
+// registry with the given name, with any encrypted field values
+// decrypted. It also reports whether any field should be
+// encrypted again because it was encrypted with a previous key or
+// because a field that should be encrypted was not. The cipher may be
+// nil, in which case an error is returned if any field is encrypted.
+func (c *stateCipher) decryptFields(data []byte, registryName string, fields []string) (_ []byte, stale bool, _ error) {
+	if !bytes.Contains(data, []byte(encryptedPrefix)) && (c == nil || len(fields) == 0) {
+		return data, false, nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil || obj == nil {
+		return data, false, nil
+	}
+	shouldEncrypt := make(map[string]bool)
+	for _, name := range fields {
+		shouldEncrypt[name] = true
+	}
+	for name, val := range obj {
+		var s string
+		if err := json.Unmarshal(val, &s); err != nil || !isEncrypted([]byte(s)) {
+			if shouldEncrypt[name] {
+				stale = true
+			}
+			continue
+		}
+		if c == nil {
+			return nil, false, errgo.New("state is encrypted but no encryption key is available")
+		}
+		plain, oldKey, err := c.decrypt([]byte(s), fieldAD(registryName, name))
+		if err != nil {
+			return nil, false, errgo.Notef(err, "cannot decrypt field %q", name)
+		}
+		stale = stale || oldKey
+		obj[name] = plain
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	return data, stale, nil
+}
+
+// fieldAD returns the associated data used to
+// encrypt the given field of the state saved for
+// the registry with the given name.
+func fieldAD(registryName, field string) []byte {
+	data, _ := json.Marshal([]string{registryName, field})
+	return data
+}
+
+// encryptedFields returns the JSON names of the fields in the
+// struct pointed to by val that are tagged to be encrypted.
+func encryptedFields(val interface{}) []string {
+	t := reflect.TypeOf(val)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	t = t.Elem()
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("encrypt") != "true" {
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" {
+			name = tag
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// stateEncryption holds the encryption in use
+// by Main for the current hook.
+type stateEncryption struct {
+	source KeySource
+	cipher *stateCipher
+
+	// state holds the encrypting PersistentState when
+	// all state is encrypted (see RegisterStateEncryption).
+	// Otherwise only fields are encrypted.
+	state *encryptedState
+
+	// stale records the registries whose state has encrypted
+	// fields that must be saved even if they have not changed,
+	// because they need to be encrypted with the current key.
+	stale map[string]bool
+
+	// hasPrevious records whether there are previous keys.
+	hasPrevious bool
+
+	// rotated records whether the key has been rotated
+	// during the current hook.
+	rotated bool
+
+	// retire records whether the previous keys should be
+	// removed when the state has been saved.
+	retire bool
+}
+
+// newStateEncryption returns the encryption to use for the
+// state registered with r, which may be nil if no state
+// is encrypted, and the PersistentState to use in place of
+// state.
+func newStateEncryption(r *Registry, ctxt *Context, state PersistentState) (*stateEncryption, PersistentState, error) {
+	source := r.stateKeys
+	if source == nil {
+		for _, val := range r.state {
+			if len(encryptedFields(val.val)) > 0 {
+				source = &keyFile{}
+				break
+			}
+		}
+	}
+	if source == nil {
+		return nil, state, nil
+	}
+	keys, err := source.Keys(ctxt)
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "cannot get state encryption keys")
+	}
+	c, err := newStateCipher(keys)
+	if err != nil {
+		return nil, nil, errgo.Mask(err)
+	}
+	e := &stateEncryption{
+		source:      source,
+		cipher:      c,
+		stale:       make(map[string]bool),
+		hasPrevious: len(keys.Previous) > 0,
+	}
+	if r.stateKeys != nil {
+		e.state = &encryptedState{
+			state:  state,
+			cipher: c,
+			plain:  make(map[string][]byte),
+			stale:  make(map[string]bool),
+		}
+		state = e.state
+	}
+	return e, state, nil
+}
+
+// fieldCipher returns the cipher to use to encrypt
+// state fields. It returns nil if all state is encrypted.
+func (e *stateEncryption) fieldCipher() *stateCipher {
+	if e == nil || e.state != nil {
+		return nil
+	}
+	return e.cipher
+}
+
+// decryptFields decrypts any encrypted fields in the given data
+// saved for the state value val by the registry with the given name.
+// The receiver may be nil. See stateCipher.decryptFields.
+func (e *stateEncryption) decryptFields(data []byte, registryName string, val interface{}) ([]byte, bool, error) {
+	if e == nil {
+		return (*stateCipher)(nil).decryptFields(data, registryName, nil)
+	}
+	var fields []string
+	if e.state == nil {
+		fields = encryptedFields(val)
+	}
+	return e.cipher.decryptFields(data, registryName, fields)
+}
+
+// removeKeyFile removes the default key file used to
+// encrypt fields, if any. It is called when all the
+// state has been removed (see RegisterStateCleanup).
+func (e *stateEncryption) removeKeyFile(ctxt *Context) error {
+	if e == nil {
+		return nil
+	}
+	f, ok := e.source.(*keyFile)
+	if !ok || f.path != "" {
+		return nil
+	}
+	if err := os.Remove(f.filePath(ctxt)); err != nil && !os.IsNotExist(err) {
+		return errgo.Notef(err, "cannot remove key file")
+	}
+	return nil
+}
+
+// rotate makes a new current key and arranges
+// for all state to be encrypted with it.
+func (e *stateEncryption) rotate(ctxt *Context) error {
+	if err := e.source.Rotate(ctxt); err != nil {
+		return errgo.Notef(err, "cannot rotate state encryption key")
+	}
+	keys, err := e.source.Keys(ctxt)
+	if err != nil {
+		return errgo.Notef(err, "cannot get state encryption keys")
+	}
+	c, err := newStateCipher(keys)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if e.state != nil {
+		if err := e.state.rekey(c); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	e.cipher = c
+	e.stale["*"] = true
+	e.rotated = true
+	return nil
+}
+
+// prepareRetirement is called before the state is saved. If there are
+// previous keys and all the state was found to be encrypted with the
+// current key, it arranges for all the state to be saved again, so
+// that the previous generation of the state does not need the
+// previous keys either, and for the previous keys to be removed when
+// the state has been saved.
+func (e *stateEncryption) prepareRetirement() error {
+	if e == nil || !e.hasPrevious || e.rotated {
+		return nil
+	}
+	if len(e.stale) > 0 {
+		return nil
+	}
+	if e.state != nil {
+		if err := e.state.loadAll(); err != nil {
+			return errgo.Mask(err)
+		}
+		if len(e.state.stale) > 0 {
+			return nil
+		}
+		e.state.markStale()
+	}
+	e.stale["*"] = true
+	e.retire = true
+	return nil
+}
+
+// retireKeys removes the previous keys if prepareRetirement
+// found that they are no longer needed. It is called when
+// the state has been saved.
+func (e *stateEncryption) retireKeys(ctxt *Context) error {
+	if e == nil || !e.retire {
+		return nil
+	}
+	if err := e.source.Retire(ctxt); err != nil {
+		return errgo.Notef(err, "cannot remove previous state encryption keys")
+	}
+	return nil
+}
+
+// isStale reports whether the state for the given
+// registry must be saved with the current key.
+func (e *stateEncryption) isStale(registryName string) bool {
+	return e != nil && (e.stale["*"] || e.stale[registryName])
+}
+
+// encryptedState is a PersistentState that encrypts
+// all the data saved in another PersistentState.
+// Each value is bound to the name it is saved under.
+type encryptedState struct {
+	state  PersistentState
+	cipher *stateCipher
+
+	// plain holds the data that has been loaded,
+	// keyed by name.
+	plain map[string][]byte
+
+	// stale records the data that must be saved
+	// again because it is not encrypted with the
+	// current key.
+	stale map[string]bool
+}
+
+// Save implements PersistentState.Save.
+func (s *encryptedState) Save(name string, data []byte) error {
+	return s.SaveAll(map[string][]byte{
+		name: data,
+	})
+}
+
+// SaveAll implements TransactionalState.SaveAll. Any stale
+// data is saved along with the given values.
+func (s *encryptedState) SaveAll(values map[string][]byte) error {
+	plain := make(map[string][]byte)
+	for name := range s.stale {
+		plain[name] = s.plain[name]
+	}
+	for name, data := range values {
+		plain[name] = data
+	}
+	encrypted := make(map[string][]byte)
+	for name, data := range plain {
+		var err error
+		encrypted[name], err = s.cipher.encrypt(data, []byte(name))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := commitState(s.state, encrypted); err != nil {
+		return errgo.Mask(err)
+	}
+	for name, data := range plain {
+		s.plain[name] = data
+		delete(s.stale, name)
+	}
+	return nil
+}
+
+// Load implements PersistentState.Load.
+func (s *encryptedState) Load(name string) ([]byte, error) {
+	data, err := s.state.Load(name)
+	if err != nil || data == nil {
+		return nil, errgo.Mask(err)
+	}
+	stale := true
+	if isEncrypted(data) {
+		data, stale, err = s.cipher.decrypt(data, []byte(name))
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot decrypt state for %s", name)
+		}
+	}
+	s.plain[name] = data
+	if stale {
+		s.stale[name] = true
+	}
+	return data, nil
+}
+
+// Delete implements PersistentState.Delete.
+func (s *encryptedState) Delete(name string) error {
+	if err := s.state.Delete(name); err != nil {
+		return errgo.Mask(err)
+	}
+	delete(s.plain, name)
+	delete(s.stale, name)
+	return nil
+}
+
+// List implements PersistentState.List.
+func (s *encryptedState) List() ([]string, error) {
+	return s.state.List()
+}
+
+// hasPendingWrites implements pendingWriter.hasPendingWrites.
+func (s *encryptedState) hasPendingWrites() bool {
+	return len(s.stale) > 0
+}
+
+// rekey arranges for all the data to be
+// encrypted with the given cipher.
+func (s *encryptedState) rekey(c *stateCipher) error {
+	if err := s.loadAll(); err != nil {
+		return errgo.Mask(err)
+	}
+	s.cipher = c
+	s.markStale()
+	return nil
+}
+
+// loadAll loads all the data that has not already been loaded.
+func (s *encryptedState) loadAll() error {
+	names, err := s.List()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, name := range names {
+		if _, ok := s.plain[name]; ok {
+			continue
+		}
+		if _, err := s.Load(name); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// markStale arranges for all the loaded
+// data to be saved again.
+func (s *encryptedState) markStale() {
+	for name := range s.plain {
+		s.stale[name] = true
+	}
+}
+
+// pendingWriter is implemented by PersistentState implementations
+// that may need to write data even when no data has changed.
+type pendingWriter interface {
+	hasPendingWrites() bool
+}
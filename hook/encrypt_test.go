@@ -0,0 +1,285 @@
+package hook_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type encryptSuite struct{}
+
+var _ = gc.Suite(&encryptSuite{})
+
+const encryptedPrefix = "gocharm-encrypted:v1:"
+
+func (*encryptSuite) TestStateEncryption(c *gc.C) {
+	var rotate bool
+	var st struct {
+		Password string
+	}
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		State:        hooktest.MemState{"hook": []byte(`{}`)},
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterStateEncryption(hook.KeyFile("state.key"))
+			var ctxt *hook.Context
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, &st)
+			r.RegisterHook("install", func() error {
+				st.Password = "secret"
+				return nil
+			})
+			r.RegisterHook("start", func() error {
+				if rotate {
+					return ctxt.RotateStateKey()
+				}
+				return nil
+			})
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+
+	// The key file is private to the unit.
+	keyPath := filepath.Join(runner.HookStateDir, "state.key")
+	info, err := os.Stat(keyPath)
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Mode().Perm(), gc.Equals, os.FileMode(0600))
+
+	// All the state is encrypted, including the state
+	// saved in plain text before encryption was enabled.
+	state := runner.State.(hooktest.MemState)
+	for name, data := range state {
+		c.Assert(strings.HasPrefix(string(data), encryptedPrefix), gc.Equals, true, gc.Commentf("state %s", name))
+		c.Assert(strings.Contains(string(data), "secret"), gc.Equals, false)
+	}
+	saved := string(state["root"])
+
+	// Unchanged state is not saved again.
+	st.Password = ""
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(st.Password, gc.Equals, "secret")
+	c.Assert(string(state["root"]), gc.Equals, saved)
+
+	// After rotation, the state is encrypted with the new key
+	// and the old key is kept.
+	rotate = true
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(state["root"]), gc.Not(gc.Equals), saved)
+	keys, err := hook.KeyFile(keyPath).Keys(&hook.Context{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys.Previous, gc.HasLen, 1)
+
+	// State encrypted with the old key can still be read
+	// and is encrypted with the new key.
+	rotate = false
+	state["root"] = []byte(saved)
+	st.Password = ""
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(st.Password, gc.Equals, "secret")
+	c.Assert(string(state["root"]), gc.Not(gc.Equals), saved)
+	keys, err = hook.KeyFile(keyPath).Keys(&hook.Context{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys.Previous, gc.HasLen, 1)
+
+	// When all the state is found to be encrypted with
+	// the new key, it is saved again and the old key is
+	// removed.
+	st.Password = ""
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(st.Password, gc.Equals, "secret")
+	keys, err = hook.KeyFile(keyPath).Keys(&hook.Context{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys.Previous, gc.HasLen, 0)
+
+	st.Password = ""
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(st.Password, gc.Equals, "secret")
+
+	state["root"] = []byte(saved)
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.ErrorMatches, `cannot load state for root: .*no matching key`)
+}
+
+func (*encryptSuite) TestEncryptedFields(c *gc.C) {
+	type tlsState struct {
+		CertPEM string `json:"cert"`
+		KeyPEM  string `json:"key" encrypt:"true"`
+	}
+	var st tlsState
+	var ctxt *hook.Context
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterStateCleanup("remove")
+			r.Clone("tls").RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, &st)
+			r.RegisterHook("install", nop)
+			r.RegisterHook("start", nop)
+		},
+		Logger: c,
+	}
+	// State saved before the field was tagged is
+	// encrypted when it is next saved.
+	runner.State = hooktest.MemState{
+		"root.tls": []byte(`{"cert":"cert data","key":"key data"}`),
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(st, gc.Equals, tlsState{
+		CertPEM: "cert data",
+		KeyPEM:  "key data",
+	})
+	var saved map[string]string
+	err = json.Unmarshal(runner.State.(hooktest.MemState)["root.tls"], &saved)
+	c.Assert(err, gc.IsNil)
+	c.Assert(saved["cert"], gc.Equals, "cert data")
+	c.Assert(strings.HasPrefix(saved["key"], encryptedPrefix), gc.Equals, true)
+
+	st = tlsState{}
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(st.KeyPEM, gc.Equals, "key data")
+
+	// The default key file is named after the unit
+	// and is removed along with the state.
+	keyPath := filepath.Join(runner.HookStateDir, ctxt.UUID+"-"+ctxt.UnitTag()+".key")
+	_, err = os.Stat(keyPath)
+	c.Assert(err, gc.IsNil)
+	err = runner.RunHook("remove", "", "")
+	c.Assert(err, gc.IsNil)
+	_, err = os.Stat(keyPath)
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+}
+
+func (*encryptSuite) TestMovedEncryptedFieldRejected(c *gc.C) {
+	type passwords struct {
+		Admin string `encrypt:"true"`
+		User  string `encrypt:"true"`
+	}
+	var a, b passwords
+	setter := func(*hook.Context) error { return nil }
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.Clone("a").RegisterContext(setter, &a)
+			r.Clone("b").RegisterContext(setter, &b)
+			r.RegisterHook("install", func() error {
+				a = passwords{"a-admin", "a-user"}
+				b = passwords{"b-admin", "b-user"}
+				return nil
+			})
+			r.RegisterHook("start", nop)
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	state := runner.State.(hooktest.MemState)
+	var savedA, savedB map[string]string
+	err = json.Unmarshal(state["root.a"], &savedA)
+	c.Assert(err, gc.IsNil)
+	err = json.Unmarshal(state["root.b"], &savedB)
+	c.Assert(err, gc.IsNil)
+	saved := func(m map[string]string) []byte {
+		data, err := json.Marshal(m)
+		c.Assert(err, gc.IsNil)
+		return data
+	}
+
+	// An encrypted value moved to another field is rejected.
+	state["root.a"] = saved(map[string]string{
+		"Admin": savedA["User"],
+		"User":  savedA["User"],
+	})
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.ErrorMatches, `cannot unmarshal state for root.a: cannot decrypt field "Admin": .*`)
+
+	// An encrypted value moved to the same field
+	// of another registry is rejected.
+	state["root.a"] = saved(map[string]string{
+		"Admin": savedB["Admin"],
+		"User":  savedA["User"],
+	})
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.ErrorMatches, `cannot unmarshal state for root.a: cannot decrypt field "Admin": .*`)
+
+	state["root.a"] = saved(savedA)
+	a = passwords{}
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(a, gc.Equals, passwords{"a-admin", "a-user"})
+}
+
+func (*encryptSuite) TestSecretKey(c *gc.C) {
+	runner := &hooktest.Runner{
+		Logger: c,
+	}
+	ctxt := &hook.Context{
+		Runner: runner,
+	}
+	source := hook.SecretKey("state-key")
+	keys, err := source.Keys(ctxt)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys.Current, gc.HasLen, 32)
+	c.Assert(runner.Secrets.Secrets, gc.HasLen, 1)
+
+	err = source.Rotate(ctxt)
+	c.Assert(err, gc.IsNil)
+	newKeys, err := source.Keys(ctxt)
+	c.Assert(err, gc.IsNil)
+	c.Assert(newKeys.Current, gc.Not(gc.DeepEquals), keys.Current)
+	c.Assert(newKeys.Previous, gc.DeepEquals, [][]byte{keys.Current})
+	c.Assert(runner.Secrets.Secrets, gc.HasLen, 1)
+
+	err = source.Retire(ctxt)
+	c.Assert(err, gc.IsNil)
+	retiredKeys, err := source.Keys(ctxt)
+	c.Assert(err, gc.IsNil)
+	c.Assert(retiredKeys, gc.DeepEquals, hook.EncryptionKeys{
+		Current: newKeys.Current,
+	})
+}
+
+func (*encryptSuite) TestSecretKeyNotCreatedOnError(c *gc.C) {
+	runner := &hooktest.Runner{
+		Secrets: &hooktest.SecretStore{},
+		Logger:  c,
+	}
+	ctxt := &hook.Context{
+		Runner: secretGetFailRunner{runner},
+	}
+	_, err := hook.SecretKey("state-key").Keys(ctxt)
+	c.Assert(err, gc.ErrorMatches, `cannot get key secret "state-key": permission denied`)
+	c.Assert(runner.Secrets.Secrets, gc.HasLen, 0)
+}
+
+// secretGetFailRunner is a hook.ToolRunner
+// whose secret-get tool always fails.
+type secretGetFailRunner struct {
+	hook.ToolRunner
+}
+
+func (r secretGetFailRunner) Run(cmd string, args ...string) ([]byte, error) {
+	if cmd == "secret-get" {
+		return nil, errors.New("permission denied")
+	}
+	return r.ToolRunner.Run(cmd, args...)
+}
@@ -0,0 +1,226 @@
+package hook
+
+import (
+	"gopkg.in/errgo.v1"
+)
+
+// The methods in this file provide a typed layer over RegisterHook.
+// Rather than registering a function for a hook by name and reading
+// information about the hook from a shared context, the function is
+// passed an event value holding the information relevant to the hook.
+//
+// Functions registered with these methods are ordinary hook functions:
+// they run in order of registration with any other functions registered
+// for the same hook, before any wildcard ("*") functions.
+
+// RelationEvent holds information about a relation hook.
+type RelationEvent struct {
+	// Context holds the context for the hook.
+	Context *Context
+
+	// Name holds the name of the relation, as
+	// registered with RegisterRelation.
+	Name string
+
+	// Id holds the id of the relation.
+	Id RelationId
+
+	// Unit holds the remote unit that the hook is running for.
+	// It is empty for relation-created and relation-broken hooks,
+	// and for a relation-changed hook triggered by a change to the
+	// remote application's settings.
+	Unit UnitId
+
+	// App holds the name of the remote application.
+	App string
+
+	// DepartingUnit holds the unit that is leaving the relation in
+	// a relation-departed hook. This may be the charm unit itself.
+	DepartingUnit UnitId
+}
+
+// Data returns the relation settings of the remote unit. It returns
+// nil if the event has no remote unit or the unit has left the
+// relation. The settings are fetched the first time they are
+// asked for.
+func (ev *RelationEvent) Data() (map[string]string, error) {
+	if ev.Unit == "" {
+		return nil, nil
+	}
+	units, err := ev.Context.GetRelationUnits(ev.Id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return units[ev.Unit], nil
+}
+
+// AppData returns the relation settings of the remote application.
+func (ev *RelationEvent) AppData() (map[string]string, error) {
+	settings, err := ev.Context.GetAppRelation(ev.Id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return settings, nil
+}
+
+// ConfigChangedEvent holds information about
+// a config-changed hook.
+type ConfigChangedEvent struct {
+	// Context holds the context for the hook.
+	Context *Context
+
+	// Changed holds the configuration options that have
+	// changed, as returned by Context.ChangedConfig.
+	Changed map[string]Change
+}
+
+// StorageEvent holds information about a storage hook.
+type StorageEvent struct {
+	// Context holds the context for the hook.
+	Context *Context
+
+	// Name holds the name of the storage,
+	// as registered with RegisterStorage.
+	Name string
+
+	// Id holds the id of the storage instance,
+	// for example "data/0".
+	Id string
+}
+
+// Info returns information about the storage instance.
+func (ev *StorageEvent) Info() (*StorageInfo, error) {
+	info, err := ev.Context.Storage(ev.Id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return info, nil
+}
+
+// ActionEvent holds information about a running action.
+type ActionEvent struct {
+	// Context holds the context for the action.
+	Context *Context
+
+	// Name holds the name of the action.
+	Name string
+
+	// Id holds the id of the running action.
+	Id string
+
+	// Params holds a pointer to the action parameters,
+	// as for ActionContext.Params.
+	Params interface{}
+}
+
+// OnRelationCreated registers f to be called in the
+// <name>-relation-created hook.
+func (r *Registry) OnRelationCreated(name string, f func(*RelationEvent) error) {
+	r.onRelation(name, "relation-created", f)
+}
+
+// OnRelationJoined registers f to be called in the
+// <name>-relation-joined hook.
+func (r *Registry) OnRelationJoined(name string, f func(*RelationEvent) error) {
+	r.onRelation(name, "relation-joined", f)
+}
+
+// OnRelationChanged registers f to be called in the
+// <name>-relation-changed hook.
+func (r *Registry) OnRelationChanged(name string, f func(*RelationEvent) error) {
+	r.onRelation(name, "relation-changed", f)
+}
+
+// OnRelationDeparted registers f to be called in the
+// <name>-relation-departed hook.
+func (r *Registry) OnRelationDeparted(name string, f func(*RelationEvent) error) {
+	r.onRelation(name, "relation-departed", f)
+}
+
+// OnRelationBroken registers f to be called in the
+// <name>-relation-broken hook.
+func (r *Registry) OnRelationBroken(name string, f func(*RelationEvent) error) {
+	r.onRelation(name, "relation-broken", f)
+}
+
+func (r *Registry) onRelation(name, kind string, f func(*RelationEvent) error) {
+	if name == "" {
+		panic(errgo.Newf("no relation name given for %s event", kind))
+	}
+	r.registerEventContext()
+	r.RegisterHook(name+"-"+kind, func() error {
+		ctxt := r.eventCtxt
+		return f(&RelationEvent{
+			Context:       ctxt,
+			Name:          ctxt.RelationName,
+			Id:            ctxt.RelationId,
+			Unit:          ctxt.RemoteUnit,
+			App:           ctxt.RemoteApp,
+			DepartingUnit: ctxt.DepartingUnit,
+		})
+	})
+}
+
+// OnConfigChanged registers f to be called
+// in the config-changed hook.
+func (r *Registry) OnConfigChanged(f func(*ConfigChangedEvent) error) {
+	r.registerEventContext()
+	r.RegisterHook("config-changed", func() error {
+		ctxt := r.eventCtxt
+		return f(&ConfigChangedEvent{
+			Context: ctxt,
+			Changed: ctxt.ChangedConfig(),
+		})
+	})
+}
+
+// OnStorageAttached registers f to be called in the
+// <name>-storage-attached hook.
+func (r *Registry) OnStorageAttached(name string, f func(*StorageEvent) error) {
+	r.onStorage(name, "storage-attached", f)
+}
+
+// OnStorageDetaching registers f to be called in the
+// <name>-storage-detaching hook.
+func (r *Registry) OnStorageDetaching(name string, f func(*StorageEvent) error) {
+	r.onStorage(name, "storage-detaching", f)
+}
+
+func (r *Registry) onStorage(name, kind string, f func(*StorageEvent) error) {
+	r.registerEventContext()
+	r.RegisterHook(name+"-"+kind, func() error {
+		ctxt := r.eventCtxt
+		return f(&StorageEvent{
+			Context: ctxt,
+			Name:    name,
+			Id:      ctxt.StorageId,
+		})
+	})
+}
+
+// OnAction registers an action as for RegisterAction,
+// calling f with an ActionEvent when the action runs.
+func (r *Registry) OnAction(name, description string, params interface{}, f func(*ActionEvent) error) {
+	r.RegisterAction(name, description, params, func(actxt *ActionContext) error {
+		return f(&ActionEvent{
+			Context: actxt.Context,
+			Name:    actxt.ActionName,
+			Id:      actxt.ActionId,
+			Params:  actxt.Params,
+		})
+	})
+}
+
+// registerEventContext arranges for r.eventCtxt to be set to the
+// registry's context before any hook functions run. Unlike
+// RegisterContext, it may be called any number of times.
+func (r *Registry) registerEventContext() {
+	if r.hasEventContext {
+		return
+	}
+	r.hasEventContext = true
+	r.contexts = append(r.contexts, func(ctxt *Context) error {
+		r.eventCtxt = ctxt.withRegistryName(r.name)
+		return nil
+	})
+}
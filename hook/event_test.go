@@ -0,0 +1,156 @@
+package hook_test
+
+import (
+	"github.com/juju/charm/v9"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type eventSuite struct{}
+
+var _ = gc.Suite(&eventSuite{})
+
+func (*eventSuite) TestRelationEvents(c *gc.C) {
+	var calls []string
+	var joined *hook.RelationEvent
+	var data, appData map[string]string
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterRelation(charm.Relation{
+				Name:      "db",
+				Interface: "pgsql",
+				Role:      charm.RoleRequirer,
+			})
+			r.OnRelationJoined("db", func(ev *hook.RelationEvent) error {
+				calls = append(calls, "joined")
+				joined = ev
+				var err error
+				data, err = ev.Data()
+				c.Check(err, gc.IsNil)
+				appData, err = ev.AppData()
+				c.Check(err, gc.IsNil)
+				return nil
+			})
+			// String-based registration still works alongside
+			// the typed layer and runs in registration order.
+			r.RegisterHook("db-relation-joined", func() error {
+				calls = append(calls, "string")
+				return nil
+			})
+			sub := r.Clone("sub")
+			sub.OnRelationDeparted("db", func(ev *hook.RelationEvent) error {
+				calls = append(calls, "departed "+string(ev.DepartingUnit))
+				c.Check(ev.Context.CommandName(), gc.Equals, "cmd-root.sub")
+				return nil
+			})
+			r.RegisterHook("*", func() error {
+				calls = append(calls, "*")
+				return nil
+			})
+		},
+		RelationIds: map[string][]hook.RelationId{
+			"db": {"db:0"},
+		},
+		Relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"db:0": {
+				"postgresql/0": {"host": "10.0.0.1"},
+			},
+		},
+		AppRelations: map[hook.RelationId]map[string]string{
+			"db:0": {"database": "foo"},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("db-relation-joined", "db:0", "postgresql/0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(calls, jc.DeepEquals, []string{"joined", "string", "*"})
+	c.Assert(joined.Name, gc.Equals, "db")
+	c.Assert(joined.Id, gc.Equals, hook.RelationId("db:0"))
+	c.Assert(joined.Unit, gc.Equals, hook.UnitId("postgresql/0"))
+	c.Assert(joined.App, gc.Equals, "postgresql")
+	c.Assert(data, jc.DeepEquals, map[string]string{"host": "10.0.0.1"})
+	c.Assert(appData, jc.DeepEquals, map[string]string{"database": "foo"})
+
+	calls = nil
+	err = runner.RunHook("db-relation-departed", "db:0", "postgresql/0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(calls, jc.DeepEquals, []string{"departed postgresql/0", "*"})
+}
+
+func (*eventSuite) TestConfigChangedEvent(c *gc.C) {
+	var changes []map[string]hook.Change
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterConfig("port", charm.Option{
+				Type:    "int",
+				Default: 80,
+			})
+			r.OnConfigChanged(func(ev *hook.ConfigChangedEvent) error {
+				changes = append(changes, ev.Changed)
+				return nil
+			})
+		},
+		Config: map[string]interface{}{
+			"port": 80,
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	runner.Config["port"] = 8080
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, jc.DeepEquals, []map[string]hook.Change{{
+		"port": {New: 80.0},
+	}, {
+		"port": {Old: 80.0, New: 8080.0},
+	}})
+}
+
+func (*eventSuite) TestStorageAndActionEvents(c *gc.C) {
+	var storage *hook.StorageEvent
+	var info *hook.StorageInfo
+	var action *hook.ActionEvent
+	type params struct {
+		Name string `json:"name"`
+	}
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterStorage(charm.Storage{
+				Name: "data",
+				Type: charm.StorageFilesystem,
+			})
+			r.OnStorageAttached("data", func(ev *hook.StorageEvent) error {
+				storage = ev
+				var err error
+				info, err = ev.Info()
+				return err
+			})
+			r.OnAction("greet", "Say hello", params{}, func(ev *hook.ActionEvent) error {
+				action = ev
+				return nil
+			})
+		},
+		ActionParams: map[string]interface{}{
+			"name": "bob",
+		},
+		Logger: c,
+	}
+	dir := c.MkDir()
+	err := runner.AttachStorage("data/0", dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(storage.Name, gc.Equals, "data")
+	c.Assert(storage.Id, gc.Equals, "data/0")
+	c.Assert(info.Location, gc.Equals, dir)
+
+	err = runner.RunAction("greet")
+	c.Assert(err, gc.IsNil)
+	c.Assert(action.Name, gc.Equals, "greet")
+	c.Assert(action.Params, jc.DeepEquals, &params{Name: "bob"})
+}
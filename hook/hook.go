@@ -19,8 +19,10 @@
 // name in a struct - it provides the gocharm logic with a name
 // that it can use to store data associated with registry. At runtime,
 // all local state is stored in the directory /usr/lib/juju-localstate/<env-UUID>.
-// You will see the names provided to Registry.Clone reflected in the
-// names of the files created there.
+// The state registered with Registry.RegisterContext is held in a single
+// file there, keyed by the names provided to Registry.Clone, and those
+// names are also reflected in the names of the directories returned by
+// Context.StateDir.
 //
 // After all hooks, relations and config options have been registered,
 // any functions registered with Registry.SetContext will be called.
@@ -57,6 +59,15 @@ func (id UnitId) Tag() names.UnitTag {
 	return names.NewUnitTag(string(id))
 }
 
+// App returns the name of the application that the unit
+// belongs to.
+func (id UnitId) App() string {
+	if i := strings.Index(string(id), "/"); i >= 0 {
+		return string(id)[0:i]
+	}
+	return string(id)
+}
+
 // Context provides information about the
 // hook context. It should be treated as read-only.
 type Context struct {
@@ -64,6 +75,15 @@ type Context struct {
 	// the context is associated with.
 	registryName string
 
+	// cache holds values that are fetched at most once
+	// during a hook. It is shared by all copies of the
+	// context, and is set up by Main.
+	cache *contextCache
+
+	// relationNames holds the names of all the
+	// relations registered with the registry.
+	relationNames []string
+
 	// Fields valid for all hooks
 
 	// UUID holds the globally unique environment id.
@@ -81,14 +101,28 @@ type Context struct {
 	// HookName holds the name of the currently running hook.
 	HookName string
 
-	// Relations holds all the relation data available to the charm.
-	// For each relation id, it holds all the units that have joined
-	// that relation, and within that, all the relation settings for
-	// each of those units.
+	// Relations holds the relation data that has been fetched
+	// so far. For each relation id, it holds all the units that
+	// have joined that relation, and within that, all the relation
+	// settings for each of those units.
+	//
+	// Relation data is fetched on demand, so an entry will
+	// only be present after GetRelationUnits, GetAppRelation or
+	// PrefetchRelations has been called for the relation. The same
+	// applies to AppRelations and RelationIds (see GetRelationIds).
 	//
 	// This does not include settings for the charm unit itself.
 	Relations map[RelationId]map[UnitId]map[string]string
 
+	// AppRelations holds the application-level relation data
+	// available to the charm. For each relation id, it holds
+	// the settings published by the remote application.
+	// An entry is present only when the remote application
+	// is known, which is when at least one of its units
+	// has joined the relation or when the current hook is
+	// running for the relation.
+	AppRelations map[RelationId]map[string]string
+
 	// RelationIds holds the relation ids for each relation declared
 	// in the charm. For example, if the charm has a relation named
 	// "webserver" in its metadata.yaml, the current ids for that
@@ -109,9 +143,65 @@ type Context struct {
 
 	// RemoteUnit holds the id of the unit that the current
 	// relation hook is running for. This will be empty
-	// for a relation-broken hook.
+	// for a relation-broken hook, and for a relation-changed
+	// hook triggered by a change to the remote application's
+	// settings.
 	RemoteUnit UnitId
 
+	// RemoteApp holds the name of the application that the
+	// current relation hook is running for.
+	RemoteApp string
+
+	// DepartingUnit holds the id of the unit that is leaving
+	// the relation in a relation-departed hook. This may be
+	// the charm unit itself.
+	DepartingUnit UnitId
+
+	// Fields valid for storage-related hooks only.
+
+	// StorageId holds the id of the storage instance that the
+	// current storage hook is running for, for example "data/0".
+	StorageId string
+
+	// Fields valid for workload hooks (<container>-pebble-ready) only.
+
+	// WorkloadName holds the name of the workload container
+	// that the current hook is running for.
+	WorkloadName string
+
+	// Fields valid for secret hooks (secret-changed, secret-rotate,
+	// secret-expired and secret-remove) only.
+
+	// SecretId holds the URI of the secret that the current
+	// hook is running for.
+	SecretId string
+
+	// SecretLabel holds the label of the secret that the
+	// current hook is running for, if it has one.
+	SecretLabel string
+
+	// SecretRevision holds the revision of the secret that
+	// the current hook is running for. It is only set
+	// for secret-expired and secret-remove hooks.
+	SecretRevision int
+
+	// Fields valid for series upgrade hooks
+	// (pre-series-upgrade and post-series-upgrade) only.
+
+	// TargetSeries holds the series that the unit's
+	// machine is being upgraded to.
+	TargetSeries string
+
+	// Fields valid for actions only.
+
+	// ActionName holds the name of the action that is
+	// currently running. It is empty if the current
+	// hook is not an action.
+	ActionName string
+
+	// ActionId holds the id of the currently running action.
+	ActionId string
+
 	// Runner is used to run hook tools by methods on the context.
 	Runner ToolRunner
 
@@ -127,14 +217,50 @@ type Context struct {
 	RunCommandArgs []string
 }
 
+// contextCache holds information that does not change
+// for the duration of a hook.
+type contextCache struct {
+	isLeader *bool
+
+	// hookState holds the hook package's persistent state.
+	hookState *hookState
+
+	// config holds all the configuration values
+	// if they have been retrieved by Main.
+	config map[string]json.RawMessage
+
+	// changes holds the values used to calculate
+	// configuration and relation changes.
+	changes *changeCache
+
+	// deferCurrent records whether Context.Defer
+	// has been called by the running hook function.
+	deferCurrent bool
+
+	// status collects status reports while Main is
+	// running hook functions.
+	status *statusCollector
+
+	// encryption holds the state encryption in use
+	// by Main, if any. See RegisterStateEncryption.
+	encryption *stateEncryption
+}
+
 // Relation holds the current relation settings for the unit
 // that triggered the current hook. It will panic if
 // the current hook is not a relation-related hook.
+// If the settings cannot be fetched, the error is
+// logged and Relation returns nil.
 func (ctxt *Context) Relation() map[string]string {
 	if ctxt.RemoteUnit == "" || ctxt.RelationId == "" {
 		panic(fmt.Errorf("Relation called in non-relation hook %s", ctxt.HookName))
 	}
-	return ctxt.Relations[ctxt.RelationId][ctxt.RemoteUnit]
+	units, err := ctxt.GetRelationUnits(ctxt.RelationId)
+	if err != nil {
+		ctxt.Logf("%v", err)
+		return nil
+	}
+	return units[ctxt.RemoteUnit]
 }
 
 // Close closes ctxt.Runner, if it is not nil.
@@ -225,11 +351,21 @@ func (ctxt *Context) Logf(f string, a ...interface{}) error {
 	return errgo.Mask(err)
 }
 
+// getAllRelationApp returns all the application settings published
+// by the given application on the relation with the given id.
+func (ctxt *Context) getAllRelationApp(relationId RelationId, app string) (map[string]string, error) {
+	var val map[string]string
+	if err := ctxt.RunJSON(&val, "relation-get", "-r", string(relationId), "--app", "--format", "json", "--", "-", app); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return val, nil
+}
+
 // getAllRelationUnit returns all the settings from the given unit associated
 // with the relation with the given id.
 func (ctxt *Context) getAllRelationUnit(relationId RelationId, unit UnitId) (map[string]string, error) {
 	var val map[string]string
-	if err := ctxt.runJSON(&val, "relation-get", "-r", string(relationId), "--format", "json", "--", "-", string(unit)); err != nil {
+	if err := ctxt.RunJSON(&val, "relation-get", "-r", string(relationId), "--format", "json", "--", "-", string(unit)); err != nil {
 		return nil, errgo.Mask(err)
 	}
 	return val, nil
@@ -239,7 +375,7 @@ func (ctxt *Context) getAllRelationUnit(relationId RelationId, unit UnitId) (map
 // with the relation with the given name.
 func (ctxt *Context) relationIds(relationName string) ([]RelationId, error) {
 	var val []RelationId
-	if err := ctxt.runJSON(&val, "relation-ids", "--format", "json", "--", relationName); err != nil {
+	if err := ctxt.RunJSON(&val, "relation-ids", "--format", "json", "--", relationName); err != nil {
 		return nil, errgo.Mask(err)
 	}
 	return val, nil
@@ -248,7 +384,7 @@ func (ctxt *Context) relationIds(relationName string) ([]RelationId, error) {
 // relationUnits returns all the units associated with the given relation id.
 func (ctxt *Context) relationUnits(relationId RelationId) ([]UnitId, error) {
 	var val []UnitId
-	if err := ctxt.runJSON(&val, "relation-list", "--format", "json", "-r", string(relationId)); err != nil {
+	if err := ctxt.RunJSON(&val, "relation-list", "--format", "json", "-r", string(relationId)); err != nil {
 		return nil, errgo.Mask(err)
 	}
 	return val, nil
@@ -278,6 +414,34 @@ func (ctxt *Context) SetRelationWithId(relationId RelationId, keyvals ...string)
 	return errgo.Mask(err)
 }
 
+// SetAppRelation sets the given key-value pairs in the application
+// databag of the relation with the given id, making them available to
+// all units of the remote application. Only the leader may set
+// application relation settings; it returns an error if the current
+// unit is not the leader.
+func (ctxt *Context) SetAppRelation(relationId RelationId, keyvals ...string) error {
+	if len(keyvals)%2 != 0 {
+		return errgo.Newf("invalid key/value count")
+	}
+	if len(keyvals) == 0 {
+		return nil
+	}
+	isLeader, err := ctxt.IsLeader()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !isLeader {
+		return errgo.Newf("cannot set application settings on relation %s: unit %s is not the leader", relationId, ctxt.Unit)
+	}
+	args := make([]string, 0, 4+len(keyvals)/2)
+	args = append(args, "-r", string(relationId), "--app", "--")
+	for i := 0; i < len(keyvals); i += 2 {
+		args = append(args, fmt.Sprintf("%s=%s", keyvals[i], keyvals[i+1]))
+	}
+	_, err = ctxt.Runner.Run("relation-set", args...)
+	return errgo.Mask(err)
+}
+
 // GetConfig reads the charm configuration value for the given
 // key into the value pointed to by val, which should be
 // a pointer to one of the possible configuration option
@@ -285,7 +449,7 @@ func (ctxt *Context) SetRelationWithId(relationId RelationId, keyvals ...string)
 // To find out whether a value has actually been set (is non-null)
 // pass a pointer to a pointer to the desired type.
 func (ctxt *Context) GetConfig(key string, val interface{}) error {
-	if err := ctxt.runJSON(val, "config-get", "--format", "json", "--", key); err != nil {
+	if err := ctxt.RunJSON(val, "config-get", "--format", "json", "--", key); err != nil {
 		return errgo.Notef(err, "cannot get configuration option %q", key)
 	}
 	return nil
@@ -341,7 +505,7 @@ func (ctxt *Context) GetConfigBool(key string) (bool, error) {
 // what they might be, pass in a pointer to a map[string]interface{}
 // value,
 func (ctxt *Context) GetAllConfig(val interface{}) error {
-	if err := ctxt.runJSON(&val, "config-get", "--format", "json"); err != nil {
+	if err := ctxt.RunJSON(&val, "config-get", "--format", "json"); err != nil {
 		return errgo.Mask(err)
 	}
 	return nil
@@ -361,18 +525,42 @@ const (
 // message. If the status cannot be set because we are
 // using a version of juju that does not yet support it,
 // that error will be silently discarded.
+//
+// When called from a hook function, the status is not set
+// immediately. Instead, the status reported by each registry
+// (and each reconciler, see RegisterReconciler) is remembered,
+// and when all the hook functions have completed, the unit's status
+// is set to the most severe of them (blocked, then maintenance, then
+// waiting, then active), with a message combining the messages of
+// the reports with that status, each prefixed with the name of the
+// registry that reported it. A report remains in effect until the
+// same registry reports another status, so, for example, a blocked
+// status set by one charmbit is not overwritten when another
+// charmbit reports that it is active.
 func (ctxt *Context) SetStatus(st Status, message string) error {
-	_, err := ctxt.Runner.Run("status-set", string(st), message)
-	if errgo.Cause(err) == ErrUnimplemented {
-		return nil
+	if _, ok := statusSeverity[st]; !ok {
+		return errgo.Newf("invalid status %q", st)
 	}
-	return errgo.Mask(err)
+	if !ctxt.collectingStatus() {
+		return ctxt.runStatusSet(false, st, message)
+	}
+	ctxt.reportStatus(statusReport{
+		Source:  registrySource(ctxt.registryName),
+		Label:   registryLabel(ctxt.registryName),
+		Status:  st,
+		Message: message,
+	})
+	return nil
 }
 
-func (ctxt *Context) runJSON(dst interface{}, cmd string, args ...string) error {
+// RunJSON runs the hook tool with the given name and arguments,
+// which should ask for JSON output, and unmarshals the output into
+// dst. It is useful for hook tools that are not otherwise supported by
+// this package.
+func (ctxt *Context) RunJSON(dst interface{}, cmd string, args ...string) error {
 	out, err := ctxt.Runner.Run(cmd, args...)
 	if err != nil {
-		return errgo.Mask(err)
+		return errgo.Mask(err, errgo.Is(ErrUnimplemented))
 	}
 	if err := json.Unmarshal(out, dst); err != nil {
 		return errgo.Notef(err, "cannot parse command output %q", out)
@@ -3,7 +3,9 @@ package hooktest
 
 import (
 	"encoding/json"
+	"sort"
 	"strings"
+	"sync"
 
 	"gopkg.in/errgo.v1"
 
@@ -17,22 +19,91 @@ import (
 // and records all the calls in the Record field, with the
 // exception of the calls mentioned below.
 //
-// Any calls to juju-log are logged using Logger, but otherwise ignored.
-// Calls to config-get from the Config field and not invoked through RunFunc.
-// Likewise, calls to unit-get will be satisfied from the PublicAddress
-// and PrivateAddress fields.
+// Any calls to juju-log and action-log are logged using Logger, but
+// otherwise ignored. The following hook tools are satisfied from
+// fields of the Runner and are not invoked through RunFunc:
+//
+//	config-get	Config
+//	unit-get	PublicAddress and PrivateAddress
+//	action-get	ActionParams
+//	is-leader	IsLeader
+//	leader-get	LeaderSettings
+//	storage-list	Storage
+//	storage-get	Storage
+//	network-get	Networks and PrivateAddress
+//	relation-ids	RelationIds
+//	relation-list	Relations
+//	relation-get	Relations and AppRelations
+//	secret-get	Secrets
+//	secret-ids	Secrets
+//	secret-info-get	Secrets
+//	status-get	Status and AppStatus
+//	state-get	UnitState
+//
+// Calls to leader-set are recorded as usual and also update
+// LeaderSettings. Calls to secret-add, secret-set, secret-remove,
+// secret-grant and secret-revoke are recorded as usual and
+// also update Secrets; as in Juju, they fail for secrets owned
+// by the application unless IsLeader is true. Calls to status-set are recorded as usual
+// and also update Status or AppStatus. Calls to state-set and
+// state-delete are recorded as usual and also update UnitState.
+//
+// As in Juju, only add-metric and juju-log may be used in the
+// collect-metrics hook; Run returns an error for any other hook tool
+// called while that hook is running.
+//
+// Every call to a hook tool, including those satisfied from fields,
+// is counted in ToolCalls. Run may be called concurrently.
 type Runner struct {
 	RegisterHooks func(r *hook.Registry)
 
 	// The following fields hold information that will
 	// be available through the hook context.
-	Relations   map[hook.RelationId]map[hook.UnitId]map[string]string
-	RelationIds map[string][]hook.RelationId
-	Config      map[string]interface{}
+	Relations    map[hook.RelationId]map[hook.UnitId]map[string]string
+	AppRelations map[hook.RelationId]map[string]string
+	RelationIds  map[string][]hook.RelationId
+	Config       map[string]interface{}
+
+	// ActionParams holds the parameters that will be
+	// returned by action-get when an action is run with RunAction.
+	ActionParams map[string]interface{}
+
+	// IsLeader holds whether the unit is the leader.
+	// LeaderSettings holds the current leader settings;
+	// it is updated when leader-set is called on the leader.
+	IsLeader       bool
+	LeaderSettings map[string]string
+
+	// Storage holds the storage instances attached to the unit,
+	// keyed by storage id (for example "data/0"). Each
+	// entry holds the location of the storage, usually a
+	// temporary directory. See AttachStorage.
+	Storage map[string]string
 
 	PublicAddress  string
 	PrivateAddress string
 
+	// Networks holds the network information returned by
+	// network-get, keyed by binding name. If there is no
+	// entry for a binding, network-get returns PrivateAddress
+	// as the only ingress address.
+	Networks map[string]*hook.NetworkInfo
+
+	// Secrets holds the secrets available to the unit.
+	// If it is nil, it will be created when a secret
+	// hook tool is first run.
+	Secrets *SecretStore
+
+	// Status and AppStatus hold the current unit and
+	// application status. They are updated when
+	// status-set is called.
+	Status    hook.StatusInfo
+	AppStatus hook.StatusInfo
+
+	// UnitState holds the unit state stored in the
+	// controller with state-set (see hook.NewControllerState).
+	UnitState map[string]string
+
 	// HookStateDir holds the directory in which state
 	// other than hook state will be stored (for instance,
 	// this is used by the service package to store service
@@ -50,6 +121,17 @@ type Runner struct {
 	RunFunc func(string, ...string) ([]byte, error)
 	Record  [][]string
 
+	// ToolCalls holds the number of times each
+	// hook tool has been called, keyed by tool name.
+	ToolCalls map[string]int
+
+	// mu guards the fields changed by Run.
+	mu sync.Mutex
+
+	// restricted records whether the collect-metrics hook
+	// is running, so that only metric tools are allowed.
+	restricted bool
+
 	// Logger should be set to a logger. The Logf method
 	// will be called when the charm generates log messages.
 	Logger interface {
@@ -63,32 +145,16 @@ type Runner struct {
 // RunHook runs a hook in the context of the Runner. If it's a relation
 // hook, then relId should hold the current relation id and
 // relUnit should hold the unit that the relation hook is running for.
+// For a <container>-pebble-ready hook, the context's WorkloadName
+// is set to the container name.
 //
 // Any hook tools that have been run will be stored in r.Record.
 func (runner *Runner) RunHook(hookName string, relId hook.RelationId, relUnit hook.UnitId) error {
-	if runner.HookStateDir == "" {
-		panic("empty hook state dir")
-	}
-	if runner.State == nil {
-		runner.State = make(MemState)
-	}
-	r := hook.NewRegistry()
-	runner.RegisterHooks(r)
-	hook.RegisterMainHooks(r)
-	hctxt := &hook.Context{
-		UUID:         UUID,
-		Unit:         "someunit/0",
-		CharmDir:     "/dev/null",
-		HookStateDir: runner.HookStateDir,
-
-		HookName:    hookName,
-		Runner:      runner,
-		Relations:   runner.Relations,
-		RelationIds: runner.RelationIds,
-	}
+	hctxt := runner.newContext(hookName)
 	if relId != "" {
 		hctxt.RelationId = relId
 		hctxt.RemoteUnit = relUnit
+		hctxt.RemoteApp = relUnit.App()
 	loop:
 		for name, ids := range runner.RelationIds {
 			for _, id := range ids {
@@ -101,7 +167,128 @@ func (runner *Runner) RunHook(hookName string, relId hook.RelationId, relUnit ho
 		if hctxt.RelationName == "" {
 			panic("relation id not found")
 		}
+		if strings.HasSuffix(hookName, "-relation-departed") {
+			hctxt.DepartingUnit = relUnit
+		}
+	}
+	if strings.HasSuffix(hookName, "-pebble-ready") {
+		hctxt.WorkloadName = strings.TrimSuffix(hookName, "-pebble-ready")
+	}
+	return runner.main(hctxt)
+}
+
+// RunSecretHook runs the secret hook with the given name (for
+// example "secret-changed") for the secret with the given id, label
+// and revision.
+func (runner *Runner) RunSecretHook(hookName string, secretId, label string, revision int) error {
+	hctxt := runner.newContext(hookName)
+	hctxt.SecretId = secretId
+	hctxt.SecretLabel = label
+	hctxt.SecretRevision = revision
+	return runner.main(hctxt)
+}
+
+// RunAction runs the action with the given name in the context
+// of the Runner. The action parameters are taken from
+// runner.ActionParams.
+//
+// Any hook tools that have been run, including action-set
+// and action-fail, will be stored in r.Record.
+func (runner *Runner) RunAction(actionName string) error {
+	hctxt := runner.newContext("action")
+	hctxt.ActionName = actionName
+	hctxt.ActionId = "1"
+	return runner.main(hctxt)
+}
+
+// Deferred returns the hook functions that are currently deferred
+// (see hook.Context.Defer), in the order they will run.
+func (runner *Runner) Deferred() ([]hook.DeferredEvent, error) {
+	if runner.State == nil {
+		return nil, nil
+	}
+	return hook.DeferredEvents(runner.State)
+}
+
+// RunDeferred runs any deferred hook functions as they would be run at
+// the start of the next hook, but without running any other hook
+// functions. This makes it possible to step through deferred events.
+func (runner *Runner) RunDeferred() error {
+	r := hook.NewRegistry()
+	runner.RegisterHooks(r)
+	hook.RegisterMainHooks(r)
+	return hook.MainDeferred(r, runner.newContext("update-status"), runner.State)
+}
+
+// AttachStorage simulates the attachment of the storage instance with
+// the given id (for example "data/0") at the given location, which
+// will usually be a temporary directory. It adds the storage to
+// runner.Storage and runs the corresponding storage-attached hook.
+func (runner *Runner) AttachStorage(id string, location string) error {
+	if runner.Storage == nil {
+		runner.Storage = make(map[string]string)
+	}
+	runner.Storage[id] = location
+	hctxt := runner.newContext(storageName(id) + "-storage-attached")
+	hctxt.StorageId = id
+	return runner.main(hctxt)
+}
+
+// DetachStorage simulates the detachment of the storage instance with
+// the given id. It runs the corresponding storage-detaching hook and
+// then removes the storage from runner.Storage.
+func (runner *Runner) DetachStorage(id string) error {
+	hctxt := runner.newContext(storageName(id) + "-storage-detaching")
+	hctxt.StorageId = id
+	if err := runner.main(hctxt); err != nil {
+		return err
+	}
+	delete(runner.Storage, id)
+	return nil
+}
+
+// storageName returns the storage name part of a storage id.
+func storageName(id string) string {
+	if i := strings.Index(id, "/"); i >= 0 {
+		return id[0:i]
+	}
+	return id
+}
+
+// newContext returns a new hook context for running
+// the hook with the given name.
+func (runner *Runner) newContext(hookName string) *hook.Context {
+	if runner.HookStateDir == "" {
+		panic("empty hook state dir")
+	}
+	if runner.State == nil {
+		runner.State = make(MemState)
+	}
+	return &hook.Context{
+		UUID:         UUID,
+		Unit:         "someunit/0",
+		CharmDir:     "/dev/null",
+		HookStateDir: runner.HookStateDir,
+
+		HookName: hookName,
+		Runner:   runner,
 	}
+}
+
+// main runs hook.Main with the given context
+// and a freshly registered registry.
+func (runner *Runner) main(hctxt *hook.Context) error {
+	runner.mu.Lock()
+	runner.restricted = hctxt.HookName == "collect-metrics"
+	runner.mu.Unlock()
+	defer func() {
+		runner.mu.Lock()
+		runner.restricted = false
+		runner.mu.Unlock()
+	}()
+	r := hook.NewRegistry()
+	runner.RegisterHooks(r)
+	hook.RegisterMainHooks(r)
 	c, err := hook.Main(r, hctxt, runner.State)
 	if c != nil {
 		panic(errgo.Newf("non-command hook returned Command"))
@@ -127,6 +314,19 @@ func (runner *Runner) RunCommand(cmdName string, args []string) (hook.Command, e
 
 // Run implements hook.Runner.Run.
 func (runner *Runner) Run(cmd string, args ...string) ([]byte, error) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if runner.ToolCalls == nil {
+		runner.ToolCalls = make(map[string]int)
+	}
+	runner.ToolCalls[cmd]++
+	if runner.restricted && cmd != "add-metric" && cmd != "juju-log" {
+		return nil, errgo.Newf("%s cannot be used in the collect-metrics hook", cmd)
+	}
+	return runner.run(cmd, args...)
+}
+
+func (runner *Runner) run(cmd string, args ...string) ([]byte, error) {
 	if cmd == "juju-log" {
 		if len(args) != 1 {
 			panic("expected exactly one argument to juju-log")
@@ -135,6 +335,106 @@ func (runner *Runner) Run(cmd string, args ...string) ([]byte, error) {
 		return nil, nil
 	}
 	switch cmd {
+	case "action-get":
+		data, err := json.Marshal(runner.ActionParams)
+		if err != nil {
+			panic(err)
+		}
+		return data, nil
+	case "action-log":
+		if len(args) != 1 {
+			panic("expected exactly one argument to action-log")
+		}
+		runner.Logger.Logf("action: %s", args[0])
+		return nil, nil
+	case "is-leader":
+		return json.Marshal(runner.IsLeader)
+	case "leader-get":
+		var val interface{} = runner.LeaderSettings
+		if len(args) > 3 {
+			// leader-get --format json -- key
+			val = runner.LeaderSettings[args[3]]
+		}
+		data, err := json.Marshal(val)
+		if err != nil {
+			panic(err)
+		}
+		return data, nil
+	case "storage-list":
+		// storage-list --format json [-- name]
+		ids := []string{}
+		for id := range runner.Storage {
+			if len(args) < 4 || storageName(id) == args[3] {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		return json.Marshal(ids)
+	case "storage-get":
+		// storage-get --format json -s id
+		location, ok := runner.Storage[args[3]]
+		if !ok {
+			return nil, errgo.Newf("storage %q not found", args[3])
+		}
+		return json.Marshal(hook.StorageInfo{
+			Kind:     "filesystem",
+			Location: location,
+		})
+	case "network-get":
+		// network-get --format json -- binding
+		info, ok := runner.Networks[args[3]]
+		if !ok {
+			info = &hook.NetworkInfo{
+				IngressAddresses: []string{runner.PrivateAddress},
+			}
+		}
+		return json.Marshal(info)
+	case "relation-ids":
+		// relation-ids --format json -- name
+		ids := runner.RelationIds[args[3]]
+		if ids == nil {
+			ids = []hook.RelationId{}
+		}
+		return json.Marshal(ids)
+	case "relation-list":
+		// relation-list --format json -r id
+		units := []hook.UnitId{}
+		for unit := range runner.Relations[hook.RelationId(args[3])] {
+			units = append(units, unit)
+		}
+		sort.Slice(units, func(i, j int) bool {
+			return units[i] < units[j]
+		})
+		return json.Marshal(units)
+	case "relation-get":
+		if len(args) == 8 && args[2] == "--app" {
+			// relation-get -r id --app --format json -- - app
+			return json.Marshal(runner.AppRelations[hook.RelationId(args[1])])
+		}
+		if len(args) == 7 && args[5] == "-" {
+			// relation-get -r id --format json -- - unit
+			return json.Marshal(runner.Relations[hook.RelationId(args[1])][hook.UnitId(args[6])])
+		}
+	case "secret-get", "secret-ids", "secret-info-get":
+		return runner.secrets().run(cmd, args, runner.IsLeader)
+	case "state-get":
+		// state-get --format json
+		val := runner.UnitState
+		if val == nil {
+			val = map[string]string{}
+		}
+		return json.Marshal(val)
+	case "status-get":
+		// status-get --format json --include-data [--application]
+		if len(args) > 3 && args[3] == "--application" {
+			if !runner.IsLeader {
+				return nil, errgo.New("finding application status: not the leader")
+			}
+			return json.Marshal(map[string]hook.StatusInfo{
+				"application-status": runner.AppStatus,
+			})
+		}
+		return json.Marshal(runner.Status)
 	case "config-get":
 		var val interface{}
 		if len(args) < 4 {
@@ -166,12 +466,94 @@ func (runner *Runner) Run(cmd string, args ...string) ([]byte, error) {
 	rec := []string{cmd}
 	rec = append(rec, args...)
 	runner.Record = append(runner.Record, rec)
+	if cmd == "leader-set" {
+		return nil, runner.leaderSet(args)
+	}
+	if cmd == "status-set" {
+		return nil, runner.statusSet(args)
+	}
+	switch cmd {
+	case "state-set":
+		if runner.UnitState == nil {
+			runner.UnitState = make(map[string]string)
+		}
+		for _, arg := range args {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				panic(errgo.Newf("invalid state-set argument %q", arg))
+			}
+			runner.UnitState[kv[0]] = kv[1]
+		}
+		return nil, nil
+	case "state-delete":
+		delete(runner.UnitState, args[0])
+		return nil, nil
+	}
+	switch cmd {
+	case "secret-add", "secret-set", "secret-remove", "secret-grant", "secret-revoke":
+		return runner.secrets().run(cmd, args, runner.IsLeader)
+	}
 	if runner.RunFunc != nil {
 		return runner.RunFunc(cmd, args...)
 	}
 	return nil, nil
 }
 
+// secrets returns runner.Secrets, creating it if necessary.
+func (runner *Runner) secrets() *SecretStore {
+	if runner.Secrets == nil {
+		runner.Secrets = new(SecretStore)
+	}
+	return runner.Secrets
+}
+
+// leaderSet updates runner.LeaderSettings as
+// leader-set would.
+func (runner *Runner) leaderSet(args []string) error {
+	if !runner.IsLeader {
+		return errgo.New("cannot write leadership settings: not the leader")
+	}
+	if runner.LeaderSettings == nil {
+		runner.LeaderSettings = make(map[string]string)
+	}
+	for _, arg := range args {
+		if arg == "--" {
+			continue
+		}
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			panic(errgo.Newf("invalid leader-set argument %q", arg))
+		}
+		if kv[1] == "" {
+			delete(runner.LeaderSettings, kv[0])
+		} else {
+			runner.LeaderSettings[kv[0]] = kv[1]
+		}
+	}
+	return nil
+}
+
+// statusSet updates runner.Status or runner.AppStatus
+// as status-set would.
+func (runner *Runner) statusSet(args []string) error {
+	status := &runner.Status
+	if len(args) > 0 && args[0] == "--application" {
+		if !runner.IsLeader {
+			return errgo.New("cannot set application status: not the leader")
+		}
+		status = &runner.AppStatus
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		panic(errgo.Newf("unexpected status-set arguments %q", args))
+	}
+	*status = hook.StatusInfo{
+		Status:  hook.Status(args[0]),
+		Message: args[1],
+	}
+	return nil
+}
+
 // Run implements hook.Runner.Close.
 // It panics if called more than once.
 func (runner *Runner) Close() error {
@@ -195,5 +577,19 @@ func (s MemState) Load(name string) ([]byte, error) {
 	return s[name], nil
 }
 
+func (s MemState) Delete(name string) error {
+	delete(s, name)
+	return nil
+}
+
+func (s MemState) List() ([]string, error) {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
 // UUID holds an arbitrary environment UUID for testing purposes.
 const UUID = "373b309b-4a86-4f13-88e2-c213d97075b8"
@@ -0,0 +1,68 @@
+package hooktest
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	"gopkg.in/errgo.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+)
+
+// CheckStateMigrations checks the migrations for the state registered
+// with hook.Registry.RegisterContextVersioned by the registry with the
+// given name (for example "root.db") when registerHooks is called.
+//
+// The states map holds the state data, as it would have been saved,
+// expected at some or all of the versions of the state, including the
+// current one. The state at the earliest version is migrated one step
+// at a time to the current version; after each step, if the map holds
+// an entry for the new version, the migrated data must hold the same
+// JSON value as that entry. An error is returned if any migration
+// fails or produces unexpected data, or if the migrated data holds
+// fields that are not in the state type.
+func CheckStateMigrations(registerHooks func(r *hook.Registry), registryName string, states map[int]string) error {
+	if len(states) == 0 {
+		return errgo.New("no states to check")
+	}
+	r := hook.NewRegistry()
+	registerHooks(r)
+	versions := make([]int, 0, len(states))
+	for v := range states {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	first := versions[0]
+	_, err := hook.MigrateState(r, registryName, first, []byte(states[first]), func(v int, data []byte) error {
+		want, ok := states[v]
+		if !ok {
+			return nil
+		}
+		equal, err := jsonEqual(data, []byte(want))
+		if err != nil {
+			return errgo.Notef(err, "invalid state at version %d", v)
+		}
+		if !equal {
+			return errgo.Newf("state migrated to version %d is %s; want %s", v, data, want)
+		}
+		return nil
+	})
+	if err != nil {
+		return errgo.Notef(err, "state at version %d", first)
+	}
+	return nil
+}
+
+// jsonEqual reports whether the given JSON
+// documents hold the same value.
+func jsonEqual(data0, data1 []byte) (bool, error) {
+	var v0, v1 interface{}
+	if err := json.Unmarshal(data0, &v0); err != nil {
+		return false, errgo.Mask(err)
+	}
+	if err := json.Unmarshal(data1, &v1); err != nil {
+		return false, errgo.Mask(err)
+	}
+	return reflect.DeepEqual(v0, v1), nil
+}
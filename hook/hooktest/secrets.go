@@ -0,0 +1,247 @@
+package hooktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// SecretStore is an in-memory store of Juju secrets. It is used by
+// Runner to implement the secret hook tools.
+type SecretStore struct {
+	// Secrets holds all the secrets, keyed by id.
+	Secrets map[string]*Secret
+
+	nextId int
+}
+
+// Secret holds a secret in a SecretStore.
+type Secret struct {
+	Id string
+
+	// Owner holds the owner of a secret created by the charm
+	// under test, either "application" or "unit". It is empty
+	// for secrets owned by other applications.
+	Owner string
+
+	// Label holds the label given to the secret by the charm
+	// under test.
+	Label string
+
+	// Revisions holds the content of each revision of the
+	// secret. Revision n is held in Revisions[n-1]. The content
+	// of a revision that has been removed is nil.
+	Revisions []map[string]string
+
+	// Tracked holds the revision that the charm under test is
+	// tracking as a consumer of the secret. It is zero if the
+	// charm has not yet read the secret.
+	Tracked int
+
+	// Grants holds an entry for each relation id that has
+	// been granted access to the secret. If access has been
+	// granted to a single unit only, the key holds the
+	// relation id and the unit separated by a space.
+	Grants map[string]bool
+}
+
+// Add adds a secret owned by another application with the given
+// content to the store, and returns its id. The charm under test
+// can then consume it.
+func (s *SecretStore) Add(content map[string]string) string {
+	return s.add("", "", content)
+}
+
+// Update adds a new revision with the given content
+// to the secret with the given id.
+func (s *SecretStore) Update(id string, content map[string]string) {
+	sec, ok := s.Secrets[id]
+	if !ok {
+		panic(fmt.Errorf("secret %q not found", id))
+	}
+	sec.Revisions = append(sec.Revisions, content)
+}
+
+func (s *SecretStore) add(owner, label string, content map[string]string) string {
+	if s.Secrets == nil {
+		s.Secrets = make(map[string]*Secret)
+	}
+	s.nextId++
+	id := fmt.Sprintf("secret:%d", s.nextId)
+	s.Secrets[id] = &Secret{
+		Id:        id,
+		Owner:     owner,
+		Label:     label,
+		Revisions: []map[string]string{content},
+	}
+	return id
+}
+
+// run runs the secret hook tool with the given name
+// and arguments. As in Juju, only the leader can create
+// or change secrets owned by the application.
+func (s *SecretStore) run(cmd string, args []string, isLeader bool) ([]byte, error) {
+	pos, flags := parseSecretArgs(args)
+	if cmd == "secret-add" {
+		content, err := parseContent(pos)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		owner := flags["--owner"]
+		if owner == "" {
+			owner = "application"
+		}
+		if owner == "application" && !isLeader {
+			return nil, errgo.New("cannot add application-owned secret: not the leader")
+		}
+		return []byte(s.add(owner, flags["--label"], content) + "\n"), nil
+	}
+	if cmd == "secret-ids" {
+		ids := []string{}
+		for id, sec := range s.Secrets {
+			if sec.Owner != "" {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		return json.Marshal(ids)
+	}
+	sec, pos, err := s.lookup(pos, flags)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	switch cmd {
+	case "secret-set", "secret-remove", "secret-grant", "secret-revoke":
+		if sec.Owner == "application" && !isLeader {
+			return nil, errgo.Newf("cannot change application-owned secret %q: not the leader", sec.Id)
+		}
+	}
+	switch cmd {
+	case "secret-get":
+		if label := flags["--label"]; label != "" {
+			sec.Label = label
+		}
+		rev := len(sec.Revisions)
+		switch {
+		case sec.Owner != "", flags["--peek"] != "":
+		case sec.Tracked == 0, flags["--refresh"] != "":
+			sec.Tracked = rev
+		default:
+			rev = sec.Tracked
+		}
+		content := sec.Revisions[rev-1]
+		if len(pos) > 0 {
+			return json.Marshal(content[pos[0]])
+		}
+		return json.Marshal(content)
+	case "secret-info-get":
+		return json.Marshal(map[string]interface{}{
+			sec.Id: map[string]interface{}{
+				"revision": len(sec.Revisions),
+				"label":    sec.Label,
+				"owner":    sec.Owner,
+			},
+		})
+	case "secret-set":
+		content, err := parseContent(pos)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if label := flags["--label"]; label != "" {
+			sec.Label = label
+		}
+		sec.Revisions = append(sec.Revisions, content)
+		return nil, nil
+	case "secret-remove":
+		if rev := flags["--revision"]; rev != "" {
+			n, err := strconv.Atoi(rev)
+			if err != nil || n < 1 || n > len(sec.Revisions) {
+				return nil, errgo.Newf("invalid revision %q", rev)
+			}
+			sec.Revisions[n-1] = nil
+			return nil, nil
+		}
+		delete(s.Secrets, sec.Id)
+		return nil, nil
+	case "secret-grant", "secret-revoke":
+		key := flags["-r"]
+		if unit := flags["--unit"]; unit != "" {
+			key += " " + unit
+		}
+		if sec.Grants == nil {
+			sec.Grants = make(map[string]bool)
+		}
+		if cmd == "secret-grant" {
+			sec.Grants[key] = true
+		} else {
+			delete(sec.Grants, key)
+		}
+		return nil, nil
+	}
+	return nil, errgo.Newf("unexpected secret command %q", cmd)
+}
+
+// lookup finds the secret referred to by the given
+// arguments, either by id (the first positional argument)
+// or by label. It returns the remaining positional arguments.
+func (s *SecretStore) lookup(pos []string, flags map[string]string) (*Secret, []string, error) {
+	if len(pos) > 0 && strings.HasPrefix(pos[0], "secret:") {
+		sec, ok := s.Secrets[pos[0]]
+		if !ok {
+			return nil, nil, errgo.Newf("secret %q not found", pos[0])
+		}
+		return sec, pos[1:], nil
+	}
+	label := flags["--label"]
+	for _, sec := range s.Secrets {
+		if label != "" && sec.Label == label {
+			return sec, pos, nil
+		}
+	}
+	return nil, nil, errgo.Newf("secret with label %q not found", label)
+}
+
+// secretBoolFlags holds the secret tool flags
+// that do not take an argument.
+var secretBoolFlags = map[string]bool{
+	"--refresh": true,
+	"--peek":    true,
+}
+
+// parseSecretArgs parses the arguments to a secret tool into
+// positional arguments and flags. Flags that do not
+// take an argument are given the value "true".
+func parseSecretArgs(args []string) ([]string, map[string]string) {
+	var pos []string
+	flags := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case secretBoolFlags[arg]:
+			flags[arg] = "true"
+		case strings.HasPrefix(arg, "-") && i+1 < len(args):
+			flags[arg] = args[i+1]
+			i++
+		default:
+			pos = append(pos, arg)
+		}
+	}
+	return pos, flags
+}
+
+// parseContent parses key=value arguments into secret content.
+func parseContent(args []string) (map[string]string, error) {
+	content := make(map[string]string)
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			return nil, errgo.Newf("invalid secret content argument %q", arg)
+		}
+		content[arg[0:i]] = arg[i+1:]
+	}
+	return content, nil
+}
@@ -0,0 +1,65 @@
+package hook
+
+import (
+	"fmt"
+
+	"gopkg.in/errgo.v1"
+)
+
+// IsLeader reports whether the current unit is the leader of its
+// application. The result is cached for the rest of the hook, because
+// Juju guarantees that leadership will not be lost by a unit
+// until its current hook has completed.
+func (ctxt *Context) IsLeader() (bool, error) {
+	if ctxt.cache != nil && ctxt.cache.isLeader != nil {
+		return *ctxt.cache.isLeader, nil
+	}
+	var isLeader bool
+	if err := ctxt.RunJSON(&isLeader, "is-leader", "--format", "json"); err != nil {
+		return false, errgo.Mask(err)
+	}
+	if ctxt.cache != nil {
+		ctxt.cache.isLeader = &isLeader
+	}
+	return isLeader, nil
+}
+
+// LeaderSettings returns all the current leader settings.
+// Leader settings are set by the leader with SetLeaderSettings
+// and can be read by all units of the application.
+func (ctxt *Context) LeaderSettings() (map[string]string, error) {
+	var val map[string]string
+	if err := ctxt.RunJSON(&val, "leader-get", "--format", "json"); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return val, nil
+}
+
+// LeaderSetting returns the leader setting with the given key,
+// or the empty string if it has not been set.
+func (ctxt *Context) LeaderSetting(key string) (string, error) {
+	var val string
+	if err := ctxt.RunJSON(&val, "leader-get", "--format", "json", "--", key); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return val, nil
+}
+
+// SetLeaderSettings sets the given key-value pairs in the leader
+// settings. Setting a key to the empty string removes it. This will
+// fail if the current unit is not the leader.
+func (ctxt *Context) SetLeaderSettings(keyvals ...string) error {
+	if len(keyvals)%2 != 0 {
+		return errgo.Newf("invalid key/value count")
+	}
+	if len(keyvals) == 0 {
+		return nil
+	}
+	args := make([]string, 0, 1+len(keyvals)/2)
+	args = append(args, "--")
+	for i := 0; i < len(keyvals); i += 2 {
+		args = append(args, fmt.Sprintf("%s=%s", keyvals[i], keyvals[i+1]))
+	}
+	_, err := ctxt.Runner.Run("leader-set", args...)
+	return errgo.Mask(err)
+}
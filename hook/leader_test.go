@@ -0,0 +1,222 @@
+package hook_test
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type leaderSuite struct{}
+
+var _ = gc.Suite(&leaderSuite{})
+
+func (*leaderSuite) TestLeaderHooksAreValid(c *gc.C) {
+	r := hook.NewRegistry()
+	r.RegisterHook("leader-elected", nop)
+	r.RegisterHook("leader-settings-changed", nop)
+	r.RegisterHook("leader-deposed", nop)
+}
+
+func (*leaderSuite) TestIsLeaderIsCached(c *gc.C) {
+	isLeaderCount := 0
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		IsLeader:     true,
+		Logger:       c,
+	}
+	ctxt := &hook.Context{
+		HookName: "leader-elected",
+		Runner: runFunc(func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "is-leader" {
+				isLeaderCount++
+			}
+			return runner.Run(cmd, args...)
+		}),
+	}
+	r := hook.NewRegistry()
+	var hctxt *hook.Context
+	r.RegisterContext(func(ctxt *hook.Context) error {
+		hctxt = ctxt
+		return nil
+	}, nil)
+	r.RegisterHook("leader-elected", func() error {
+		for i := 0; i < 3; i++ {
+			isLeader, err := hctxt.IsLeader()
+			c.Assert(err, gc.IsNil)
+			c.Assert(isLeader, jc.IsTrue)
+		}
+		return nil
+	})
+	_, err := hook.Main(r, ctxt, make(hooktest.MemState))
+	c.Assert(err, gc.IsNil)
+	c.Assert(isLeaderCount, gc.Equals, 1)
+}
+
+func (*leaderSuite) TestLeaderSettings(c *gc.C) {
+	var ctxt *hook.Context
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("leader-elected", func() error {
+				return ctxt.SetLeaderSettings("password", "secret", "old", "")
+			})
+			r.RegisterHook("leader-settings-changed", func() error {
+				val, err := ctxt.LeaderSetting("password")
+				c.Assert(err, gc.IsNil)
+				c.Assert(val, gc.Equals, "secret")
+				settings, err := ctxt.LeaderSettings()
+				c.Assert(err, gc.IsNil)
+				c.Assert(settings, jc.DeepEquals, map[string]string{
+					"password": "secret",
+				})
+				return nil
+			})
+		},
+		IsLeader: true,
+		LeaderSettings: map[string]string{
+			"old": "value",
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("leader-elected", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"leader-set", "--", "password=secret", "old="},
+	})
+	runner.IsLeader = false
+	err = runner.RunHook("leader-settings-changed", "", "")
+	c.Assert(err, gc.IsNil)
+
+	err = runner.RunHook("leader-elected", "", "")
+	c.Assert(err, gc.ErrorMatches, "leader-elected hook for root: cannot write leadership settings: not the leader")
+}
+
+func (*leaderSuite) TestSetAppRelation(c *gc.C) {
+	var ctxt *hook.Context
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("db-relation-joined", func() error {
+				c.Check(ctxt.RemoteApp, gc.Equals, "postgresql")
+				settings, err := ctxt.GetAppRelation(ctxt.RelationId)
+				c.Check(err, gc.IsNil)
+				c.Check(settings, jc.DeepEquals, map[string]string{
+					"database": "foo",
+				})
+				return ctxt.SetAppRelation(ctxt.RelationId, "user", "bob")
+			})
+		},
+		RelationIds: map[string][]hook.RelationId{
+			"db": {"db:0"},
+		},
+		AppRelations: map[hook.RelationId]map[string]string{
+			"db:0": {"database": "foo"},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("db-relation-joined", "db:0", "postgresql/0")
+	c.Assert(err, gc.ErrorMatches, "db-relation-joined hook for root: cannot set application settings on relation db:0: unit someunit/0 is not the leader")
+	c.Assert(runner.Record, gc.HasLen, 0)
+
+	runner.IsLeader = true
+	err = runner.RunHook("db-relation-joined", "db:0", "postgresql/0")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"relation-set", "-r", "db:0", "--app", "--", "user=bob"},
+	})
+}
+
+type sharedState struct {
+	Password string
+}
+
+func (*leaderSuite) TestLeaderState(c *gc.C) {
+	var state sharedState
+	var ctxt *hook.Context
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			state = sharedState{}
+			r = r.Clone("shared")
+			r.RegisterLeaderState(&state)
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("leader-elected", nop)
+			r.RegisterHook("leader-settings-changed", nop)
+			r.RegisterHook("*", func() error {
+				if isLeader, _ := ctxt.IsLeader(); isLeader && state.Password == "" {
+					state.Password = "secret"
+				}
+				if state.Password == "" {
+					state.Password = "follower"
+				}
+				return nil
+			})
+		},
+		Logger: c,
+	}
+
+	// A follower cannot change the state.
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, gc.HasLen, 0)
+	c.Assert(runner.LeaderSettings, gc.HasLen, 0)
+
+	// The leader saves changed state.
+	runner.IsLeader = true
+	err = runner.RunHook("leader-elected", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.LeaderSettings, jc.DeepEquals, map[string]string{
+		"root.shared": `{"Password":"secret"}`,
+	})
+
+	// Unchanged state is not saved again.
+	runner.Record = nil
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, gc.HasLen, 0)
+
+	// A follower sees the state set by the leader.
+	runner.IsLeader = false
+	err = runner.RunHook("leader-settings-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(state.Password, gc.Equals, "secret")
+}
+
+func (*leaderSuite) TestRegisterLeaderStateTwice(c *gc.C) {
+	r := hook.NewRegistry()
+	var state sharedState
+	r.RegisterLeaderState(&state)
+	c.Assert(func() {
+		r.RegisterLeaderState(&state)
+	}, gc.PanicMatches, "RegisterLeaderState called more than once")
+	c.Assert(func() {
+		r.Clone("x").RegisterLeaderState(state)
+	}, gc.PanicMatches, "leader state value is not pointer but type hook_test.sharedState")
+}
+
+func nop() error {
+	return nil
+}
+
+type runFunc func(cmd string, args ...string) ([]byte, error)
+
+func (f runFunc) Run(cmd string, args ...string) ([]byte, error) {
+	return f(cmd, args...)
+}
+
+func (f runFunc) Close() error {
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 
 	"gopkg.in/errgo.v1"
@@ -19,7 +20,20 @@ const (
 	envRelationName  = "JUJU_RELATION"
 	envRelationId    = "JUJU_RELATION_ID"
 	envRemoteUnit    = "JUJU_REMOTE_UNIT"
+	envRemoteApp     = "JUJU_REMOTE_APP"
 	envSocketPath    = "JUJU_AGENT_SOCKET"
+	envSocketAddress = "JUJU_AGENT_SOCKET_ADDRESS"
+	envSocketNetwork = "JUJU_AGENT_SOCKET_NETWORK"
+	envAgentToken    = "JUJU_AGENT_TOKEN"
+	envStorageId     = "JUJU_STORAGE_ID"
+	envActionName    = "JUJU_ACTION_NAME"
+	envActionId      = "JUJU_ACTION_UUID"
+	envDepartingUnit = "JUJU_DEPARTING_UNIT"
+	envWorkloadName  = "JUJU_WORKLOAD_NAME"
+	envSecretId      = "JUJU_SECRET_ID"
+	envSecretLabel   = "JUJU_SECRET_LABEL"
+	envSecretRev     = "JUJU_SECRET_REVISION"
+	envTargetSeries  = "JUJU_TARGET_SERIES"
 )
 
 var mustEnvVars = []string{
@@ -36,6 +50,11 @@ var relationEnvVars = []string{
 	// to be set for relation-broken hooks.
 }
 
+var actionEnvVars = []string{
+	envActionName,
+	envActionId,
+}
+
 // Main creates a new context from the environment and invokes the
 // appropriate command or hook functions from the given
 // registry or sub-registries of it.
@@ -50,7 +69,21 @@ var relationEnvVars = []string{
 //
 // This function is designed to be called by gocharm
 // generated code and tests only.
-func Main(r *Registry, ctxt *Context, state PersistentState) (_ Command, err error) {
+func Main(r *Registry, ctxt *Context, state PersistentState) (Command, error) {
+	return runMain(r, ctxt, state, false)
+}
+
+// MainDeferred is like Main except that it only runs deferred hook
+// functions (see Context.Defer) and not the functions registered for
+// ctxt.HookName.
+//
+// This function is designed to be called by tests only.
+func MainDeferred(r *Registry, ctxt *Context, state PersistentState) error {
+	_, err := runMain(r, ctxt, state, true)
+	return err
+}
+
+func runMain(r *Registry, ctxt *Context, state PersistentState, deferredOnly bool) (_ Command, err error) {
 	if ctxt.RunCommandName != "" {
 		log.Printf("running command %q %q", ctxt.RunCommandName, ctxt.RunCommandArgs)
 		cmd := r.commands[ctxt.RunCommandName]
@@ -59,22 +92,114 @@ func Main(r *Registry, ctxt *Context, state PersistentState) (_ Command, err err
 		}
 		return cmd(ctxt.RunCommandArgs)
 	}
+	if ctxt.cache == nil {
+		ctxt.cache = new(contextCache)
+	}
+	// Make sure that relation data fetched on demand
+	// is shared between all the registries' contexts.
+	if ctxt.Relations == nil {
+		ctxt.Relations = make(map[RelationId]map[UnitId]map[string]string)
+	}
+	if ctxt.AppRelations == nil {
+		ctxt.AppRelations = make(map[RelationId]map[string]string)
+	}
+	if ctxt.RelationIds == nil {
+		ctxt.RelationIds = make(map[string][]RelationId)
+	}
+	relationNames := make([]string, 0, len(r.relations))
+	for name := range r.relations {
+		relationNames = append(relationNames, name)
+	}
+	sort.Strings(relationNames)
+	ctxt.relationNames = relationNames
 	ctxt.Logf("running hook %s {", ctxt.HookName)
 	defer ctxt.Logf("} %s", ctxt.HookName)
+	if ctxt.HookName == string(hooks.CollectMetrics) && !deferredOnly {
+		if len(r.hooks[ctxt.HookName]) == 0 {
+			return nil, usageError(r)
+		}
+		return nil, errgo.Mask(runCollectMetrics(r, ctxt, state))
+	}
+	// Set up any state encryption before the state is loaded.
+	encryption, state, err := newStateEncryption(r, ctxt, state)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ctxt.cache.encryption = encryption
 	// Retrieve all persistent state.
-	// TODO read all of the state in one operation from a single file?
-	if err := loadState(r, state); err != nil {
+	stateData, err := loadState(r, state, encryption)
+	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	leaderSettings, err := loadLeaderState(r, ctxt)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	hstate, hstateData, err := loadHookState(state)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	config, err := loadConfig(r, ctxt)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := loadConfigStructs(r, config); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ctxt.cache.hookState = hstate
+	ctxt.cache.config = config
+	ctxt.cache.status = new(statusCollector)
 	// Notify everyone about the context.
-	for _, setter := range r.contexts {
-		if err := setter(ctxt); err != nil {
-			return nil, errgo.Notef(err, "cannot set context")
-		}
+	if err := setContexts(r, ctxt); err != nil {
+		return nil, errgo.Mask(err)
 	}
+	// cleanedUp records whether the state has been removed
+	// by RegisterStateCleanup, in which case it must not
+	// be saved again.
+	cleanedUp := false
+	// deferred holds the hook functions deferred
+	// by the current hook.
+	var deferred []DeferredEvent
 	defer func() {
-		// All the hooks have now run; save the state.
-		saveErr := saveState(r, state)
+		// All the hooks have now run; set the status
+		// and save the state.
+		if statusErr := flushStatus(r, ctxt); statusErr != nil {
+			if err == nil {
+				err = statusErr
+			} else {
+				ctxt.Logf("%v", statusErr)
+			}
+		}
+		// The values seen and the functions deferred by a
+		// failed hook are not recorded, so that it runs in
+		// the same way when it is retried.
+		if err == nil {
+			if ctxt.cache.changes != nil {
+				ctxt.cache.changes.commit(hstate)
+			}
+			forgetRelations(hstate, ctxt)
+			hstate.Deferred = addDeferred(hstate.Deferred, deferred)
+		}
+		var saveErr error
+		if !cleanedUp {
+			saveErr = encryption.prepareRetirement()
+		}
+		changes := make(map[string][]byte)
+		if saveErr == nil {
+			saveErr = saveState(r, stateData, changes, encryption)
+		}
+		if saveErr == nil {
+			saveErr = saveHookState(hstate, hstateData, changes)
+		}
+		if saveErr == nil && !cleanedUp {
+			saveErr = commitState(state, changes)
+			if saveErr == nil {
+				saveErr = encryption.retireKeys(ctxt)
+			}
+		}
+		if saveErr == nil {
+			saveErr = saveLeaderState(r, ctxt, leaderSettings)
+		}
 		if saveErr == nil {
 			return
 		}
@@ -85,50 +210,279 @@ func Main(r *Registry, ctxt *Context, state PersistentState) (_ Command, err err
 		ctxt.Logf("cannot save local state: %v", saveErr)
 	}()
 
+	// Actions are not hooks, so no hook functions
+	// run when an action is invoked.
+	if ctxt.ActionName != "" {
+		if err := runAction(r, ctxt); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return nil, nil
+	}
+
 	// The wildcard hook always runs after any other
 	// registered hooks.
 	hookFuncs := r.hooks[ctxt.HookName]
+	nfuncs := len(hookFuncs)
 
-	if len(hookFuncs) == 0 {
+	if nfuncs == 0 && !deferredOnly {
 		ctxt.Logf("hook %q not registered", ctxt.HookName)
 		return nil, usageError(r)
 	}
 	hookFuncs = append(hookFuncs, r.hooks["*"]...)
-	for _, f := range hookFuncs {
-		if err := f.run(); err != nil {
-			// TODO better error context here, perhaps
-			// including local state name, hook name, etc.
+	invalid, err := checkConfig(r, ctxt, config, hstate)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(invalid) > 0 && isTeardownHook(ctxt.HookName) {
+		// The unit is being torn down, so everything must run
+		// regardless of configuration; otherwise services could
+		// be left running after the unit has gone.
+		invalid = nil
+	}
+	// Deferred hook functions run before any functions
+	// for the current hook.
+	if err := runDeferred(r, ctxt, hstate, invalid); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if deferredOnly {
+		return nil, nil
+	}
+	for i, f := range hookFuncs {
+		if isInvalidRegistry(invalid, f.registryName) {
+			ctxt.Logf("not running %s hook for %s because of invalid configuration", ctxt.HookName, f.registryName)
+			continue
+		}
+		isDeferred, err := runHookFunc(r, ctxt, f)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		if isDeferred {
+			if i < nfuncs {
+				deferred = append(deferred, newDeferredEvent(ctxt, hookFuncs[:nfuncs], i, false))
+			} else {
+				deferred = append(deferred, newDeferredEvent(ctxt, hookFuncs[nfuncs:], i-nfuncs, true))
+			}
+		}
+	}
+	if err := runReconcilers(r, ctxt, invalid); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if ctxt.HookName == r.stateCleanupHook {
+		ctxt.Logf("removing all persistent state")
+		if err := cleanUpState(ctxt, state); err != nil {
 			return nil, errgo.Mask(err)
 		}
+		if err := encryption.removeKeyFile(ctxt); err != nil {
+			return nil, errgo.Mask(err)
+		}
+		cleanedUp = true
 	}
 	return nil, nil
 }
 
-func loadState(r *Registry, state PersistentState) error {
+// setContexts calls all the registered context setters with ctxt.
+func setContexts(r *Registry, ctxt *Context) error {
+	for _, setter := range r.contexts {
+		if err := setter(ctxt); err != nil {
+			return errgo.Notef(err, "cannot set context")
+		}
+	}
+	return nil
+}
+
+// loadState loads all registered state. It returns the data
+// that was loaded, keyed by registry name, so that saveState
+// can tell what has changed. When fields are encrypted, the
+// returned data holds the state with its fields decrypted.
+func loadState(r *Registry, state PersistentState, e *stateEncryption) (map[string][]byte, error) {
+	loaded := make(map[string][]byte)
 	for _, val := range r.state {
 		data, err := state.Load(val.registryName)
 		if err != nil {
-			return errgo.Notef(err, "cannot load state for %s", val.registryName)
+			return nil, errgo.Notef(err, "cannot load state for %s", val.registryName)
 		}
 		if data == nil {
 			continue
 		}
-		if err := json.Unmarshal(data, val.val); err != nil {
-			return errgo.Notef(err, "cannot unmarshal state for %s", val.registryName)
+		stale, err := val.unmarshal(data, e)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal state for %s", val.registryName)
+		}
+		if e != nil && stale {
+			e.stale[val.registryName] = true
+		}
+		if e.fieldCipher() != nil {
+			// The encrypted data is different every time, so
+			// compare against the plain data instead.
+			data, err = val.marshal(nil)
+			if err != nil {
+				return nil, errgo.Notef(err, "cannot marshal state for %s", val.registryName)
+			}
 		}
+		loaded[val.registryName] = data
 	}
-	return nil
+	return loaded, nil
 }
 
-func saveState(r *Registry, state PersistentState) (err error) {
+// saveState adds any registered state that has changed since
+// it was loaded from the given data to changes, along with
+// any state that needs encrypting again.
+func saveState(r *Registry, loaded map[string][]byte, changes map[string][]byte, e *stateEncryption) error {
 	for _, val := range r.state {
-		data, err := json.Marshal(val.val)
+		data, err := val.marshal(nil)
 		if err != nil {
 			return errgo.Notef(err, "cannot marshal state for %s", val.registryName)
 		}
-		if err := state.Save(val.registryName, data); err != nil {
-			return errgo.Notef(err, "cannot save state for %s", val.registryName)
+		if string(data) == string(loaded[val.registryName]) && !e.isStale(val.registryName) {
+			continue
+		}
+		if e.fieldCipher() != nil {
+			data, err = val.marshal(e)
+			if err != nil {
+				return errgo.Notef(err, "cannot marshal state for %s", val.registryName)
+			}
+		}
+		changes[val.registryName] = data
+	}
+	return nil
+}
+
+// commitState saves all the given state changes, atomically
+// if the state implements TransactionalState.
+func commitState(state PersistentState, changes map[string][]byte) error {
+	if len(changes) == 0 {
+		if state, ok := state.(pendingWriter); !ok || !state.hasPendingWrites() {
+			return nil
+		}
+	}
+	if state, ok := state.(TransactionalState); ok {
+		return errgo.Mask(state.SaveAll(changes))
+	}
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := state.Save(name, changes[name]); err != nil {
+			return errgo.Notef(err, "cannot save state for %s", name)
+		}
+	}
+	return nil
+}
+
+// hookStateName holds the name under which the hook package
+// saves its own persistent state. It cannot clash with
+// the name of any registry because those all start with "root".
+const hookStateName = "hook"
+
+// hookState holds persistent state used by the hook
+// package itself.
+type hookState struct {
+	// ConfigBlocked records whether the unit's status
+	// has been set to blocked because of invalid configuration.
+	ConfigBlocked bool `json:",omitempty"`
+
+	// Config holds the configuration values last seen
+	// by Context.ChangedConfig.
+	Config map[string]interface{} `json:",omitempty"`
+
+	// Relations holds the relation settings last seen
+	// by Context.ChangedRelation.
+	Relations map[RelationId]map[UnitId]map[string]string `json:",omitempty"`
+
+	// Deferred holds the hook functions that
+	// have been deferred, in order.
+	Deferred []DeferredEvent `json:",omitempty"`
+
+	// Status holds the unit status reports that
+	// are currently in effect. See Context.SetStatus.
+	Status []statusReport `json:",omitempty"`
+}
+
+// loadHookState loads the hook package's persistent state.
+// It also returns the data that was loaded, so that
+// saveHookState can avoid saving unchanged state.
+func loadHookState(state PersistentState) (*hookState, []byte, error) {
+	var st hookState
+	data, err := state.Load(hookStateName)
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "cannot load hook state")
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &st); err != nil {
+			return nil, nil, errgo.Notef(err, "cannot unmarshal hook state")
+		}
+	}
+	return &st, data, nil
+}
+
+// saveHookState adds the hook package's persistent state to changes
+// if it has changed since it was loaded from oldData.
+func saveHookState(st *hookState, oldData []byte, changes map[string][]byte) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal hook state")
+	}
+	if oldData == nil && string(data) == "{}" || string(data) == string(oldData) {
+		return nil
+	}
+	changes[hookStateName] = data
+	return nil
+}
+
+// loadLeaderState loads all registered leader state from the leader
+// settings. It returns the settings that it loaded from, so that
+// saveLeaderState can tell what has changed.
+func loadLeaderState(r *Registry, ctxt *Context) (map[string]string, error) {
+	if len(r.leaderState) == 0 {
+		return nil, nil
+	}
+	settings, err := ctxt.LeaderSettings()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get leader settings")
+	}
+	for _, val := range r.leaderState {
+		data, ok := settings[val.registryName]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), val.val); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal leader state for %s", val.registryName)
+		}
+	}
+	return settings, nil
+}
+
+// saveLeaderState saves any leader state that has changed since
+// it was loaded from the given settings. Changes are only saved if
+// the current unit is the leader.
+func saveLeaderState(r *Registry, ctxt *Context, settings map[string]string) error {
+	var keyvals []string
+	for _, val := range r.leaderState {
+		data, err := json.Marshal(val.val)
+		if err != nil {
+			return errgo.Notef(err, "cannot marshal leader state for %s", val.registryName)
+		}
+		if string(data) != settings[val.registryName] {
+			keyvals = append(keyvals, val.registryName, string(data))
+		}
+	}
+	if len(keyvals) == 0 {
+		return nil
+	}
+	isLeader, err := ctxt.IsLeader()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !isLeader {
+		for i := 0; i < len(keyvals); i += 2 {
+			ctxt.Logf("discarding changes to leader state for %s on non-leader unit", keyvals[i])
 		}
+		return nil
+	}
+	if err := ctxt.SetLeaderSettings(keyvals...); err != nil {
+		return errgo.Notef(err, "cannot save leader state")
 	}
 	return nil
 }
@@ -160,16 +514,18 @@ func RegisterMainHooks(r *Registry) {
 	// We always need install and start hooks.
 	r.RegisterHook("install", nop)
 	r.RegisterHook("start", nop)
-	// TODO Perhaps... ensure that we have a stop hook, and make
-	// it clean up our persistent state. But that may not be
-	// right if "stop" is considered something we can start
-	// from again.
+	// Cleaning up the persistent state is opt-in
+	// (see RegisterStateCleanup) because some charms
+	// may want to keep it; when it is enabled, the
+	// cleanup hook must be present for it to happen.
+	if r.stateCleanupHook != "" {
+		r.RegisterHook(r.stateCleanupHook, nop)
+	}
 }
 
 // NewContextFromEnvironment creates a hook context from the current
-// environment, using the given tool runner to acquire information to
-// populate the context, and the given registry to determine which
-// relations to fetch information for.
+// environment. Relation information is not fetched until it is
+// asked for; see Context.GetRelationIds and Context.PrefetchRelations.
 //
 // The hookName argument holds the name of the hook
 // to invoke, and args holds any additional arguments.
@@ -197,55 +553,64 @@ func NewContextFromEnvironment(r *Registry, stateDir string, hookName string, ar
 	vars := mustEnvVars
 	if os.Getenv(envRelationName) != "" {
 		vars = append(vars, relationEnvVars...)
-		if !strings.HasSuffix(hookName, "-"+string(hooks.RelationBroken)) {
+		// When only the remote application's settings have
+		// changed, there is no remote unit.
+		if !strings.HasSuffix(hookName, "-"+string(hooks.RelationBroken)) && os.Getenv(envRemoteApp) == "" {
 			vars = append(vars, envRemoteUnit)
 		}
 	}
+	if storageHookPattern.MatchString(hookName) {
+		vars = append(vars, envStorageId)
+	}
+	if workloadHookPattern.MatchString(hookName) {
+		vars = append(vars, envWorkloadName)
+	}
+	switch hooks.Kind(hookName) {
+	case hooks.Action:
+		vars = append(vars, actionEnvVars...)
+	case secretChanged, secretRotate:
+		vars = append(vars, envSecretId)
+	case secretExpired, secretRemove:
+		vars = append(vars, envSecretId, envSecretRev)
+	}
 	for _, v := range vars {
 		if os.Getenv(v) == "" {
 			return nil, nil, errgo.Newf("required environment variable %q not set", v)
 		}
 	}
+	secretRevision := 0
+	if rev := os.Getenv(envSecretRev); rev != "" {
+		n, err := strconv.Atoi(rev)
+		if err != nil {
+			return nil, nil, errgo.Newf("invalid secret revision %q", rev)
+		}
+		secretRevision = n
+	}
 	runner, err := newToolRunnerFromEnvironment()
 	if err != nil {
 		return nil, nil, errgo.Notef(err, "cannot make runner")
 	}
 	ctxt := &Context{
-		UUID:         os.Getenv(envUUID),
-		Unit:         UnitId(os.Getenv(envUnitName)),
-		CharmDir:     os.Getenv(envCharmDir),
-		RelationName: os.Getenv(envRelationName),
-		RelationId:   RelationId(os.Getenv(envRelationId)),
-		RemoteUnit:   UnitId(os.Getenv(envRemoteUnit)),
-		HookName:     hookName,
-		Runner:       runner,
-		HookStateDir: stateDir,
-	}
-
-	// Populate the relation fields of the ContextInfo
-	ctxt.RelationIds = make(map[string][]RelationId)
-	ctxt.Relations = make(map[RelationId]map[UnitId]map[string]string)
-	for name := range r.RegisteredRelations() {
-		ids, err := ctxt.relationIds(name)
-		if err != nil {
-			return nil, nil, errgo.Notef(err, "cannot get relation ids for relation %q", name)
-		}
-		ctxt.RelationIds[name] = ids
-		for _, id := range ids {
-			units := make(map[UnitId]map[string]string)
-			unitIds, err := ctxt.relationUnits(id)
-			if err != nil {
-				return nil, nil, errgo.Notef(err, "cannot get unit ids for relation id %q", id)
-			}
-			for _, unitId := range unitIds {
-				settings, err := ctxt.getAllRelationUnit(id, unitId)
-				if err != nil {
-					return nil, nil, errgo.Notef(err, "cannot get settings for relation %s, unit %s", id, unitId)
-				}
-				units[unitId] = settings
-			}
-			ctxt.Relations[id] = units
-		}
+		UUID:           os.Getenv(envUUID),
+		Unit:           UnitId(os.Getenv(envUnitName)),
+		CharmDir:       os.Getenv(envCharmDir),
+		RelationName:   os.Getenv(envRelationName),
+		RelationId:     RelationId(os.Getenv(envRelationId)),
+		RemoteUnit:     UnitId(os.Getenv(envRemoteUnit)),
+		RemoteApp:      os.Getenv(envRemoteApp),
+		DepartingUnit:  UnitId(os.Getenv(envDepartingUnit)),
+		StorageId:      os.Getenv(envStorageId),
+		WorkloadName:   os.Getenv(envWorkloadName),
+		SecretId:       os.Getenv(envSecretId),
+		SecretLabel:    os.Getenv(envSecretLabel),
+		SecretRevision: secretRevision,
+		TargetSeries:   os.Getenv(envTargetSeries),
+		ActionName:     os.Getenv(envActionName),
+		ActionId:       os.Getenv(envActionId),
+		HookName:       hookName,
+		Runner:         runner,
+		HookStateDir:   stateDir,
 	}
+
 	return ctxt, NewDiskState(ctxt.StateDir()), nil
 }
@@ -0,0 +1,152 @@
+package hook
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"github.com/juju/charm/v9/hooks"
+	"gopkg.in/errgo.v1"
+)
+
+// registeredMetric holds a metric registered with RegisterMetric.
+type registeredMetric struct {
+	metric  charm.Metric
+	collect func() (float64, error)
+}
+
+// metricNamePattern matches valid metric names.
+var metricNamePattern = regexp.MustCompile("^[a-z](?:[a-z0-9-]*[a-z0-9])?$")
+
+// RegisterMetric registers a metric to be included in the charm's
+// metrics.yaml. The type should be either charm.MetricTypeGauge
+// or charm.MetricTypeAbsolute.
+//
+// When the collect-metrics hook runs, the collector function will be
+// called to obtain the current value of the metric. All the values
+// are then sent to Juju with add-metric. If a collector returns an
+// error, the error is logged and the metric is omitted.
+//
+// Juju allows only add-metric and juju-log to be used in the
+// collect-metrics hook, so the collectors are the only functions that
+// run in it: hook functions registered with RegisterHook (including
+// "*" functions), deferred functions and reconcilers do not run, and
+// no state is saved. The registered context setters are called as
+// usual, but the local state is loaded only when that can be done
+// without hook tools (it is not loaded from the controller or with a
+// key held in a secret), configuration structs hold their default
+// values and leader state is not loaded.
+//
+// For example, a charm running a service with the service package
+// might collect a metric from the running service like this:
+//
+//	r.RegisterMetric("requests", charm.MetricTypeAbsolute, "Number of requests served", func() (float64, error) {
+//		var n int
+//		err := svc.Call("Server.RequestCount", struct{}{}, &n)
+//		return float64(n), err
+//	})
+//
+// RegisterMetric will panic if the metric name is invalid or
+// has already been registered, or if the type is not known.
+func (r *Registry) RegisterMetric(name string, typ charm.MetricType, description string, collector func() (float64, error)) {
+	if !metricNamePattern.MatchString(name) || strings.HasPrefix(name, "juju-") {
+		panic(errgo.Newf("invalid metric name %q", name))
+	}
+	if _, ok := r.metrics[name]; ok {
+		panic(errgo.Newf("metric %q registered twice", name))
+	}
+	switch typ {
+	case charm.MetricTypeGauge, charm.MetricTypeAbsolute:
+	default:
+		panic(errgo.Newf("metric %q has unknown type %q", name, typ))
+	}
+	if collector == nil {
+		panic(errgo.Newf("no collector given for metric %q", name))
+	}
+	r.metrics[name] = &registeredMetric{
+		metric: charm.Metric{
+			Type:        typ,
+			Description: description,
+		},
+		collect: collector,
+	}
+	// Make sure that the hook is generated.
+	r.RegisterHook(string(hooks.CollectMetrics), nop)
+}
+
+// RegisteredMetrics returns the metrics that have
+// been registered with RegisterMetric, keyed by name.
+func (r *Registry) RegisteredMetrics() map[string]charm.Metric {
+	metrics := make(map[string]charm.Metric)
+	for name, m := range r.metrics {
+		metrics[name] = m.metric
+	}
+	return metrics
+}
+
+// runCollectMetrics runs the collect-metrics hook
+// as described in RegisterMetric.
+func runCollectMetrics(r *Registry, ctxt *Context, state PersistentState) error {
+	if localStateNeedsTools(r, state) {
+		ctxt.Logf("local state is not available in the collect-metrics hook")
+	} else {
+		encryption, state, err := newStateEncryption(r, ctxt, state)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if _, err := loadState(r, state, encryption); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := loadConfigStructs(r, nil); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := setContexts(r, ctxt); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(collectMetrics(r, ctxt))
+}
+
+// localStateNeedsTools reports whether loading the local
+// state registered with r from the given state requires
+// hook tools.
+func localStateNeedsTools(r *Registry, state PersistentState) bool {
+	if _, ok := state.(*controllerState); ok {
+		return true
+	}
+	if r.stateKeys != nil {
+		if _, ok := r.stateKeys.(*keyFile); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collectMetrics calls all the registered metric collectors
+// and adds the resulting values with add-metric.
+func collectMetrics(r *Registry, ctxt *Context) error {
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, name := range names {
+		val, err := r.metrics[name].collect()
+		if err != nil {
+			ctxt.Logf("cannot collect metric %s: %v", name, err)
+			continue
+		}
+		args = append(args, fmt.Sprintf("%s=%s", name, strconv.FormatFloat(val, 'f', -1, 64)))
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	if _, err := ctxt.Runner.Run("add-metric", args...); err != nil {
+		return errgo.Notef(err, "cannot add metrics")
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package hook_test
+
+import (
+	"errors"
+
+	"github.com/juju/charm/v9"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type metricsSuite struct{}
+
+var _ = gc.Suite(&metricsSuite{})
+
+func (*metricsSuite) TestRegisterMetric(c *gc.C) {
+	r := hook.NewRegistry()
+	collect := func() (float64, error) {
+		return 0, nil
+	}
+	r.RegisterMetric("requests", charm.MetricTypeAbsolute, "Requests served", collect)
+	c.Assert(r.RegisteredMetrics(), jc.DeepEquals, map[string]charm.Metric{
+		"requests": {
+			Type:        charm.MetricTypeAbsolute,
+			Description: "Requests served",
+		},
+	})
+	c.Assert(r.RegisteredHooks(), jc.DeepEquals, []string{"collect-metrics"})
+
+	c.Assert(func() {
+		r.RegisterMetric("requests", charm.MetricTypeGauge, "", collect)
+	}, gc.PanicMatches, `metric "requests" registered twice`)
+	c.Assert(func() {
+		r.RegisterMetric("juju-units", charm.MetricTypeGauge, "", collect)
+	}, gc.PanicMatches, `invalid metric name "juju-units"`)
+	c.Assert(func() {
+		r.RegisterMetric("Bad", charm.MetricTypeGauge, "", collect)
+	}, gc.PanicMatches, `invalid metric name "Bad"`)
+	c.Assert(func() {
+		r.RegisterMetric("load", "counter", "", collect)
+	}, gc.PanicMatches, `metric "load" has unknown type "counter"`)
+	c.Assert(func() {
+		r.RegisterMetric("load", charm.MetricTypeGauge, "", nil)
+	}, gc.PanicMatches, `no collector given for metric "load"`)
+}
+
+func (*metricsSuite) TestCollectMetrics(c *gc.C) {
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterMetric("requests", charm.MetricTypeAbsolute, "", func() (float64, error) {
+				return 42, nil
+			})
+			r.RegisterMetric("load", charm.MetricTypeGauge, "", func() (float64, error) {
+				return 0.25, nil
+			})
+			r.Clone("broken").RegisterMetric("broken", charm.MetricTypeGauge, "", func() (float64, error) {
+				return 0, errors.New("no value")
+			})
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("collect-metrics", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"add-metric", "load=0.25", "requests=42"},
+	})
+
+	// Metrics are not collected in other hooks.
+	runner.Record = nil
+	err = runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, gc.HasLen, 0)
+}
+
+func (*metricsSuite) TestCollectMetricsUsesOnlyMetricTools(c *gc.C) {
+	var loaded []int
+	registerHooks := func(r *hook.Registry) {
+		var st struct {
+			Requests int
+		}
+		var leader struct {
+			Password string
+		}
+		var config struct {
+			Port int `config:"port" default:"80" description:"Port"`
+		}
+		var ctxt *hook.Context
+		r.RegisterContext(func(hctxt *hook.Context) error {
+			ctxt = hctxt
+			return nil
+		}, &st)
+		r.RegisterLeaderState(&leader)
+		r.RegisterConfigStruct(&config)
+		r.RegisterConfigValidator("port", hook.IntRange(1, 65535))
+		r.RegisterHook("install", func() error {
+			st.Requests = 42
+			return nil
+		})
+		r.RegisterHook("*", func() error {
+			_, err := ctxt.GetRelationIds("db")
+			return err
+		})
+		r.RegisterMetric("requests", charm.MetricTypeAbsolute, "", func() (float64, error) {
+			loaded = append(loaded, st.Requests)
+			return float64(st.Requests), nil
+		})
+	}
+	runner := &hooktest.Runner{
+		HookStateDir:  c.MkDir(),
+		RegisterHooks: registerHooks,
+		Logger:        c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	runner.Record = nil
+	err = runner.RunHook("collect-metrics", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"add-metric", "requests=42"},
+	})
+
+	// When the local state cannot be loaded without
+	// hook tools, the metrics are collected without it.
+	runner = &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			registerHooks(r)
+			r.RegisterStateEncryption(hook.SecretKey("state-key"))
+		},
+		Logger: c,
+	}
+	runner.State = hook.NewControllerState(&hook.Context{Runner: runner}, hooktest.MemState{}, 0)
+	err = runner.RunHook("collect-metrics", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"add-metric", "requests=0"},
+	})
+	c.Assert(loaded, jc.DeepEquals, []int{42, 0})
+}
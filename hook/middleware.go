@@ -0,0 +1,95 @@
+package hook
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// HookFunc is the type of a function registered with RegisterHook.
+type HookFunc func() error
+
+// HookInfo holds information about a hook function
+// that is passed to middleware registered with Use.
+type HookInfo struct {
+	// HookName holds the name of the hook that is running.
+	// For a function registered with the wildcard name "*", this
+	// is the name of the actual hook. For an action, it holds the
+	// name of the action.
+	HookName string
+
+	// RegistryName holds the name of the registry that the
+	// function was registered with, for example "root.service".
+	RegistryName string
+
+	// Context holds the context for the running hook.
+	Context *Context
+}
+
+// Use registers middleware that will wrap every hook function when it
+// is run. The middleware is called with the hook function and
+// information about it, and returns the function to be run in its
+// place, which will usually call next.
+//
+// Middleware applies to all hook functions, regardless of which
+// registry they were registered with, and to actions. Middleware
+// registered earlier wraps middleware registered later. A new registry
+// already uses AnnotateErrors and RecoverPanics, in that order, so
+// panics in later middleware are recovered too.
+func (r *Registry) Use(m func(next HookFunc, info HookInfo) HookFunc) {
+	if m == nil {
+		panic(errgo.New("nil middleware passed to Use"))
+	}
+	r.middleware = append(r.middleware, m)
+}
+
+// wrapHookFunc returns f wrapped in all the registered middleware.
+func wrapHookFunc(r *Registry, f HookFunc, info HookInfo) HookFunc {
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		f = r.middleware[i](f, info)
+	}
+	return f
+}
+
+// RecoverPanics is middleware that recovers from a panic in a hook
+// function, logs the panic with its stack trace and returns
+// it as an error.
+func RecoverPanics(next HookFunc, info HookInfo) HookFunc {
+	return func() (err error) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			info.Context.Logf("panic in %s hook for %s: %v\n%s", info.HookName, info.RegistryName, p, debug.Stack())
+			err = errgo.Newf("panic: %v", p)
+		}()
+		return next()
+	}
+}
+
+// AnnotateErrors is middleware that annotates any error returned by a
+// hook function with the name of the hook and of the registry that
+// the function was registered with. The error's cause is preserved.
+func AnnotateErrors(next HookFunc, info HookInfo) HookFunc {
+	return func() error {
+		err := next()
+		if err == nil {
+			return nil
+		}
+		return errgo.NoteMask(err, fmt.Sprintf("%s hook for %s", info.HookName, info.RegistryName), errgo.Any)
+	}
+}
+
+// TimeHooks is middleware that logs the time taken
+// by each hook function.
+func TimeHooks(next HookFunc, info HookInfo) HookFunc {
+	return func() error {
+		start := time.Now()
+		err := next()
+		info.Context.Logf("%s hook for %s took %v", info.HookName, info.RegistryName, time.Since(start))
+		return err
+	}
+}
@@ -0,0 +1,121 @@
+package hook_test
+
+import (
+	"fmt"
+	"strings"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type middlewareSuite struct{}
+
+var _ = gc.Suite(&middlewareSuite{})
+
+// recordingLogger records all log messages.
+type recordingLogger struct {
+	c    *gc.C
+	logs []string
+}
+
+func (l *recordingLogger) Logf(f string, a ...interface{}) {
+	l.logs = append(l.logs, fmt.Sprintf(f, a...))
+	l.c.Logf(f, a...)
+}
+
+func (*middlewareSuite) TestRecoverPanics(c *gc.C) {
+	logger := &recordingLogger{c: c}
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.Clone("sub").RegisterHook("install", func() error {
+				panic("oops")
+			})
+		},
+		Logger: logger,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.ErrorMatches, `install hook for root.sub: panic: oops`)
+	found := false
+	for _, msg := range logger.logs {
+		if strings.HasPrefix(msg, "panic in install hook for root.sub: oops\n") {
+			c.Assert(strings.Contains(msg, "middleware_test.go"), gc.Equals, true)
+			found = true
+		}
+	}
+	c.Assert(found, gc.Equals, true)
+}
+
+func (*middlewareSuite) TestAnnotateErrorsPreservesCause(c *gc.C) {
+	errFailed := errgo.New("failed")
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.Clone("a").Clone("b").RegisterHook("start", func() error {
+				return errgo.WithCausef(nil, errFailed, "cannot start")
+			})
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("start", "", "")
+	c.Assert(err, gc.ErrorMatches, `start hook for root.a.b: cannot start`)
+	c.Assert(errgo.Cause(err), gc.Equals, errFailed)
+}
+
+func (*middlewareSuite) TestUse(c *gc.C) {
+	var calls []string
+	trace := func(name string) func(hook.HookFunc, hook.HookInfo) hook.HookFunc {
+		return func(next hook.HookFunc, info hook.HookInfo) hook.HookFunc {
+			return func() error {
+				calls = append(calls, fmt.Sprintf("%s %s %s", name, info.HookName, info.RegistryName))
+				return next()
+			}
+		}
+	}
+	logger := &recordingLogger{c: c}
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.Use(trace("outer"))
+			r.Use(trace("inner"))
+			r.Use(hook.TimeHooks)
+			r.RegisterHook("install", func() error {
+				calls = append(calls, "install")
+				return nil
+			})
+			r.Clone("sub").RegisterHook("*", func() error {
+				calls = append(calls, "*")
+				return nil
+			})
+		},
+		Logger: logger,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(calls, jc.DeepEquals, []string{
+		"outer install root",
+		"inner install root",
+		"install",
+		// RegisterMainHooks registers its own install hook.
+		"outer install root",
+		"inner install root",
+		"outer install root.sub",
+		"inner install root.sub",
+		"*",
+	})
+	timed := 0
+	for _, msg := range logger.logs {
+		if strings.HasPrefix(msg, "install hook for root") && strings.Contains(msg, " took ") {
+			timed++
+		}
+	}
+	c.Assert(timed, gc.Equals, 3)
+
+	c.Assert(func() {
+		hook.NewRegistry().Use(nil)
+	}, gc.PanicMatches, `nil middleware passed to Use`)
+}
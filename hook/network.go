@@ -0,0 +1,91 @@
+package hook
+
+import (
+	"fmt"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// RegisterExtraBinding registers an extra binding to be included in
+// the charm's metadata.yaml. Extra bindings allow an operator to bind
+// the charm to a network space without a relation; see
+// Context.NetworkInfo for how to find the addresses for a binding.
+// It is OK to register the same binding more than once.
+func (r *Registry) RegisterExtraBinding(name string) {
+	if name == "" {
+		panic(fmt.Errorf("empty extra binding name"))
+	}
+	if _, ok := r.relations[name]; ok {
+		panic(errgo.Newf("extra binding %q has the same name as a relation", name))
+	}
+	r.extraBindings[name] = charm.ExtraBinding{
+		Name: name,
+	}
+}
+
+// RegisteredExtraBindings returns the extra bindings that
+// have been registered with RegisterExtraBinding, keyed by name.
+func (r *Registry) RegisteredExtraBindings() map[string]charm.ExtraBinding {
+	return r.extraBindings
+}
+
+// NetworkInfo holds the network configuration for a binding,
+// as returned by the network-get hook tool.
+type NetworkInfo struct {
+	// BindAddresses holds the addresses of the network
+	// interfaces on the unit's machine that the binding
+	// is bound to.
+	BindAddresses []BindAddress `json:"bind-addresses"`
+
+	// EgressSubnets holds the subnets, in CIDR notation,
+	// that outgoing traffic on the binding will originate from.
+	EgressSubnets []string `json:"egress-subnets"`
+
+	// IngressAddresses holds the addresses that other
+	// units should use to connect to the unit on the binding,
+	// most preferred first.
+	IngressAddresses []string `json:"ingress-addresses"`
+}
+
+// BindAddress holds the addresses of a network interface.
+type BindAddress struct {
+	MACAddress    string             `json:"mac-address"`
+	InterfaceName string             `json:"interface-name"`
+	Addresses     []InterfaceAddress `json:"addresses"`
+}
+
+// InterfaceAddress holds an address of a network interface.
+type InterfaceAddress struct {
+	Hostname string `json:"hostname"`
+	Address  string `json:"address"`
+	CIDR     string `json:"cidr"`
+}
+
+// NetworkInfo returns the network configuration for the given binding,
+// which may be the name of a relation or of an extra binding registered
+// with RegisterExtraBinding.
+func (ctxt *Context) NetworkInfo(binding string) (*NetworkInfo, error) {
+	var info NetworkInfo
+	if err := ctxt.RunJSON(&info, "network-get", "--format", "json", "--", binding); err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot get network information for binding %q", binding), errgo.Is(ErrUnimplemented))
+	}
+	return &info, nil
+}
+
+// IngressAddress returns the address that other units should use to
+// connect to the local unit over the given binding. If the network-get
+// hook tool is not available, it falls back to PrivateAddress.
+func (ctxt *Context) IngressAddress(binding string) (string, error) {
+	info, err := ctxt.NetworkInfo(binding)
+	if errgo.Cause(err) == ErrUnimplemented {
+		return ctxt.PrivateAddress()
+	}
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if len(info.IngressAddresses) == 0 {
+		return "", errgo.Newf("no ingress address found for binding %q", binding)
+	}
+	return info.IngressAddresses[0], nil
+}
@@ -0,0 +1,102 @@
+package hook_test
+
+import (
+	"github.com/juju/charm/v9"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type networkSuite struct{}
+
+var _ = gc.Suite(&networkSuite{})
+
+func (*networkSuite) TestRegisterExtraBinding(c *gc.C) {
+	r := hook.NewRegistry()
+	r.RegisterExtraBinding("cluster")
+	r.RegisterExtraBinding("cluster")
+	c.Assert(r.RegisteredExtraBindings(), jc.DeepEquals, map[string]charm.ExtraBinding{
+		"cluster": {Name: "cluster"},
+	})
+	r.RegisterRelation(charm.Relation{
+		Name:      "website",
+		Interface: "http",
+		Role:      charm.RoleProvider,
+	})
+	c.Assert(func() {
+		r.RegisterExtraBinding("website")
+	}, gc.PanicMatches, `extra binding "website" has the same name as a relation`)
+	c.Assert(func() {
+		r.RegisterRelation(charm.Relation{
+			Name:      "cluster",
+			Interface: "cluster",
+			Role:      charm.RolePeer,
+		})
+	}, gc.PanicMatches, `relation "cluster" has the same name as an extra binding`)
+}
+
+func (*networkSuite) TestNetworkInfo(c *gc.C) {
+	var ctxt *hook.Context
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterExtraBinding("cluster")
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("install", nop)
+		},
+		PrivateAddress: "10.0.0.1",
+		Networks: map[string]*hook.NetworkInfo{
+			"cluster": {
+				BindAddresses: []hook.BindAddress{{
+					InterfaceName: "eth1",
+					Addresses: []hook.InterfaceAddress{{
+						Address: "192.168.0.1",
+						CIDR:    "192.168.0.0/24",
+					}},
+				}},
+				IngressAddresses: []string{"192.168.0.1"},
+				EgressSubnets:    []string{"192.168.0.1/32"},
+			},
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+
+	info, err := ctxt.NetworkInfo("cluster")
+	c.Assert(err, gc.IsNil)
+	c.Assert(info, jc.DeepEquals, runner.Networks["cluster"])
+
+	addr, err := ctxt.IngressAddress("cluster")
+	c.Assert(err, gc.IsNil)
+	c.Assert(addr, gc.Equals, "192.168.0.1")
+
+	// Bindings with no explicit network information
+	// default to the private address.
+	addr, err = ctxt.IngressAddress("other")
+	c.Assert(err, gc.IsNil)
+	c.Assert(addr, gc.Equals, "10.0.0.1")
+}
+
+func (*networkSuite) TestIngressAddressFallback(c *gc.C) {
+	ctxt := &hook.Context{
+		Runner: runFunc(func(cmd string, args ...string) ([]byte, error) {
+			switch cmd {
+			case "network-get":
+				return nil, errgo.WithCausef(nil, hook.ErrUnimplemented, "no network-get")
+			case "unit-get":
+				return []byte("10.0.0.2"), nil
+			}
+			return nil, errgo.Newf("unexpected command %q", cmd)
+		}),
+	}
+	addr, err := ctxt.IngressAddress("website")
+	c.Assert(err, gc.IsNil)
+	c.Assert(addr, gc.Equals, "10.0.0.2")
+}
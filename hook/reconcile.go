@@ -0,0 +1,199 @@
+package hook
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// registeredReconciler holds a reconciler registered
+// with RegisterReconciler.
+type registeredReconciler struct {
+	name         string
+	registryName string
+	after        []string
+	reconcile    func(*Context) (Status, error)
+}
+
+// RegisterReconciler registers a function that reconciles the state of
+// the unit with its desired state, for example by pushing configuration
+// to a running service and publishing relation settings. This replaces
+// the common pattern of a wildcard ("*") hook function that compares
+// desired and committed state.
+//
+// All reconcilers run once after all the hook functions for the current
+// hook (including wildcard functions) have run. A reconciler runs after
+// any reconcilers named in after; apart from that, reconcilers run in
+// order of registration.
+//
+// The reconciler returns the resulting status of the unit as far as it
+// is concerned. If it returns an error, it has not been able to
+// reconcile the state: the error is logged and used as the status
+// message (with StatusMaintenance if no status was returned), and
+// because reconcilers run in every hook, it will be retried by the
+// next hook. A reconciler is not run if any of the reconcilers it runs
+// after did not return StatusActive; its status is StatusWaiting
+// instead.
+//
+// The status returned by each reconciler is combined with the statuses
+// reported by the rest of the charm, each message being prefixed with
+// the reconciler's name, and the unit's status is set when all
+// reconcilers have run. See Context.SetStatus.
+//
+// Reconcilers do not run for actions or the collect-metrics
+// hook, or when the registry they were registered with has
+// invalid configuration (see RegisterConfigValidator).
+//
+// RegisterReconciler will panic if a reconciler with the same name
+// has already been registered.
+func (r *Registry) RegisterReconciler(name string, f func(*Context) (Status, error), after ...string) {
+	if name == "" {
+		panic(errgo.New("empty reconciler name"))
+	}
+	if r.reconciler(name) != nil {
+		panic(errgo.Newf("reconciler %q registered twice", name))
+	}
+	r.reconcilers = append(r.reconcilers, &registeredReconciler{
+		name:         name,
+		registryName: r.name,
+		after:        after,
+		reconcile:    f,
+	})
+}
+
+// reconciler returns the registered reconciler
+// with the given name, or nil if there is none.
+func (r *Registry) reconciler(name string) *registeredReconciler {
+	for _, rec := range r.reconcilers {
+		if rec.name == name {
+			return rec
+		}
+	}
+	return nil
+}
+
+// runReconcilers runs all the registered reconcilers except those
+// in invalid registries, and reports their statuses. See
+// Context.SetStatus.
+func runReconcilers(r *Registry, ctxt *Context, invalid map[string]bool) error {
+	if len(r.reconcilers) == 0 {
+		return nil
+	}
+	order, err := reconcilerOrder(r.reconcilers)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	statuses := make(map[string]Status)
+	for _, rec := range order {
+		if isInvalidRegistry(invalid, rec.registryName) {
+			ctxt.Logf("not running reconciler %s because of invalid configuration", rec.name)
+			continue
+		}
+		report := statusReport{
+			Source: "reconciler:" + rec.name,
+			Label:  rec.name,
+		}
+		var waitingFor []string
+		for _, dep := range rec.after {
+			if statuses[dep] != StatusActive {
+				waitingFor = append(waitingFor, dep)
+			}
+		}
+		if len(waitingFor) > 0 {
+			report.Status = StatusWaiting
+			report.Message = "waiting for " + strings.Join(waitingFor, ", ")
+		} else {
+			report.Status, report.Message = runReconciler(r, ctxt, rec)
+		}
+		statuses[rec.name] = report.Status
+		ctxt.reportStatus(report)
+	}
+	return nil
+}
+
+// runReconciler runs a single reconciler, wrapped in
+// the registered middleware, and returns its status
+// and status message.
+func runReconciler(r *Registry, ctxt *Context, rec *registeredReconciler) (Status, string) {
+	rctxt := ctxt.withRegistryName(rec.registryName)
+	var st Status
+	// recErr holds the error returned by the reconciler
+	// itself, without any annotation added by the middleware,
+	// so that it can be used as the status message.
+	var recErr error
+	run := wrapHookFunc(r, func() error {
+		st, recErr = rec.reconcile(rctxt)
+		return recErr
+	}, HookInfo{
+		HookName:     ctxt.HookName,
+		RegistryName: rec.registryName,
+		Context:      rctxt,
+	})
+	if err := run(); err != nil {
+		ctxt.Logf("reconciler %s failed (will retry in next hook): %v", rec.name, err)
+		if st == "" || st == StatusActive {
+			st = StatusMaintenance
+		}
+		if recErr == nil {
+			// The error came from the middleware, for
+			// example a recovered panic.
+			recErr = err
+		}
+		return st, recErr.Error()
+	}
+	if st == "" {
+		st = StatusActive
+	}
+	if _, ok := statusSeverity[st]; !ok {
+		ctxt.Logf("reconciler %s returned unknown status %q", rec.name, st)
+		return StatusMaintenance, fmt.Sprintf("unknown status %q", st)
+	}
+	return st, ""
+}
+
+// reconcilerOrder returns the reconcilers sorted so that each
+// reconciler comes after all the reconcilers it runs after,
+// otherwise preserving registration order.
+func reconcilerOrder(recs []*registeredReconciler) ([]*registeredReconciler, error) {
+	known := make(map[string]bool)
+	for _, rec := range recs {
+		known[rec.name] = true
+	}
+	for _, rec := range recs {
+		for _, dep := range rec.after {
+			if !known[dep] {
+				return nil, errgo.Newf("reconciler %q runs after unknown reconciler %q", rec.name, dep)
+			}
+		}
+	}
+	done := make(map[string]bool)
+	order := make([]*registeredReconciler, 0, len(recs))
+	for len(order) < len(recs) {
+		progress := false
+	loop:
+		for _, rec := range recs {
+			if done[rec.name] {
+				continue
+			}
+			for _, dep := range rec.after {
+				if !done[dep] {
+					continue loop
+				}
+			}
+			done[rec.name] = true
+			order = append(order, rec)
+			progress = true
+		}
+		if !progress {
+			var cycle []string
+			for _, rec := range recs {
+				if !done[rec.name] {
+					cycle = append(cycle, rec.name)
+				}
+			}
+			return nil, errgo.Newf("dependency cycle between reconcilers %s", strings.Join(cycle, ", "))
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,93 @@
+package hook_test
+
+import (
+	"errors"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type reconcileSuite struct{}
+
+var _ = gc.Suite(&reconcileSuite{})
+
+func (*reconcileSuite) TestReconcilers(c *gc.C) {
+	var calls []string
+	dbReady := false
+	reconciler := func(name string, f func() (hook.Status, error)) func(*hook.Context) (hook.Status, error) {
+		return func(ctxt *hook.Context) (hook.Status, error) {
+			calls = append(calls, name)
+			return f()
+		}
+	}
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterHook("*", func() error {
+				calls = append(calls, "*")
+				return nil
+			})
+			r.RegisterReconciler("server", reconciler("server", func() (hook.Status, error) {
+				return hook.StatusActive, nil
+			}), "config", "db")
+			r.Clone("db").RegisterReconciler("db", reconciler("db", func() (hook.Status, error) {
+				if !dbReady {
+					return hook.StatusWaiting, errors.New("no credentials")
+				}
+				return hook.StatusActive, nil
+			}))
+			r.RegisterReconciler("config", reconciler("config", func() (hook.Status, error) {
+				return hook.StatusActive, nil
+			}))
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(calls, jc.DeepEquals, []string{"*", "db", "config"})
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-set", "waiting", "db: no credentials; server: waiting for db"},
+	})
+
+	// The failed reconciler is retried in the next hook.
+	dbReady = true
+	calls = nil
+	runner.Record = nil
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(calls, jc.DeepEquals, []string{"*", "db", "config", "server"})
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-set", "active", ""},
+	})
+}
+
+func (*reconcileSuite) TestReconcilerErrors(c *gc.C) {
+	nop := func(*hook.Context) (hook.Status, error) {
+		return hook.StatusActive, nil
+	}
+	r := hook.NewRegistry()
+	r.RegisterReconciler("a", nop)
+	c.Assert(func() {
+		r.Clone("x").RegisterReconciler("a", nop)
+	}, gc.PanicMatches, `reconciler "a" registered twice`)
+
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterReconciler("a", nop, "b")
+			r.RegisterReconciler("b", nop, "a")
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.ErrorMatches, `dependency cycle between reconcilers a, b`)
+
+	runner.RegisterHooks = func(r *hook.Registry) {
+		r.RegisterReconciler("a", nop, "unknown")
+	}
+	err = runner.RunHook("install", "", "")
+	c.Assert(err, gc.ErrorMatches, `reconciler "a" runs after unknown reconciler "unknown"`)
+}
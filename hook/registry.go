@@ -23,11 +23,19 @@ type ContextSetter func(ctxt *Context) error
 type Registry struct {
 	name string
 
-	// hasContext and hasCommand record whether the
-	// RegisterContext and/or RegisterCommand have
-	// been called for this context.
-	hasContext bool
-	hasCommand bool
+	// hasContext, hasCommand and hasLeaderState record
+	// whether RegisterContext, RegisterCommand and/or
+	// RegisterLeaderState have been called for this context.
+	hasContext     bool
+	hasCommand     bool
+	hasLeaderState bool
+
+	// hasEventContext records whether eventCtxt
+	// will be set when a hook runs, and eventCtxt
+	// holds the context passed to typed event functions
+	// registered with this registry (see event.go).
+	hasEventContext bool
+	eventCtxt       *Context
 
 	// clones stores an entry for each cloned name.
 	clones map[string]bool
@@ -38,14 +46,26 @@ type Registry struct {
 // sharedRegistry holds registry values that
 // are shared across all clones of a Registry.
 type sharedRegistry struct {
-	hooks     map[string][]hookFunc
-	commands  map[string]func([]string) (Command, error)
-	relations map[string]charm.Relation
-	resources map[string]resource.Meta
-	config    map[string]charm.Option
-	contexts  []ContextSetter
-	state     []localState
-	charmInfo CharmInfo
+	hooks            map[string][]hookFunc
+	commands         map[string]func([]string) (Command, error)
+	relations        map[string]charm.Relation
+	resources        map[string]resource.Meta
+	storage          map[string]charm.Storage
+	extraBindings    map[string]charm.ExtraBinding
+	containers       map[string]charm.Container
+	config           map[string]charm.Option
+	actions          map[string]*registeredAction
+	metrics          map[string]*registeredMetric
+	middleware       []func(HookFunc, HookInfo) HookFunc
+	reconcilers      []*registeredReconciler
+	stateCleanupHook string
+	stateKeys        KeySource
+	contexts         []ContextSetter
+	configStructs    []configStruct
+	configValidators []configValidator
+	state            []localState
+	leaderState      []localState
+	charmInfo        CharmInfo
 }
 
 // CharmInfo holds descriptive information associated with
@@ -65,6 +85,11 @@ type hookFunc struct {
 type localState struct {
 	registryName string
 	val          interface{}
+
+	// version and migrations hold the values passed
+	// to RegisterContextVersioned.
+	version    int
+	migrations map[int]StateMigration
 }
 
 // NewRegistry returns a new hook registry.
@@ -73,11 +98,20 @@ func NewRegistry() *Registry {
 		name:   "root",
 		clones: make(map[string]bool),
 		sharedRegistry: &sharedRegistry{
-			hooks:     make(map[string][]hookFunc),
-			commands:  make(map[string]func([]string) (Command, error)),
-			relations: make(map[string]charm.Relation),
-			resources: make(map[string]resource.Meta),
-			config:    make(map[string]charm.Option),
+			hooks:         make(map[string][]hookFunc),
+			commands:      make(map[string]func([]string) (Command, error)),
+			relations:     make(map[string]charm.Relation),
+			resources:     make(map[string]resource.Meta),
+			storage:       make(map[string]charm.Storage),
+			extraBindings: make(map[string]charm.ExtraBinding),
+			containers:    make(map[string]charm.Container),
+			config:        make(map[string]charm.Option),
+			actions:       make(map[string]*registeredAction),
+			metrics:       make(map[string]*registeredMetric),
+			middleware: []func(HookFunc, HookInfo) HookFunc{
+				AnnotateErrors,
+				RecoverPanics,
+			},
 			charmInfo: CharmInfo{
 				Name: "anon",
 			},
@@ -161,6 +195,10 @@ func (r *Registry) RegisterHook(name string, f func() error) {
 // This function may not be called more than once for a given Registry;
 // it will panic if it is.
 func (r *Registry) RegisterContext(setter ContextSetter, state interface{}) {
+	r.registerContext(setter, state, 0, nil)
+}
+
+func (r *Registry) registerContext(setter ContextSetter, state interface{}, version int, migrations map[int]StateMigration) {
 	if r.hasContext {
 		// TODO if this proves to be a problem, we could save
 		// some of the stack from the original invocation, so
@@ -180,6 +218,36 @@ func (r *Registry) RegisterContext(setter ContextSetter, state interface{}) {
 	r.state = append(r.state, localState{
 		registryName: r.name,
 		val:          state,
+		version:      version,
+		migrations:   migrations,
+	})
+}
+
+// RegisterLeaderState registers a value that holds state shared by all
+// units of the application. The state argument should hold a pointer
+// to the value.
+//
+// When a hook runs, before any context setter functions are called,
+// the value is loaded from the leader settings. When all hooks have
+// completed, if the current unit is the leader and the value has
+// changed, it is saved to the leader settings with leader-set. On other
+// units the value should be treated as read-only - any changes made to
+// it will be discarded. The data is saved using JSON.Marshal under a
+// leader settings key named after the registry.
+//
+// This function may not be called more than once for a given Registry;
+// it will panic if it is.
+func (r *Registry) RegisterLeaderState(state interface{}) {
+	if r.hasLeaderState {
+		panic("RegisterLeaderState called more than once")
+	}
+	r.hasLeaderState = true
+	if reflect.ValueOf(state).Kind() != reflect.Ptr {
+		panic(errgo.Newf("leader state value is not pointer but type %T", state))
+	}
+	r.leaderState = append(r.leaderState, localState{
+		registryName: r.name,
+		val:          state,
 	})
 }
 
@@ -236,6 +304,9 @@ func (r *Registry) RegisterRelation(rel charm.Relation) {
 	if rel.Scope == "" {
 		rel.Scope = charm.ScopeGlobal
 	}
+	if _, ok := r.extraBindings[rel.Name]; ok {
+		panic(errgo.Newf("relation %q has the same name as an extra binding", rel.Name))
+	}
 	old, ok := r.relations[rel.Name]
 	if ok {
 		if old != rel {
@@ -314,23 +385,60 @@ func (r *Registry) RegisteredConfig() map[string]charm.Option {
 
 var relationHookPattern = regexp.MustCompile("^(?:(" + names.RelationSnippet + ")-)?(relation-[a-z]+)$")
 
+// storageNameSnippet matches a storage name as allowed
+// in a charm's metadata.
+const storageNameSnippet = "[a-z][a-z0-9]*(?:-[a-z0-9]*[a-z][a-z0-9]*)*"
+
+var storageHookPattern = regexp.MustCompile("^" + storageNameSnippet + "-(storage-attached|storage-detaching)$")
+
+// workloadNameSnippet matches a workload container name.
+const workloadNameSnippet = "[a-z](?:[a-z0-9-]*[a-z0-9])?"
+
+var (
+	workloadNamePattern = regexp.MustCompile("^" + workloadNameSnippet + "$")
+	workloadHookPattern = regexp.MustCompile("^(" + workloadNameSnippet + ")-pebble-ready$")
+)
+
+// Secret hook kinds. These are not yet defined
+// by the charm/hooks package.
+const (
+	secretChanged hooks.Kind = "secret-changed"
+	secretRotate  hooks.Kind = "secret-rotate"
+	secretExpired hooks.Kind = "secret-expired"
+	secretRemove  hooks.Kind = "secret-remove"
+)
+
 var hookNames = map[hooks.Kind]bool{
-	hooks.Install:            true,
-	hooks.Start:              true,
-	hooks.ConfigChanged:      true,
-	hooks.UpdateStatus:       true,
-	hooks.UpgradeCharm:       true,
-	hooks.Stop:               true,
-	hooks.Action:             true,
-	hooks.CollectMetrics:     true,
-	hooks.MeterStatusChanged: true,
-	hooks.RelationJoined:     true,
-	hooks.RelationChanged:    true,
-	hooks.RelationDeparted:   true,
-	hooks.RelationBroken:     true,
+	hooks.Install:               true,
+	hooks.Start:                 true,
+	hooks.ConfigChanged:         true,
+	hooks.UpdateStatus:          true,
+	hooks.UpgradeCharm:          true,
+	hooks.Stop:                  true,
+	hooks.Remove:                true,
+	hooks.Action:                true,
+	hooks.CollectMetrics:        true,
+	hooks.MeterStatusChanged:    true,
+	hooks.LeaderElected:         true,
+	hooks.LeaderSettingsChanged: true,
+	hooks.LeaderDeposed:         true,
+	hooks.PreSeriesUpgrade:      true,
+	hooks.PostSeriesUpgrade:     true,
+	hooks.RelationCreated:       true,
+	hooks.RelationJoined:        true,
+	hooks.RelationChanged:       true,
+	hooks.RelationDeparted:      true,
+	hooks.RelationBroken:        true,
+	secretChanged:               true,
+	secretRotate:                true,
+	secretExpired:               true,
+	secretRemove:                true,
 }
 
 func validHookName(s string) bool {
+	if storageHookPattern.MatchString(s) || workloadHookPattern.MatchString(s) {
+		return true
+	}
 	if m := relationHookPattern.FindStringSubmatch(s); m != nil {
 		if m[1] == "" {
 			// The user has specified a relation hook name with
@@ -0,0 +1,207 @@
+package hook_test
+
+import (
+	"os"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type registrySuite struct{}
+
+var _ = gc.Suite(&registrySuite{})
+
+var hookNameTests = []struct {
+	name  string
+	valid bool
+}{
+	{"install", true},
+	{"remove", true},
+	{"pre-series-upgrade", true},
+	{"post-series-upgrade", true},
+	{"leader-elected", true},
+	{"db-relation-created", true},
+	{"db-relation-joined", true},
+	{"relation-created", false},
+	{"data-storage-attached", true},
+	{"secret-changed", true},
+	{"secret-rotate", true},
+	{"secret-expired", true},
+	{"secret-remove", true},
+	{"workload-pebble-ready", true},
+	{"my-workload-pebble-ready", true},
+	{"-pebble-ready", false},
+	{"pebble-ready", false},
+	{"secret-foo", false},
+	{"foo", false},
+}
+
+func (*registrySuite) TestHookNames(c *gc.C) {
+	for i, test := range hookNameTests {
+		c.Logf("test %d: %s", i, test.name)
+		r := hook.NewRegistry()
+		if test.valid {
+			r.RegisterHook(test.name, nop)
+		} else {
+			c.Check(func() {
+				r.RegisterHook(test.name, nop)
+			}, gc.PanicMatches, `invalid hook name ".*"`)
+		}
+	}
+}
+
+func (*registrySuite) TestHookContextFields(c *gc.C) {
+	var ctxts []hook.Context
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			var ctxt *hook.Context
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("workload-pebble-ready", nop)
+			r.RegisterHook("secret-expired", nop)
+			r.RegisterHook("*", func() error {
+				ctxts = append(ctxts, *ctxt)
+				return nil
+			})
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("workload-pebble-ready", "", "")
+	c.Assert(err, gc.IsNil)
+	err = runner.RunSecretHook("secret-expired", "secret:1234", "password", 3)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ctxts, gc.HasLen, 2)
+	c.Assert(ctxts[0].WorkloadName, gc.Equals, "workload")
+	c.Assert(ctxts[1].SecretId, gc.Equals, "secret:1234")
+	c.Assert(ctxts[1].SecretLabel, gc.Equals, "password")
+	c.Assert(ctxts[1].SecretRevision, gc.Equals, 3)
+}
+
+var contextEnvTests = []struct {
+	about       string
+	hookName    string
+	env         map[string]string
+	expectError string
+	check       func(c *gc.C, ctxt *hook.Context)
+}{{
+	about:    "pebble-ready",
+	hookName: "workload-pebble-ready",
+	env: map[string]string{
+		"JUJU_WORKLOAD_NAME": "workload",
+	},
+	check: func(c *gc.C, ctxt *hook.Context) {
+		c.Assert(ctxt.WorkloadName, gc.Equals, "workload")
+	},
+}, {
+	about:       "pebble-ready without workload name",
+	hookName:    "workload-pebble-ready",
+	expectError: `required environment variable "JUJU_WORKLOAD_NAME" not set`,
+}, {
+	about:    "secret-remove",
+	hookName: "secret-remove",
+	env: map[string]string{
+		"JUJU_SECRET_ID":       "secret:1234",
+		"JUJU_SECRET_LABEL":    "password",
+		"JUJU_SECRET_REVISION": "2",
+	},
+	check: func(c *gc.C, ctxt *hook.Context) {
+		c.Assert(ctxt.SecretId, gc.Equals, "secret:1234")
+		c.Assert(ctxt.SecretLabel, gc.Equals, "password")
+		c.Assert(ctxt.SecretRevision, gc.Equals, 2)
+	},
+}, {
+	about:    "secret-remove without revision",
+	hookName: "secret-remove",
+	env: map[string]string{
+		"JUJU_SECRET_ID": "secret:1234",
+	},
+	expectError: `required environment variable "JUJU_SECRET_REVISION" not set`,
+}, {
+	about:    "invalid secret revision",
+	hookName: "secret-expired",
+	env: map[string]string{
+		"JUJU_SECRET_ID":       "secret:1234",
+		"JUJU_SECRET_REVISION": "x",
+	},
+	expectError: `invalid secret revision "x"`,
+}, {
+	about:    "relation-departed",
+	hookName: "db-relation-departed",
+	env: map[string]string{
+		"JUJU_RELATION":       "db",
+		"JUJU_RELATION_ID":    "db:0",
+		"JUJU_REMOTE_UNIT":    "postgresql/0",
+		"JUJU_REMOTE_APP":     "postgresql",
+		"JUJU_DEPARTING_UNIT": "postgresql/0",
+	},
+	check: func(c *gc.C, ctxt *hook.Context) {
+		c.Assert(ctxt.DepartingUnit, gc.Equals, hook.UnitId("postgresql/0"))
+	},
+}, {
+	about:    "pre-series-upgrade",
+	hookName: "pre-series-upgrade",
+	env: map[string]string{
+		"JUJU_TARGET_SERIES": "focal",
+	},
+	check: func(c *gc.C, ctxt *hook.Context) {
+		c.Assert(ctxt.TargetSeries, gc.Equals, "focal")
+	},
+}}
+
+var contextEnvVars = []string{
+	"JUJU_MODEL_UUID",
+	"JUJU_UNIT_NAME",
+	"CHARM_DIR",
+	"JUJU_CONTEXT_ID",
+	"JUJU_AGENT_SOCKET",
+	"JUJU_RELATION",
+	"JUJU_RELATION_ID",
+	"JUJU_REMOTE_UNIT",
+	"JUJU_REMOTE_APP",
+	"JUJU_DEPARTING_UNIT",
+	"JUJU_WORKLOAD_NAME",
+	"JUJU_SECRET_ID",
+	"JUJU_SECRET_LABEL",
+	"JUJU_SECRET_REVISION",
+	"JUJU_TARGET_SERIES",
+}
+
+func (*registrySuite) TestNewContextFromEnvironment(c *gc.C) {
+	for _, name := range contextEnvVars {
+		old, ok := os.LookupEnv(name)
+		if ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	for i, test := range contextEnvTests {
+		c.Logf("test %d: %s", i, test.about)
+		for _, name := range contextEnvVars {
+			os.Unsetenv(name)
+		}
+		os.Setenv("JUJU_MODEL_UUID", hooktest.UUID)
+		os.Setenv("JUJU_UNIT_NAME", "someunit/0")
+		os.Setenv("CHARM_DIR", "/charm")
+		os.Setenv("JUJU_CONTEXT_ID", "ctxt-1")
+		for name, val := range test.env {
+			os.Setenv(name, val)
+		}
+		ctxt, _, err := hook.NewContextFromEnvironment(hook.NewRegistry(), c.MkDir(), test.hookName, nil)
+		if test.expectError != "" {
+			c.Check(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Check(ctxt.HookName, gc.Equals, test.hookName)
+		c.Check(ctxt.Unit, jc.DeepEquals, hook.UnitId("someunit/0"))
+		test.check(c, ctxt)
+		ctxt.Close()
+	}
+}
@@ -0,0 +1,174 @@
+package hook
+
+import (
+	"sort"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+)
+
+// maxPrefetchConcurrency holds the maximum number of relation ids
+// that PrefetchRelations will fetch concurrently.
+const maxPrefetchConcurrency = 8
+
+// GetRelationIds returns the current ids for the relation with the
+// given name. The ids are fetched the first time they are asked for and
+// are stored in ctxt.RelationIds.
+func (ctxt *Context) GetRelationIds(name string) ([]RelationId, error) {
+	if ids, ok := ctxt.RelationIds[name]; ok {
+		return ids, nil
+	}
+	ids, err := ctxt.relationIds(name)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get relation ids for relation %q", name)
+	}
+	if ctxt.RelationIds == nil {
+		ctxt.RelationIds = make(map[string][]RelationId)
+	}
+	ctxt.RelationIds[name] = ids
+	return ids, nil
+}
+
+// GetRelationUnits returns the settings for all the remote units that
+// have joined the relation with the given id, keyed by unit id. The
+// settings are fetched the first time they are asked for and are
+// stored in ctxt.Relations (and the remote application's settings in
+// ctxt.AppRelations).
+func (ctxt *Context) GetRelationUnits(id RelationId) (map[UnitId]map[string]string, error) {
+	if units, ok := ctxt.Relations[id]; ok {
+		return units, nil
+	}
+	info, err := ctxt.fetchRelation(id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ctxt.storeRelation(info)
+	return info.units, nil
+}
+
+// GetAppRelation returns the settings published by the remote
+// application on the relation with the given id. It returns nil if the
+// remote application is not known, which is the case when none of its
+// units have joined the relation and the current hook is not running
+// for the relation.
+func (ctxt *Context) GetAppRelation(id RelationId) (map[string]string, error) {
+	if _, err := ctxt.GetRelationUnits(id); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return ctxt.AppRelations[id], nil
+}
+
+// PrefetchRelations concurrently fetches the ids, unit settings and
+// application settings for all the relations with the given names, so
+// that ctxt.RelationIds, ctxt.Relations and ctxt.AppRelations are
+// complete for those relations. If no names are given, all the
+// relations registered with the Registry passed to Main are fetched.
+//
+// This is useful for hooks that need all the relation data, or
+// that access the Context fields directly rather than through
+// GetRelationIds, GetRelationUnits and GetAppRelation.
+func (ctxt *Context) PrefetchRelations(names ...string) error {
+	if len(names) == 0 {
+		names = ctxt.relationNames
+	}
+	var ids []RelationId
+	for _, name := range names {
+		nameIds, err := ctxt.GetRelationIds(name)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		for _, id := range nameIds {
+			if _, ok := ctxt.Relations[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	infos := make([]*relationInfo, len(ids))
+	errs := make([]error, len(ids))
+	sem := make(chan struct{}, maxPrefetchConcurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		i, id := i, id
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			infos[i], errs[i] = ctxt.fetchRelation(id)
+		}()
+	}
+	wg.Wait()
+	for i, info := range infos {
+		if errs[i] != nil {
+			return errgo.Mask(errs[i])
+		}
+		ctxt.storeRelation(info)
+	}
+	return nil
+}
+
+// relationInfo holds the information fetched
+// about a relation by fetchRelation.
+type relationInfo struct {
+	id    RelationId
+	units map[UnitId]map[string]string
+
+	// appSettings holds the settings of the remote application,
+	// or nil if the application is not known.
+	appSettings map[string]string
+}
+
+// fetchRelation fetches all the unit and application settings for the
+// relation with the given id. It does not change ctxt, so it is safe to
+// call concurrently.
+func (ctxt *Context) fetchRelation(id RelationId) (*relationInfo, error) {
+	unitIds, err := ctxt.relationUnits(id)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get unit ids for relation id %q", id)
+	}
+	info := &relationInfo{
+		id:    id,
+		units: make(map[UnitId]map[string]string),
+	}
+	for _, unitId := range unitIds {
+		settings, err := ctxt.getAllRelationUnit(id, unitId)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get settings for relation %s, unit %s", id, unitId)
+		}
+		info.units[unitId] = settings
+	}
+	app := ""
+	if id == ctxt.RelationId {
+		app = ctxt.RemoteApp
+	}
+	if app == "" && len(unitIds) > 0 {
+		sort.Slice(unitIds, func(i, j int) bool {
+			return unitIds[i] < unitIds[j]
+		})
+		app = unitIds[0].App()
+	}
+	if app == "" {
+		return info, nil
+	}
+	settings, err := ctxt.getAllRelationApp(id, app)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get application settings for relation %s, application %s", id, app)
+	}
+	info.appSettings = settings
+	return info, nil
+}
+
+// storeRelation stores the given relation information in ctxt.
+func (ctxt *Context) storeRelation(info *relationInfo) {
+	if ctxt.Relations == nil {
+		ctxt.Relations = make(map[RelationId]map[UnitId]map[string]string)
+	}
+	ctxt.Relations[info.id] = info.units
+	if info.appSettings == nil {
+		return
+	}
+	if ctxt.AppRelations == nil {
+		ctxt.AppRelations = make(map[RelationId]map[string]string)
+	}
+	ctxt.AppRelations[info.id] = info.appSettings
+}
@@ -0,0 +1,114 @@
+package hook_test
+
+import (
+	"github.com/juju/charm/v9"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type relationsSuite struct{}
+
+var _ = gc.Suite(&relationsSuite{})
+
+func newRelationsRunner(c *gc.C, ctxt **hook.Context, f func() error) *hooktest.Runner {
+	return &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterRelation(charm.Relation{
+				Name:      "db",
+				Interface: "pgsql",
+				Role:      charm.RoleRequirer,
+			})
+			r.RegisterRelation(charm.Relation{
+				Name:      "website",
+				Interface: "http",
+				Role:      charm.RoleProvider,
+			})
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				*ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("update-status", f)
+		},
+		RelationIds: map[string][]hook.RelationId{
+			"db":      {"db:0"},
+			"website": {"website:1", "website:2"},
+		},
+		Relations: map[hook.RelationId]map[hook.UnitId]map[string]string{
+			"db:0": {
+				"postgresql/0": {"host": "10.0.0.1"},
+				"postgresql/1": {"host": "10.0.0.2"},
+			},
+			"website:1": {
+				"haproxy/0": {},
+			},
+			"website:2": {
+				"apache/0": {},
+			},
+		},
+		AppRelations: map[hook.RelationId]map[string]string{
+			"db:0": {"database": "foo"},
+		},
+		Logger: c,
+	}
+}
+
+func (*relationsSuite) TestNoRelationDataFetchedUnlessUsed(c *gc.C) {
+	var ctxt *hook.Context
+	runner := newRelationsRunner(c, &ctxt, nop)
+	err := runner.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.ToolCalls["relation-ids"], gc.Equals, 0)
+	c.Assert(runner.ToolCalls["relation-list"], gc.Equals, 0)
+	c.Assert(runner.ToolCalls["relation-get"], gc.Equals, 0)
+}
+
+func (*relationsSuite) TestRelationDataFetchedOnDemand(c *gc.C) {
+	var ctxt *hook.Context
+	runner := newRelationsRunner(c, &ctxt, func() error {
+		for i := 0; i < 2; i++ {
+			ids, err := ctxt.GetRelationIds("db")
+			c.Assert(err, gc.IsNil)
+			c.Assert(ids, jc.DeepEquals, []hook.RelationId{"db:0"})
+			units, err := ctxt.GetRelationUnits("db:0")
+			c.Assert(err, gc.IsNil)
+			c.Assert(units, jc.DeepEquals, map[hook.UnitId]map[string]string{
+				"postgresql/0": {"host": "10.0.0.1"},
+				"postgresql/1": {"host": "10.0.0.2"},
+			})
+			settings, err := ctxt.GetAppRelation("db:0")
+			c.Assert(err, gc.IsNil)
+			c.Assert(settings, jc.DeepEquals, map[string]string{"database": "foo"})
+		}
+		return nil
+	})
+	err := runner.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+
+	// Only the relation that was asked about was fetched,
+	// and only once.
+	c.Assert(runner.ToolCalls["relation-ids"], gc.Equals, 1)
+	c.Assert(runner.ToolCalls["relation-list"], gc.Equals, 1)
+	c.Assert(runner.ToolCalls["relation-get"], gc.Equals, 3)
+	c.Assert(ctxt.RelationIds, jc.DeepEquals, map[string][]hook.RelationId{
+		"db": {"db:0"},
+	})
+}
+
+func (*relationsSuite) TestPrefetchRelations(c *gc.C) {
+	var ctxt *hook.Context
+	runner := newRelationsRunner(c, &ctxt, func() error {
+		return ctxt.PrefetchRelations()
+	})
+	err := runner.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(ctxt.RelationIds, jc.DeepEquals, runner.RelationIds)
+	c.Assert(ctxt.Relations, jc.DeepEquals, runner.Relations)
+	c.Assert(ctxt.AppRelations["db:0"], jc.DeepEquals, map[string]string{"database": "foo"})
+	c.Assert(runner.ToolCalls["relation-ids"], gc.Equals, 2)
+	c.Assert(runner.ToolCalls["relation-list"], gc.Equals, 3)
+	c.Assert(runner.Record, gc.HasLen, 0)
+}
@@ -2,13 +2,19 @@ package hook
 
 import (
 	"bytes"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
 	osexec "os/exec"
 	"strings"
+	"sync"
 
 	"gopkg.in/errgo.v1"
 )
 
-// ToolRunner is used to run hook tools.
+// ToolRunner is used to run hook tools. Run may be called
+// concurrently (see Context.PrefetchRelations).
 type ToolRunner interface {
 	// Run runs the hook tool with the given name
 	// and arguments, and returns its standard output.
@@ -20,9 +26,158 @@ type ToolRunner interface {
 
 // newToolRunnerFromEnvironment returns an implementation of ToolRunner
 // that uses a direct connection to the unit agent's socket to
-// run the tools.
+// run the tools. If the socket is not available, it falls
+// back to running the tools as commands.
+//
+// Current versions of Juju describe the socket with
+// $JUJU_AGENT_SOCKET_ADDRESS and $JUJU_AGENT_SOCKET_NETWORK;
+// older versions set $JUJU_AGENT_SOCKET to the path of a unix
+// socket.
 func newToolRunnerFromEnvironment() (ToolRunner, error) {
-	return &execToolRunner{}, nil
+	p := SocketToolRunnerParams{
+		Network:   os.Getenv(envSocketNetwork),
+		Address:   os.Getenv(envSocketAddress),
+		ContextId: os.Getenv(envJujuContextId),
+		Token:     os.Getenv(envAgentToken),
+	}
+	if p.Address == "" {
+		p.Network, p.Address = "unix", os.Getenv(envSocketPath)
+	}
+	if p.Address == "" {
+		return &execToolRunner{}, nil
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	p.Dir = dir
+	runner, err := NewSocketToolRunner(p)
+	if err != nil {
+		log.Printf("cannot connect to agent socket; running hook tools as commands: %v", err)
+		return &execToolRunner{}, nil
+	}
+	return runner, nil
+}
+
+// SocketToolRunnerParams holds the parameters
+// for NewSocketToolRunner.
+type SocketToolRunnerParams struct {
+	// Network and Address hold the network and address of
+	// the unit agent's socket (from $JUJU_AGENT_SOCKET_NETWORK
+	// and $JUJU_AGENT_SOCKET_ADDRESS). Only the "unix" network
+	// is supported: the "tcp" network used by Kubernetes
+	// operators requires TLS.
+	Network string
+	Address string
+
+	// ContextId holds the hook context id (from $JUJU_CONTEXT_ID).
+	ContextId string
+
+	// Dir holds the directory that the tools will run in.
+	Dir string
+
+	// Token holds the token that the agent uses to
+	// authenticate requests (from $JUJU_AGENT_TOKEN), if any.
+	Token string
+}
+
+// NewSocketToolRunner returns an implementation of ToolRunner that
+// runs hook tools by making jujuc RPC calls directly to the unit
+// agent listening on the given socket, avoiding the cost of
+// starting a new process for each tool.
+//
+// If a call fails for any reason other than the tool being
+// unknown to the agent, for example because the agent does not
+// understand the request, the tool is run as a command instead,
+// as are all the tools run subsequently.
+func NewSocketToolRunner(p SocketToolRunnerParams) (ToolRunner, error) {
+	if p.Network != "unix" {
+		return nil, errgo.Newf("unsupported agent socket network %q", p.Network)
+	}
+	client, err := rpc.Dial(p.Network, p.Address)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot dial agent socket")
+	}
+	return &socketToolRunner{
+		client:   client,
+		params:   p,
+		fallback: execToolRunner{},
+	}, nil
+}
+
+// jujucRequest holds the parameters to the
+// Jujuc.Main RPC call made to the unit agent.
+// The field names must match those expected
+// by the agent.
+type jujucRequest struct {
+	ContextId   string
+	Dir         string
+	CommandName string
+	Args        []string
+	StdinSet    bool
+	Stdin       []byte
+	Token       string
+}
+
+// jujucResponse holds the result of
+// the Jujuc.Main RPC call.
+type jujucResponse struct {
+	Code   int
+	Stdout []byte
+	Stderr []byte
+}
+
+type socketToolRunner struct {
+	client   *rpc.Client
+	params   SocketToolRunnerParams
+	fallback ToolRunner
+
+	// mu guards failed.
+	mu sync.Mutex
+
+	// failed records whether an RPC call has failed,
+	// so that tools are run with fallback instead.
+	failed bool
+}
+
+func (r *socketToolRunner) Run(cmd string, args ...string) ([]byte, error) {
+	r.mu.Lock()
+	failed := r.failed
+	r.mu.Unlock()
+	if failed {
+		return r.fallback.Run(cmd, args...)
+	}
+	req := jujucRequest{
+		ContextId:   r.params.ContextId,
+		Dir:         r.params.Dir,
+		CommandName: cmd,
+		Args:        args,
+		Token:       r.params.Token,
+	}
+	var resp jujucResponse
+	if err := r.client.Call("Jujuc.Main", req, &resp); err != nil {
+		if isUnimplemented(err.Error()) {
+			return nil, errgo.WithCausef(nil, ErrUnimplemented, "%s", err.Error())
+		}
+		log.Printf("agent socket call failed; running hook tools as commands: %v", err)
+		r.mu.Lock()
+		r.failed = true
+		r.mu.Unlock()
+		return r.fallback.Run(cmd, args...)
+	}
+	if resp.Code != 0 {
+		errText := strings.TrimSpace(string(resp.Stderr))
+		errText = strings.TrimPrefix(errText, "error: ")
+		if errText == "" {
+			errText = fmt.Sprintf("%s exited with code %d", cmd, resp.Code)
+		}
+		return nil, errgo.New(errText)
+	}
+	return resp.Stdout, nil
+}
+
+func (r *socketToolRunner) Close() error {
+	return r.client.Close()
 }
 
 func isUnimplemented(errStr string) bool {
@@ -50,6 +205,11 @@ func (execToolRunner) Run(cmd string, args ...string) ([]byte, error) {
 			}
 			return nil, errgo.New(errText)
 		}
+		if err, ok := err.(*osexec.Error); ok && err.Err == osexec.ErrNotFound {
+			// Older versions of juju do not provide all
+			// the hook tool commands.
+			return nil, errgo.WithCausef(nil, ErrUnimplemented, "%s", err.Error())
+		}
 		return nil, err
 	}
 	return outBuf.Bytes(), nil
@@ -0,0 +1,179 @@
+package hook_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+)
+
+type runnerSuite struct{}
+
+var _ = gc.Suite(&runnerSuite{})
+
+func (*runnerSuite) TestSocketToolRunner(c *gc.C) {
+	var jujuc fakeJujuc
+	socketPath := startFakeAgent(c, &jujuc)
+
+	runner, err := hook.NewSocketToolRunner(hook.SocketToolRunnerParams{
+		Network:   "unix",
+		Address:   socketPath,
+		ContextId: "ctxt-1",
+		Dir:       "/charm",
+		Token:     "token-1",
+	})
+	c.Assert(err, gc.IsNil)
+	defer runner.Close()
+
+	out, err := runner.Run("config-get", "--format", "json")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(out), gc.Equals, `{"port":80}`)
+
+	_, err = runner.Run("relation-get", "-r", "db:0")
+	c.Assert(err, gc.ErrorMatches, `permission denied`)
+
+	_, err = runner.Run("unknown-tool")
+	c.Assert(errgo.Cause(err), gc.Equals, hook.ErrUnimplemented)
+
+	c.Assert(jujuc.requests, jc.DeepEquals, []JujucRequest{{
+		ContextId:   "ctxt-1",
+		Dir:         "/charm",
+		CommandName: "config-get",
+		Args:        []string{"--format", "json"},
+		Token:       "token-1",
+	}, {
+		ContextId:   "ctxt-1",
+		Dir:         "/charm",
+		CommandName: "relation-get",
+		Args:        []string{"-r", "db:0"},
+		Token:       "token-1",
+	}, {
+		ContextId:   "ctxt-1",
+		Dir:         "/charm",
+		CommandName: "unknown-tool",
+		Token:       "token-1",
+	}})
+
+	// The runner can be used for hook contexts as usual.
+	ctxt := &hook.Context{
+		Runner: runner,
+	}
+	port, err := ctxt.GetConfigInt("port")
+	c.Assert(err, gc.IsNil)
+	c.Assert(port, gc.Equals, 80)
+}
+
+func (*runnerSuite) TestSocketToolRunnerDialError(c *gc.C) {
+	_, err := hook.NewSocketToolRunner(hook.SocketToolRunnerParams{
+		Network: "unix",
+		Address: filepath.Join(c.MkDir(), "nonexistent"),
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot dial agent socket: .*`)
+
+	_, err = hook.NewSocketToolRunner(hook.SocketToolRunnerParams{
+		Network: "tcp",
+		Address: "127.0.0.1:1234",
+	})
+	c.Assert(err, gc.ErrorMatches, `unsupported agent socket network "tcp"`)
+}
+
+func (*runnerSuite) TestSocketToolRunnerFallsBackOnProtocolError(c *gc.C) {
+	// Provide a config-get command for the
+	// runner to fall back to.
+	binDir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(binDir, "config-get"), []byte("#!/bin/sh\nprintf 'exec %s' \"$*\"\n"), 0755)
+	c.Assert(err, gc.IsNil)
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+oldPath)
+
+	// The agent closes connections without responding,
+	// as if it did not understand the request.
+	socketPath := filepath.Join(c.MkDir(), "agent.socket")
+	listener, err := net.Listen("unix", socketPath)
+	c.Assert(err, gc.IsNil)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	runner, err := hook.NewSocketToolRunner(hook.SocketToolRunnerParams{
+		Network: "unix",
+		Address: socketPath,
+	})
+	c.Assert(err, gc.IsNil)
+	defer runner.Close()
+
+	for i := 0; i < 2; i++ {
+		out, err := runner.Run("config-get", "port")
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(out), gc.Equals, "exec port")
+	}
+}
+
+// startFakeAgent starts an RPC server serving the given fake jujuc
+// implementation on a unix socket and returns the socket path.
+func startFakeAgent(c *gc.C, jujuc *fakeJujuc) string {
+	srv := rpc.NewServer()
+	err := srv.RegisterName("Jujuc", jujuc)
+	c.Assert(err, gc.IsNil)
+	socketPath := filepath.Join(c.MkDir(), "agent.socket")
+	listener, err := net.Listen("unix", socketPath)
+	c.Assert(err, gc.IsNil)
+	go srv.Accept(listener)
+	c.Logf("fake agent listening on %s", socketPath)
+	return socketPath
+}
+
+// JujucRequest and JujucResponse mirror the types
+// used by the unit agent's jujuc RPC server.
+type JujucRequest struct {
+	ContextId   string
+	Dir         string
+	CommandName string
+	Args        []string
+	StdinSet    bool
+	Stdin       []byte
+	Token       string
+}
+
+type JujucResponse struct {
+	Code   int
+	Stdout []byte
+	Stderr []byte
+}
+
+type fakeJujuc struct {
+	requests []JujucRequest
+}
+
+func (j *fakeJujuc) Main(req JujucRequest, resp *JujucResponse) error {
+	j.requests = append(j.requests, req)
+	switch req.CommandName {
+	case "config-get":
+		if len(req.Args) > 3 {
+			resp.Stdout = []byte(fmt.Sprintf("%d", 80))
+		} else {
+			resp.Stdout = []byte(`{"port":80}`)
+		}
+	case "relation-get":
+		resp.Code = 1
+		resp.Stderr = []byte("error: permission denied\n")
+	default:
+		return fmt.Errorf("bad request: unknown command %q", req.CommandName)
+	}
+	return nil
+}
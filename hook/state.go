@@ -1,16 +1,16 @@
 package hook
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"gopkg.in/errgo.v1"
 )
 
-// TODO should we add a CleanUp or Remove method on
-// this type to remove all the state?
-
 // PersistentState is used to save persistent charm state
 // to disk. It is defined as an interface so that it can
 // be defined differently for tests. The customary implementation
@@ -23,43 +23,307 @@ type PersistentState interface {
 	// If the data has not previously been saved, this
 	// should return (nil, nil).
 	Load(name string) ([]byte, error)
+
+	// Delete deletes the state data with the given name.
+	// It is not an error if there is no such data.
+	Delete(name string) error
+
+	// List returns the names of all the saved
+	// state data, in alphabetical order.
+	List() ([]string, error)
+}
+
+// TransactionalState is implemented by PersistentState implementations
+// that can save several values in a single atomic operation. When the
+// state passed to Main implements TransactionalState, all the state
+// changed by a hook is saved with one call to SaveAll, so either all
+// of it is saved or none of it is.
+type TransactionalState interface {
+	PersistentState
+
+	// SaveAll saves all the given state data, keyed by name,
+	// atomically. State with names not in the map is
+	// left unchanged.
+	SaveAll(values map[string][]byte) error
 }
 
+const (
+	// stateFile holds the name of the file in the state directory
+	// that holds all the state. The names of the files used by
+	// diskState do not end in ".json" so that they cannot be
+	// confused with the per-name files used by earlier versions.
+	stateFile = "gocharm-state"
+
+	// prevStateFile holds the name of the file holding the
+	// previous generation of the state, used if the current
+	// state file is missing or cannot be read.
+	prevStateFile = stateFile + ".prev"
+
+	// tmpStateFile holds the name of the file that new
+	// state is written to before it is renamed into place.
+	tmpStateFile = stateFile + ".tmp"
+)
+
 // diskState is an implementation of PersistentState that
-// stores the state in the filesystem.
+// stores all the state in a single file in the filesystem.
+// The file is read once, when state is first loaded or saved,
+// and rewritten atomically whenever state is saved.
 type diskState struct {
 	dir string
+
+	// values holds all the state, keyed by name.
+	// It is nil until the state has been read.
+	values map[string][]byte
+
+	// legacyFiles holds the per-name state files that the state
+	// was migrated from. They are removed when the state is
+	// first saved.
+	legacyFiles []string
+}
+
+// diskStateFile holds the contents of the state file.
+type diskStateFile struct {
+	Values map[string][]byte
 }
 
 // NewDiskState returns an implementation of
 // PersistentState that stores state in the given directory.
+//
+// All the state is held in a single file that is replaced
+// atomically when state is saved, and the previous generation
+// of the file is kept so that state can be recovered if the
+// file is lost or damaged. State stored by earlier versions,
+// in a separate file for each name, is migrated when it is
+// first used.
+//
+// The returned value also implements TransactionalState.
 func NewDiskState(dir string) PersistentState {
-	return &diskState{dir}
+	return &diskState{
+		dir: dir,
+	}
 }
 
 // Save implements PersistentState.Save.
 func (s *diskState) Save(name string, data []byte) error {
-	if err := os.MkdirAll(s.dir, 0700); err != nil {
+	return s.SaveAll(map[string][]byte{
+		name: data,
+	})
+}
+
+// SaveAll implements TransactionalState.SaveAll.
+func (s *diskState) SaveAll(values map[string][]byte) error {
+	if err := s.read(); err != nil {
 		return errgo.Mask(err)
 	}
-	if err := ioutil.WriteFile(s.path(name), data, 0600); err != nil {
+	newValues := make(map[string][]byte)
+	for name, data := range s.values {
+		newValues[name] = data
+	}
+	for name, data := range values {
+		newValues[name] = data
+	}
+	if err := s.write(newValues); err != nil {
 		return errgo.Mask(err)
 	}
+	s.values = newValues
+	return errgo.Mask(s.removeLegacyFiles())
+}
+
+// removeLegacyFiles removes the files that the state was
+// migrated from. It should be called only when the state
+// has been written to the state file.
+func (s *diskState) removeLegacyFiles() error {
+	for _, path := range s.legacyFiles {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errgo.Notef(err, "cannot remove migrated state file")
+		}
+	}
+	s.legacyFiles = nil
+	return nil
+}
+
+// removeFiles removes all the files holding the state, including
+// any previous and legacy files. It is used when the state has been
+// moved elsewhere.
+func (s *diskState) removeFiles() error {
+	if err := s.removeLegacyFiles(); err != nil {
+		return errgo.Mask(err)
+	}
+	for _, name := range []string{tmpStateFile, prevStateFile, stateFile} {
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+			return errgo.Notef(err, "cannot remove state file")
+		}
+	}
+	s.values = nil
 	return nil
 }
 
 // Load implements PersistentState.Load
 func (s *diskState) Load(name string) ([]byte, error) {
-	data, err := ioutil.ReadFile(s.path(name))
-	if os.IsNotExist(err) {
-		return nil, nil
+	if err := s.read(); err != nil {
+		return nil, errgo.Mask(err)
 	}
-	if err != nil {
+	return s.values[name], nil
+}
+
+// Delete implements PersistentState.Delete.
+func (s *diskState) Delete(name string) error {
+	if err := s.read(); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, ok := s.values[name]; !ok && len(s.legacyFiles) == 0 {
+		return nil
+	}
+	newValues := make(map[string][]byte)
+	for n, data := range s.values {
+		if n != name {
+			newValues[n] = data
+		}
+	}
+	if err := s.write(newValues); err != nil {
+		return errgo.Mask(err)
+	}
+	s.values = newValues
+	return errgo.Mask(s.removeLegacyFiles())
+}
+
+// List implements PersistentState.List.
+func (s *diskState) List() ([]string, error) {
+	if err := s.read(); err != nil {
 		return nil, errgo.Mask(err)
 	}
-	return data, nil
+	return sortedNames(s.values), nil
 }
 
-func (s *diskState) path(name string) string {
-	return filepath.Join(s.dir, name+".json")
+// sortedNames returns the keys of the given
+// map in alphabetical order.
+func sortedNames(values map[string][]byte) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// read reads the state into s.values if it has
+// not already been read.
+func (s *diskState) read() error {
+	if s.values != nil {
+		return nil
+	}
+	values, err := readStateFile(filepath.Join(s.dir, stateFile))
+	if err == nil {
+		s.values = values
+		return nil
+	}
+	// The current generation is missing or damaged, so
+	// fall back to the previous generation.
+	values, prevErr := readStateFile(filepath.Join(s.dir, prevStateFile))
+	if prevErr == nil {
+		s.values = values
+		return nil
+	}
+	if !os.IsNotExist(errgo.Cause(err)) {
+		return errgo.Notef(err, "cannot read state and no previous state available")
+	}
+	if !os.IsNotExist(errgo.Cause(prevErr)) {
+		return errgo.Notef(prevErr, "cannot read previous state")
+	}
+	return s.readLegacy()
+}
+
+// readLegacy reads state stored by earlier versions,
+// which used one file for each name.
+func (s *diskState) readLegacy() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	sort.Strings(paths)
+	values := make(map[string][]byte)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return errgo.Notef(err, "cannot read old state file")
+		}
+		values[strings.TrimSuffix(filepath.Base(path), ".json")] = data
+	}
+	s.values = values
+	s.legacyFiles = paths
+	return nil
+}
+
+// write writes the given values to the state file. The previous state
+// file, if any, is kept as the previous generation.
+func (s *diskState) write(values map[string][]byte) error {
+	data, err := json.Marshal(diskStateFile{
+		Values: values,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	tmpPath := filepath.Join(s.dir, tmpStateFile)
+	if err := writeFileSync(tmpPath, data, 0600); err != nil {
+		return errgo.Notef(err, "cannot write state")
+	}
+	path := filepath.Join(s.dir, stateFile)
+	if err := os.Rename(path, filepath.Join(s.dir, prevStateFile)); err != nil && !os.IsNotExist(err) {
+		return errgo.Notef(err, "cannot keep previous state")
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errgo.Notef(err, "cannot replace state")
+	}
+	if err := syncDir(s.dir); err != nil {
+		return errgo.Notef(err, "cannot sync state directory")
+	}
+	return nil
+}
+
+// readStateFile reads the state values from the given file.
+func readStateFile(path string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err, os.IsNotExist)
+	}
+	var f diskStateFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, errgo.Notef(err, "invalid state file %q", path)
+	}
+	if f.Values == nil {
+		f.Values = make(map[string][]byte)
+	}
+	return f.Values, nil
+}
+
+// writeFileSync is like ioutil.WriteFile except that it
+// makes sure that the data is on disk before returning.
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(f.Close())
+}
+
+// syncDir makes sure that changes to the entries
+// in the given directory are on disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+	return errgo.Mask(f.Sync())
 }
@@ -0,0 +1,123 @@
+package hook_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+)
+
+type stateSuite struct{}
+
+var _ = gc.Suite(&stateSuite{})
+
+func (*stateSuite) TestDiskStateSaveAll(c *gc.C) {
+	dir := c.MkDir()
+	state := hook.NewDiskState(dir).(hook.TransactionalState)
+	err := state.SaveAll(map[string][]byte{
+		"root":    []byte(`{"a":1}`),
+		"root.db": []byte(`{"b":2}`),
+	})
+	c.Assert(err, gc.IsNil)
+	err = state.Save("root", []byte(`{"a":3}`))
+	c.Assert(err, gc.IsNil)
+
+	// A new instance reads the state back from disk.
+	state = hook.NewDiskState(dir).(hook.TransactionalState)
+	data, err := state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"a":3}`)
+	data, err = state.Load("root.db")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"b":2}`)
+	data, err = state.Load("other")
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, gc.IsNil)
+
+	// Only the state file and the previous
+	// generation are left in the directory.
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	c.Assert(names, gc.DeepEquals, []string{"gocharm-state", "gocharm-state.prev"})
+}
+
+func (*stateSuite) TestDiskStateRecoversPreviousGeneration(c *gc.C) {
+	dir := c.MkDir()
+	state := hook.NewDiskState(dir)
+	err := state.Save("root", []byte(`"first"`))
+	c.Assert(err, gc.IsNil)
+	err = state.Save("root", []byte(`"second"`))
+	c.Assert(err, gc.IsNil)
+
+	// Damage the current generation.
+	err = ioutil.WriteFile(filepath.Join(dir, "gocharm-state"), []byte(`{"Values":`), 0600)
+	c.Assert(err, gc.IsNil)
+	data, err := hook.NewDiskState(dir).Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `"first"`)
+
+	// Lose it altogether.
+	err = os.Remove(filepath.Join(dir, "gocharm-state"))
+	c.Assert(err, gc.IsNil)
+	data, err = hook.NewDiskState(dir).Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `"first"`)
+}
+
+func (*stateSuite) TestDiskStateMigratesPerNameFiles(c *gc.C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "root.json"), []byte(`{"a":1}`), 0600)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(dir, "hook.json"), []byte(`{}`), 0600)
+	c.Assert(err, gc.IsNil)
+
+	state := hook.NewDiskState(dir)
+	data, err := state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"a":1}`)
+	err = state.Save("root.db", []byte(`{"b":2}`))
+	c.Assert(err, gc.IsNil)
+
+	// The old files have been removed and
+	// their contents are in the state file.
+	_, err = os.Stat(filepath.Join(dir, "root.json"))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+	_, err = os.Stat(filepath.Join(dir, "hook.json"))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+	state = hook.NewDiskState(dir)
+	data, err = state.Load("root")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{"a":1}`)
+	data, err = state.Load("hook")
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, `{}`)
+}
+
+func (*stateSuite) TestDiskStateDeleteAndList(c *gc.C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "root.json"), []byte(`{}`), 0600)
+	c.Assert(err, gc.IsNil)
+	state := hook.NewDiskState(dir)
+	err = state.Save("root.a", []byte(`1`))
+	c.Assert(err, gc.IsNil)
+	err = state.Save("hook", []byte(`2`))
+	c.Assert(err, gc.IsNil)
+	names, err := state.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.DeepEquals, []string{"hook", "root", "root.a"})
+
+	err = state.Delete("root")
+	c.Assert(err, gc.IsNil)
+	err = state.Delete("nothing")
+	c.Assert(err, gc.IsNil)
+	names, err = hook.NewDiskState(dir).List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.DeepEquals, []string{"hook", "root.a"})
+}
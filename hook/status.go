@@ -0,0 +1,245 @@
+package hook
+
+import (
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// StatusInfo holds a workload status as reported by status-get.
+type StatusInfo struct {
+	Status  Status                 `json:"status"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"status-data,omitempty"`
+}
+
+// statusReport holds a status reported by one part of the charm.
+type statusReport struct {
+	// Source identifies what reported the status: the name of a
+	// registry, "reconciler:" followed by the name of a reconciler,
+	// or "config" for the status set because of invalid
+	// configuration.
+	Source string
+
+	// Label holds the name that the status message is
+	// prefixed with when it is combined with other messages.
+	Label string `json:",omitempty"`
+
+	Status  Status
+	Message string `json:",omitempty"`
+}
+
+// statusCollector holds the status reports made during a hook.
+// The unit status reports themselves are held in the hook state
+// so that a status reported in one hook remains in effect
+// until the same source reports another one.
+type statusCollector struct {
+	// changed records whether any unit status has
+	// been reported during the hook.
+	changed bool
+
+	// app holds the application status reports
+	// made during the hook.
+	app []statusReport
+}
+
+// statusSeverity orders the statuses from least to most severe.
+var statusSeverity = map[Status]int{
+	StatusActive:      0,
+	StatusWaiting:     1,
+	StatusMaintenance: 2,
+	StatusBlocked:     3,
+}
+
+// Status returns the current status of the unit as reported by
+// status-get. Note that when called from a hook function, this does not
+// include any status set during the current hook, because the status
+// is only set when all the hook functions have completed.
+func (ctxt *Context) Status() (StatusInfo, error) {
+	var info StatusInfo
+	if err := ctxt.RunJSON(&info, "status-get", "--format", "json", "--include-data"); err != nil {
+		return StatusInfo{}, errgo.Mask(err)
+	}
+	return info, nil
+}
+
+// AppStatus returns the current status of the application as reported
+// by status-get. It may only be called on the leader unit.
+func (ctxt *Context) AppStatus() (StatusInfo, error) {
+	var info struct {
+		AppStatus StatusInfo `json:"application-status"`
+	}
+	if err := ctxt.RunJSON(&info, "status-get", "--format", "json", "--include-data", "--application"); err != nil {
+		return StatusInfo{}, errgo.Mask(err)
+	}
+	return info.AppStatus, nil
+}
+
+// SetAppStatus sets the status of the application as a whole. Only the
+// leader may set the application status; on other units, SetAppStatus
+// returns an error.
+//
+// As with SetStatus, when called from a hook function the status
+// reports from all registries are combined and the application status
+// is set once when all the hook functions have completed.
+func (ctxt *Context) SetAppStatus(st Status, message string) error {
+	if _, ok := statusSeverity[st]; !ok {
+		return errgo.Newf("invalid status %q", st)
+	}
+	isLeader, err := ctxt.IsLeader()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if !isLeader {
+		return errgo.New("cannot set application status: not the leader")
+	}
+	if !ctxt.collectingStatus() {
+		return ctxt.runStatusSet(true, st, message)
+	}
+	collector := ctxt.cache.status
+	collector.app = setReport(collector.app, statusReport{
+		Source:  registrySource(ctxt.registryName),
+		Label:   registryLabel(ctxt.registryName),
+		Status:  st,
+		Message: message,
+	})
+	return nil
+}
+
+// runStatusSet runs status-set, discarding the error if
+// the version of juju does not support it.
+func (ctxt *Context) runStatusSet(app bool, st Status, message string) error {
+	args := []string{string(st), message}
+	if app {
+		args = append([]string{"--application"}, args...)
+	}
+	_, err := ctxt.Runner.Run("status-set", args...)
+	if errgo.Cause(err) == ErrUnimplemented {
+		return nil
+	}
+	return errgo.Mask(err)
+}
+
+// collectingStatus reports whether status reports are
+// being collected by Main rather than set immediately.
+func (ctxt *Context) collectingStatus() bool {
+	return ctxt.cache != nil && ctxt.cache.status != nil && ctxt.cache.hookState != nil
+}
+
+// reportStatus records the unit status reported by the given source.
+func (ctxt *Context) reportStatus(report statusReport) {
+	st := ctxt.cache.hookState
+	st.Status = setReport(st.Status, report)
+	ctxt.cache.status.changed = true
+}
+
+// clearStatus removes any unit status reported by the given source.
+func (ctxt *Context) clearStatus(source string) {
+	st := ctxt.cache.hookState
+	for i, report := range st.Status {
+		if report.Source == source {
+			st.Status = append(st.Status[0:i:i], st.Status[i+1:]...)
+			ctxt.cache.status.changed = true
+			return
+		}
+	}
+}
+
+// setReport replaces the report in reports with the same
+// source as report, or adds it if there is none.
+func setReport(reports []statusReport, report statusReport) []statusReport {
+	for i := range reports {
+		if reports[i].Source == report.Source {
+			reports[i] = report
+			return reports
+		}
+	}
+	return append(reports, report)
+}
+
+// flushStatus sets the unit and application statuses from
+// all the status reports, if any have been made during
+// the current hook.
+func flushStatus(r *Registry, ctxt *Context) error {
+	if !ctxt.collectingStatus() {
+		return nil
+	}
+	collector := ctxt.cache.status
+	// Make sure that the status is set only once, even
+	// if flushStatus is called again.
+	ctxt.cache.status = nil
+	// Discard reports from reconcilers that are
+	// no longer registered.
+	hstate := ctxt.cache.hookState
+	reports := hstate.Status[:0]
+	for _, report := range hstate.Status {
+		if name := strings.TrimPrefix(report.Source, "reconciler:"); name != report.Source && r.reconciler(name) == nil {
+			collector.changed = true
+			continue
+		}
+		reports = append(reports, report)
+	}
+	hstate.Status = reports
+
+	if collector.changed {
+		st, message := aggregateStatus(hstate.Status)
+		if err := ctxt.runStatusSet(false, st, message); err != nil {
+			return errgo.Notef(err, "cannot set status")
+		}
+	}
+	if len(collector.app) > 0 {
+		st, message := aggregateStatus(collector.app)
+		if err := ctxt.runStatusSet(true, st, message); err != nil {
+			return errgo.Notef(err, "cannot set application status")
+		}
+	}
+	return nil
+}
+
+// aggregateStatus returns the most severe status in reports (active if
+// there are none) with a message combining the messages of the reports
+// with that status. Each message is prefixed by the report's label, if
+// any.
+func aggregateStatus(reports []statusReport) (Status, string) {
+	st := StatusActive
+	for _, report := range reports {
+		if statusSeverity[report.Status] > statusSeverity[st] {
+			st = report.Status
+		}
+	}
+	var msgs []string
+	for _, report := range reports {
+		if report.Status != st {
+			continue
+		}
+		switch {
+		case report.Label == "" && report.Message == "":
+		case report.Label == "":
+			msgs = append(msgs, report.Message)
+		case report.Message != "":
+			msgs = append(msgs, report.Label+": "+report.Message)
+		case st != StatusActive:
+			msgs = append(msgs, report.Label)
+		}
+	}
+	return st, strings.Join(msgs, "; ")
+}
+
+// registrySource returns the status report source
+// for the registry with the given name.
+func registrySource(registryName string) string {
+	if registryName == "" {
+		return "root"
+	}
+	return registryName
+}
+
+// registryLabel returns the label used for status messages
+// from the registry with the given name. Messages from the root
+// registry are not labelled.
+func registryLabel(registryName string) string {
+	if registryName == "" || registryName == "root" {
+		return ""
+	}
+	return strings.TrimPrefix(registryName, "root.")
+}
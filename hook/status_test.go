@@ -0,0 +1,135 @@
+package hook_test
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type statusSuite struct{}
+
+var _ = gc.Suite(&statusSuite{})
+
+func (*statusSuite) TestStatusAggregation(c *gc.C) {
+	type report struct {
+		st  hook.Status
+		msg string
+	}
+	reports := map[string]map[string]report{
+		"install": {
+			"db":  {hook.StatusBlocked, "no database"},
+			"web": {hook.StatusMaintenance, "installing"},
+			"":    {hook.StatusBlocked, "need relation"},
+		},
+		"start": {
+			// A later active status from one registry does
+			// not overwrite the other registry's blocked status.
+			"web": {hook.StatusActive, "serving"},
+		},
+		"config-changed": {
+			"db": {hook.StatusActive, ""},
+			"":   {hook.StatusActive, ""},
+		},
+	}
+	var current hook.StatusInfo
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			register := func(r *hook.Registry, name string) {
+				var ctxt *hook.Context
+				r.RegisterContext(func(hctxt *hook.Context) error {
+					ctxt = hctxt
+					return nil
+				}, nil)
+				r.RegisterHook("*", func() error {
+					rep, ok := reports[ctxt.HookName][name]
+					if !ok {
+						return nil
+					}
+					var err error
+					current, err = ctxt.Status()
+					c.Assert(err, gc.IsNil)
+					return ctxt.SetStatus(rep.st, rep.msg)
+				})
+			}
+			register(r, "")
+			register(r.Clone("db"), "db")
+			register(r.Clone("web"), "web")
+			r.RegisterHook("config-changed", nop)
+			r.RegisterHook("update-status", nop)
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-set", "blocked", "need relation; db: no database"},
+	})
+
+	runner.Record = nil
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(current, jc.DeepEquals, hook.StatusInfo{
+		Status:  hook.StatusBlocked,
+		Message: "need relation; db: no database",
+	})
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-set", "blocked", "need relation; db: no database"},
+	})
+
+	runner.Record = nil
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-set", "active", "web: serving"},
+	})
+
+	// The status is not set when nothing has been reported.
+	runner.Record = nil
+	err = runner.RunHook("update-status", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, gc.HasLen, 0)
+}
+
+func (*statusSuite) TestAppStatus(c *gc.C) {
+	var setErr error
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			register := func(r *hook.Registry, st hook.Status, msg string) {
+				var ctxt *hook.Context
+				r.RegisterContext(func(hctxt *hook.Context) error {
+					ctxt = hctxt
+					return nil
+				}, nil)
+				r.RegisterHook("install", func() error {
+					setErr = ctxt.SetAppStatus(st, msg)
+					return nil
+				})
+			}
+			register(r.Clone("a"), hook.StatusWaiting, "waiting for peers")
+			register(r.Clone("b"), hook.StatusMaintenance, "")
+		},
+		IsLeader: true,
+		Logger:   c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(setErr, gc.IsNil)
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-set", "--application", "maintenance", "b"},
+	})
+	c.Assert(runner.AppStatus, jc.DeepEquals, hook.StatusInfo{
+		Status:  hook.StatusMaintenance,
+		Message: "b",
+	})
+
+	runner.IsLeader = false
+	runner.Record = nil
+	err = runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(setErr, gc.ErrorMatches, "cannot set application status: not the leader")
+	c.Assert(runner.Record, gc.HasLen, 0)
+}
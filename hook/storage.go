@@ -0,0 +1,106 @@
+package hook
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/juju/charm/v9"
+	"gopkg.in/errgo.v1"
+)
+
+// RegisterStorage registers a storage requirement to be included in the
+// charm's metadata.yaml. If storage is registered twice with the same
+// name, all of the details must also match. If both st.CountMin and
+// st.CountMax are zero, exactly one instance of the storage is required.
+//
+// Hooks for the storage can be registered with RegisterHook
+// using the names <name>-storage-attached and <name>-storage-detaching.
+func (r *Registry) RegisterStorage(st charm.Storage) {
+	if st.Name == "" {
+		panic(fmt.Errorf("no storage name given in %#v", st))
+	}
+	if st.Type == "" {
+		panic(fmt.Errorf("no type given in storage %#v", st))
+	}
+	if st.CountMin == 0 && st.CountMax == 0 {
+		st.CountMin = 1
+		st.CountMax = 1
+	}
+	old, ok := r.storage[st.Name]
+	if ok {
+		if !reflect.DeepEqual(old, st) {
+			panic(errgo.Newf("storage %q is already registered with different details (%#v)", st.Name, old))
+		}
+		return
+	}
+	r.storage[st.Name] = st
+}
+
+// RegisteredStorage returns storage that has been
+// registered with RegisterStorage, keyed by storage name.
+func (r *Registry) RegisteredStorage() map[string]charm.Storage {
+	return r.storage
+}
+
+// StorageInfo holds information about a storage instance
+// attached to the unit.
+type StorageInfo struct {
+	// Kind holds the kind of the storage,
+	// either "block" or "filesystem".
+	Kind string `json:"kind"`
+
+	// Location holds the location of the storage;
+	// the mount point of a filesystem or the
+	// device path of a block device.
+	Location string `json:"location"`
+}
+
+// StorageIds returns the ids of all the storage instances attached to
+// the unit for the storage with the given name. If name is empty,
+// the ids of all attached storage instances are returned.
+func (ctxt *Context) StorageIds(name string) ([]string, error) {
+	args := []string{"--format", "json"}
+	if name != "" {
+		args = append(args, "--", name)
+	}
+	var ids []string
+	if err := ctxt.RunJSON(&ids, "storage-list", args...); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return ids, nil
+}
+
+// Storage returns information about the storage instance with the
+// given id. If id is empty, the storage instance that the current
+// storage hook is running for is used.
+func (ctxt *Context) Storage(id string) (*StorageInfo, error) {
+	if id == "" {
+		id = ctxt.StorageId
+	}
+	if id == "" {
+		return nil, errgo.Newf("no storage id given in non-storage hook %s", ctxt.HookName)
+	}
+	var info StorageInfo
+	if err := ctxt.RunJSON(&info, "storage-get", "--format", "json", "-s", id); err != nil {
+		return nil, errgo.Notef(err, "cannot get storage %q", id)
+	}
+	return &info, nil
+}
+
+// AddStorage requests that count more instances of the storage with
+// the given name be added to the unit. The storage will be attached
+// asynchronously, triggering a <name>-storage-attached hook for
+// each new instance.
+func (ctxt *Context) AddStorage(name string, count int) error {
+	_, err := ctxt.Runner.Run("storage-add", fmt.Sprintf("%s=%d", name, count))
+	return errgo.Mask(err)
+}
+
+// IsStorageHook reports whether the current hook is executing
+// as a result of storage being attached or detached.
+// If it returns true, ctxt.StorageId will be set.
+func (ctxt *Context) IsStorageHook() bool {
+	return strings.HasSuffix(ctxt.HookName, "-storage-attached") ||
+		strings.HasSuffix(ctxt.HookName, "-storage-detaching")
+}
@@ -0,0 +1,90 @@
+package hook_test
+
+import (
+	"github.com/juju/charm/v9"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type storageSuite struct{}
+
+var _ = gc.Suite(&storageSuite{})
+
+func (*storageSuite) TestRegisterStorage(c *gc.C) {
+	r := hook.NewRegistry()
+	r.RegisterStorage(charm.Storage{
+		Name:     "data",
+		Type:     charm.StorageFilesystem,
+		Location: "/srv/data",
+	})
+	// Registering the same storage again is fine.
+	r.RegisterStorage(charm.Storage{
+		Name:     "data",
+		Type:     charm.StorageFilesystem,
+		Location: "/srv/data",
+	})
+	c.Assert(r.RegisteredStorage(), jc.DeepEquals, map[string]charm.Storage{
+		"data": {
+			Name:     "data",
+			Type:     charm.StorageFilesystem,
+			Location: "/srv/data",
+			CountMin: 1,
+			CountMax: 1,
+		},
+	})
+	c.Assert(func() {
+		r.RegisterStorage(charm.Storage{
+			Name: "data",
+			Type: charm.StorageBlock,
+		})
+	}, gc.PanicMatches, `storage "data" is already registered with different details .*`)
+
+	r.RegisterHook("data-storage-attached", nop)
+	r.RegisterHook("data-storage-detaching", nop)
+	c.Assert(func() {
+		r.RegisterHook("-storage-attached", nop)
+	}, gc.PanicMatches, `invalid hook name "-storage-attached"`)
+}
+
+func (*storageSuite) TestAttachStorage(c *gc.C) {
+	var ctxt *hook.Context
+	var infos []*hook.StorageInfo
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterContext(func(hctxt *hook.Context) error {
+				ctxt = hctxt
+				return nil
+			}, nil)
+			r.RegisterHook("data-storage-attached", func() error {
+				c.Check(ctxt.IsStorageHook(), jc.IsTrue)
+				info, err := ctxt.Storage("")
+				c.Assert(err, gc.IsNil)
+				infos = append(infos, info)
+				return nil
+			})
+			r.RegisterHook("data-storage-detaching", nop)
+		},
+		Logger: c,
+	}
+	dir := c.MkDir()
+	err := runner.AttachStorage("data/0", dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, jc.DeepEquals, []*hook.StorageInfo{{
+		Kind:     "filesystem",
+		Location: dir,
+	}})
+
+	ids, err := ctxt.StorageIds("data")
+	c.Assert(err, gc.IsNil)
+	c.Assert(ids, jc.DeepEquals, []string{"data/0"})
+
+	err = runner.DetachStorage("data/0")
+	c.Assert(err, gc.IsNil)
+	ids, err = ctxt.StorageIds("")
+	c.Assert(err, gc.IsNil)
+	c.Assert(ids, gc.HasLen, 0)
+}
@@ -0,0 +1,215 @@
+package hook
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/juju/charm/v9/hooks"
+	"gopkg.in/errgo.v1"
+)
+
+// ConfigValidator checks a configuration value. The value is
+// as decoded from JSON, so it will be of type string, float64
+// or bool. Options that have no value are not checked.
+type ConfigValidator func(val interface{}) error
+
+// configValidator holds a validator registered
+// with RegisterConfigValidator.
+type configValidator struct {
+	registryName string
+	name         string
+	check        ConfigValidator
+}
+
+// RegisterConfigValidator registers a validator for the configuration
+// option with the given name, which must already have been registered.
+//
+// Before any hook functions are called, all validators are run. If any
+// fail, the unit's status is set to StatusBlocked with a message naming
+// the invalid options, and the hook functions registered by r and its
+// sub-registries are not called. Components should therefore register
+// validators on the same registry as the hooks that depend on the
+// option. Hooks that tear down part of the unit (stop, remove,
+// relation-departed, relation-broken and storage-detaching) are the
+// exception: their functions, and any deferred functions and
+// reconcilers, always run, so that a unit with invalid configuration
+// can still be removed cleanly. When the configuration becomes valid
+// again, the blocked status is withdrawn, leaving the status reported
+// by the rest of the charm (see Context.SetStatus).
+func (r *Registry) RegisterConfigValidator(name string, check ConfigValidator) {
+	if _, ok := r.config[name]; !ok {
+		panic(errgo.Newf("validator registered for unknown configuration option %q", name))
+	}
+	r.configValidators = append(r.configValidators, configValidator{
+		registryName: r.name,
+		name:         name,
+		check:        check,
+	})
+}
+
+// IntRange returns a validator that checks that a value
+// is an integer between min and max inclusive.
+func IntRange(min, max int) ConfigValidator {
+	return func(val interface{}) error {
+		f, ok := val.(float64)
+		if !ok {
+			return errgo.Newf("unexpected type %T", val)
+		}
+		if f != math.Trunc(f) {
+			return errgo.Newf("value %v is not an integer", val)
+		}
+		if f < float64(min) || f > float64(max) {
+			return errgo.Newf("value %v out of range [%d, %d]", val, min, max)
+		}
+		return nil
+	}
+}
+
+// OneOf returns a validator that checks that a value
+// is one of the given strings.
+func OneOf(vals ...string) ConfigValidator {
+	return func(val interface{}) error {
+		s, ok := val.(string)
+		if !ok {
+			return errgo.Newf("unexpected type %T", val)
+		}
+		for _, v := range vals {
+			if s == v {
+				return nil
+			}
+		}
+		quoted := make([]string, len(vals))
+		for i, v := range vals {
+			quoted[i] = fmt.Sprintf("%q", v)
+		}
+		return errgo.Newf("value %q is not one of %s", s, strings.Join(quoted, ", "))
+	}
+}
+
+// MatchRegexp returns a validator that checks that a value
+// is a string matching the given regular expression in its
+// entirety. It panics if the pattern is not valid.
+func MatchRegexp(pattern string) ConfigValidator {
+	re := regexp.MustCompile("^(?:" + pattern + ")$")
+	return func(val interface{}) error {
+		s, ok := val.(string)
+		if !ok {
+			return errgo.Newf("unexpected type %T", val)
+		}
+		if !re.MatchString(s) {
+			return errgo.Newf("value %q does not match %q", s, pattern)
+		}
+		return nil
+	}
+}
+
+// ValidPEM returns a validator that checks that a value
+// is a string holding one or more PEM blocks and nothing else.
+// The empty string is allowed, as it usually means that the
+// option has not been set.
+func ValidPEM() ConfigValidator {
+	return func(val interface{}) error {
+		s, ok := val.(string)
+		if !ok {
+			return errgo.Newf("unexpected type %T", val)
+		}
+		if s == "" {
+			return nil
+		}
+		rest := []byte(s)
+		n := 0
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			n++
+		}
+		if n == 0 {
+			return errgo.New("no PEM data found")
+		}
+		if strings.TrimSpace(string(rest)) != "" {
+			return errgo.New("unexpected data after PEM data")
+		}
+		return nil
+	}
+}
+
+// checkConfig runs all the registered validators against the given
+// configuration values and updates the unit's status accordingly. It
+// returns the names of the registries whose hooks should not run.
+func checkConfig(r *Registry, ctxt *Context, config map[string]json.RawMessage, st *hookState) (map[string]bool, error) {
+	errs := make(map[string]error)
+	invalid := make(map[string]bool)
+	for _, v := range r.configValidators {
+		var val interface{}
+		if err := json.Unmarshal(config[v.name], &val); err != nil || val == nil {
+			continue
+		}
+		if err := v.check(val); err != nil {
+			if _, ok := errs[v.name]; !ok {
+				errs[v.name] = err
+			}
+			invalid[v.registryName] = true
+		}
+	}
+	if len(errs) == 0 {
+		if st.ConfigBlocked {
+			st.ConfigBlocked = false
+			ctxt.clearStatus("config")
+		}
+		return nil, nil
+	}
+	keys := make([]string, 0, len(errs))
+	for key := range errs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	msgs := make([]string, len(keys))
+	for i, key := range keys {
+		msgs[i] = fmt.Sprintf("%s (%v)", key, errs[key])
+	}
+	msg := "invalid configuration: " + strings.Join(msgs, "; ")
+	ctxt.Logf("%s", msg)
+	ctxt.reportStatus(statusReport{
+		Source:  "config",
+		Status:  StatusBlocked,
+		Message: msg,
+	})
+	st.ConfigBlocked = true
+	return invalid, nil
+}
+
+// isInvalidRegistry reports whether the registry with the given
+// name is, or is a sub-registry of, one of the invalid registries
+// returned by checkConfig.
+func isInvalidRegistry(invalid map[string]bool, registryName string) bool {
+	for name := range invalid {
+		if registryName == name || strings.HasPrefix(registryName, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// isTeardownHook reports whether the named hook tears down part of
+// the unit, so that its functions must run even when the configuration
+// is invalid.
+func isTeardownHook(hookName string) bool {
+	switch hooks.Kind(hookName) {
+	case hooks.Stop, hooks.Remove:
+		return true
+	}
+	for _, kind := range []hooks.Kind{hooks.RelationDeparted, hooks.RelationBroken, hooks.StorageDetaching} {
+		if strings.HasSuffix(hookName, "-"+string(kind)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package hook_test
+
+import (
+	"github.com/juju/charm/v9"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type validateSuite struct{}
+
+var _ = gc.Suite(&validateSuite{})
+
+const testPEM = `
+-----BEGIN CERTIFICATE-----
+aGVsbG8=
+-----END CERTIFICATE-----
+`
+
+var validatorTests = []struct {
+	about       string
+	check       hook.ConfigValidator
+	val         interface{}
+	expectError string
+}{{
+	about: "int in range",
+	check: hook.IntRange(1, 10),
+	val:   10.0,
+}, {
+	about:       "int out of range",
+	check:       hook.IntRange(1, 10),
+	val:         11.0,
+	expectError: `value 11 out of range \[1, 10\]`,
+}, {
+	about:       "int not integer",
+	check:       hook.IntRange(1, 10),
+	val:         1.5,
+	expectError: `value 1.5 is not an integer`,
+}, {
+	about: "one of",
+	check: hook.OneOf("a", "b"),
+	val:   "b",
+}, {
+	about:       "not one of",
+	check:       hook.OneOf("a", "b"),
+	val:         "c",
+	expectError: `value "c" is not one of "a", "b"`,
+}, {
+	about:       "one of with wrong type",
+	check:       hook.OneOf("a", "b"),
+	val:         true,
+	expectError: `unexpected type bool`,
+}, {
+	about: "regexp match",
+	check: hook.MatchRegexp("[a-z]+"),
+	val:   "abc",
+}, {
+	about:       "regexp must match entire value",
+	check:       hook.MatchRegexp("[a-z]+"),
+	val:         "abc1",
+	expectError: `value "abc1" does not match "\[a-z\]\+"`,
+}, {
+	about: "valid PEM",
+	check: hook.ValidPEM(),
+	val:   testPEM,
+}, {
+	about: "empty PEM",
+	check: hook.ValidPEM(),
+	val:   "",
+}, {
+	about:       "no PEM",
+	check:       hook.ValidPEM(),
+	val:         "something",
+	expectError: `no PEM data found`,
+}, {
+	about:       "PEM with trailing data",
+	check:       hook.ValidPEM(),
+	val:         testPEM + "junk",
+	expectError: `unexpected data after PEM data`,
+}}
+
+func (*validateSuite) TestValidators(c *gc.C) {
+	for i, test := range validatorTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := test.check(test.val)
+		if test.expectError != "" {
+			c.Check(err, gc.ErrorMatches, test.expectError)
+		} else {
+			c.Check(err, gc.IsNil)
+		}
+	}
+}
+
+func (*validateSuite) TestRegisterValidatorForUnknownOption(c *gc.C) {
+	r := hook.NewRegistry()
+	c.Assert(func() {
+		r.RegisterConfigValidator("port", hook.IntRange(1, 10))
+	}, gc.PanicMatches, `validator registered for unknown configuration option "port"`)
+}
+
+func (*validateSuite) TestInvalidConfigBlocks(c *gc.C) {
+	var called []string
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterHook("config-changed", func() error {
+				called = append(called, "root")
+				return nil
+			})
+			sub := r.Clone("sub")
+			sub.RegisterConfig("mode", charm.Option{
+				Type:    "string",
+				Default: "fast",
+			})
+			sub.RegisterConfigValidator("mode", hook.OneOf("fast", "slow"))
+			sub.RegisterHook("config-changed", func() error {
+				called = append(called, "sub")
+				return nil
+			})
+		},
+		Config: map[string]interface{}{
+			"mode": "medium",
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(called, jc.DeepEquals, []string{"root"})
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-set", "blocked", `invalid configuration: mode (value "medium" is not one of "fast", "slow")`},
+	})
+
+	// Fixing the configuration unblocks the unit.
+	called = nil
+	runner.Record = nil
+	runner.Config["mode"] = "slow"
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(called, jc.DeepEquals, []string{"root", "sub"})
+	c.Assert(runner.Record, jc.DeepEquals, [][]string{
+		{"status-set", "active", ""},
+	})
+
+	// The status is not set again when nothing has changed.
+	runner.Record = nil
+	err = runner.RunHook("config-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(runner.Record, gc.HasLen, 0)
+}
+
+func (*validateSuite) TestTeardownHooksRunWithInvalidConfig(c *gc.C) {
+	var called []string
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		State:        hooktest.MemState{"root.sub": []byte(`{}`)},
+		RegisterHooks: func(r *hook.Registry) {
+			r.RegisterStateCleanup("remove")
+			sub := r.Clone("sub")
+			sub.RegisterConfig("mode", charm.Option{
+				Type:    "string",
+				Default: "fast",
+			})
+			sub.RegisterConfigValidator("mode", hook.OneOf("fast", "slow"))
+			for _, name := range []string{"start", "leader-settings-changed", "stop", "remove"} {
+				name := name
+				sub.RegisterHook(name, func() error {
+					called = append(called, name)
+					return nil
+				})
+			}
+			sub.RegisterHook("*", func() error {
+				called = append(called, "*")
+				return nil
+			})
+		},
+		Config: map[string]interface{}{
+			"mode": "medium",
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(called, gc.HasLen, 0)
+
+	// The leader-settings-changed hook does not tear
+	// anything down, so it is blocked too.
+	err = runner.RunHook("leader-settings-changed", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(called, gc.HasLen, 0)
+
+	err = runner.RunHook("stop", "", "")
+	c.Assert(err, gc.IsNil)
+	err = runner.RunHook("remove", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(called, jc.DeepEquals, []string{"stop", "*", "remove", "*"})
+
+	// The state has been removed.
+	names, err := runner.State.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.HasLen, 0)
+}
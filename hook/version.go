@@ -0,0 +1,198 @@
+package hook
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"gopkg.in/errgo.v1"
+)
+
+// StateMigration converts persistent state data from one version
+// to the next. See Registry.RegisterContextVersioned.
+type StateMigration func(data json.RawMessage) (json.RawMessage, error)
+
+// RegisterContextVersioned is like RegisterContext except that the
+// state is saved along with the given version number, which must be
+// at least 1, so that the format of the state can change over time.
+//
+// When the state is loaded, if it was saved with an earlier version,
+// it is converted to the current version by calling each of the
+// migrations from its version onwards in turn before it is
+// unmarshaled: migrations[v] is called to convert data at version v to
+// version v+1. State saved by RegisterContext, with no version, is at
+// version 0. If a migration fails or is missing, or the state was
+// saved by a later version, the hook fails rather than losing the
+// state.
+//
+// See hooktest.CheckStateMigrations for a way of testing migrations.
+//
+// RegisterContextVersioned will panic if state is nil, if version is
+// less than 1, or if a migration is registered for a version outside
+// the range [0, version).
+func (r *Registry) RegisterContextVersioned(setter ContextSetter, state interface{}, version int, migrations map[int]StateMigration) {
+	if state == nil {
+		panic(errgo.New("nil state passed to RegisterContextVersioned"))
+	}
+	if version < 1 {
+		panic(errgo.Newf("invalid state version %d", version))
+	}
+	for v, m := range migrations {
+		if v < 0 || v >= version {
+			panic(errgo.Newf("migration from version %d registered for state at version %d", v, version))
+		}
+		if m == nil {
+			panic(errgo.Newf("nil migration from version %d", v))
+		}
+	}
+	r.registerContext(setter, state, version, migrations)
+}
+
+// versionedState holds the format of saved state
+// registered with RegisterContextVersioned.
+type versionedState struct {
+	Version int             `json:"gocharm-state-version"`
+	State   json.RawMessage `json:"state"`
+}
+
+// marshal returns the data to save for the state. Any fields tagged
+// to be encrypted are encrypted if e is non-nil (see
+// RegisterStateEncryption).
+func (s *localState) marshal(e *stateEncryption) ([]byte, error) {
+	data, err := json.Marshal(s.val)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if c := e.fieldCipher(); c != nil {
+		data, err = c.encryptFields(data, s.registryName, encryptedFields(s.val))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	if s.version == 0 {
+		return data, nil
+	}
+	return json.Marshal(versionedState{
+		Version: s.version,
+		State:   data,
+	})
+}
+
+// unmarshal unmarshals the given saved data into the state,
+// decrypting any encrypted fields and migrating it to the current
+// version first if needed. It reports whether the state must be saved
+// again even if it does not change.
+func (s *localState) unmarshal(data []byte, e *stateEncryption) (stale bool, _ error) {
+	data, stale, err := s.migrate(data, e)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	if err := json.Unmarshal(data, s.val); err != nil {
+		return false, errgo.Mask(err)
+	}
+	return stale, nil
+}
+
+// migrate returns the given saved data decrypted and migrated
+// to the current version of the state. It also reports whether
+// the saved data was at an earlier version or needs encrypting
+// again.
+func (s *localState) migrate(data []byte, e *stateEncryption) (_ []byte, stale bool, _ error) {
+	version := 0
+	if s.version != 0 {
+		version, data = savedVersion(data)
+	}
+	data, stale, err := e.decryptFields(data, s.registryName, s.val)
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	if version > s.version {
+		return nil, false, errgo.Newf("state version %d is newer than current version %d", version, s.version)
+	}
+	if version < s.version {
+		stale = true
+	}
+	data, err = s.migrateFrom(version, data, nil)
+	if err != nil {
+		return nil, false, errgo.Mask(err)
+	}
+	return data, stale, nil
+}
+
+// migrateFrom migrates the given data from the given version to
+// the current version of the state. If step is non-nil, it is called
+// with the data and its version after each migration.
+func (s *localState) migrateFrom(version int, data []byte, step func(version int, data []byte) error) ([]byte, error) {
+	for ; version < s.version; version++ {
+		m := s.migrations[version]
+		if m == nil {
+			return nil, errgo.Newf("no migration from version %d", version)
+		}
+		newData, err := m(data)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot migrate state from version %d", version)
+		}
+		if !json.Valid(newData) {
+			return nil, errgo.Newf("migration from version %d produced invalid JSON", version)
+		}
+		data = newData
+		if step != nil {
+			if err := step(version+1, data); err != nil {
+				return nil, errgo.Mask(err, errgo.Any)
+			}
+		}
+	}
+	return data, nil
+}
+
+// savedVersion returns the version of the given saved state
+// and the state data itself. Data saved with no version
+// is at version 0.
+func savedVersion(data []byte) (int, []byte) {
+	var v struct {
+		Version *int            `json:"gocharm-state-version"`
+		State   json.RawMessage `json:"state"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil || v.Version == nil {
+		return 0, data
+	}
+	return *v.Version, v.State
+}
+
+// MigrateState migrates the given state data, saved at the given
+// version, for the state registered with RegisterContextVersioned by
+// the registry with the given name, and returns a new value of the
+// registered state type holding the result. It returns an error if any
+// migration fails or if the result holds fields that are not in the
+// state type.
+//
+// If step is non-nil, it is called with the state data and its version
+// after each migration; if it returns an error, the migration stops
+// and the error is returned.
+//
+// This function is designed to be called by tests only.
+func MigrateState(r *Registry, registryName string, version int, data []byte, step func(version int, data []byte) error) (interface{}, error) {
+	for _, s := range r.state {
+		if s.registryName != registryName {
+			continue
+		}
+		if s.version == 0 {
+			return nil, errgo.Newf("state for %s is not versioned", registryName)
+		}
+		if version > s.version {
+			return nil, errgo.Newf("state version %d is newer than current version %d", version, s.version)
+		}
+		data, err := s.migrateFrom(version, data, step)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		val := reflect.New(reflect.TypeOf(s.val).Elem())
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(val.Interface()); err != nil {
+			return nil, errgo.Notef(err, "migrated state does not match %T", s.val)
+		}
+		return val.Interface(), nil
+	}
+	return nil, errgo.Newf("no state registered for %s", registryName)
+}
@@ -0,0 +1,126 @@
+package hook_test
+
+import (
+	"encoding/json"
+	"strings"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/mever/gocharm/v2/hook"
+	"github.com/mever/gocharm/v2/hook/hooktest"
+)
+
+type versionSuite struct{}
+
+var _ = gc.Suite(&versionSuite{})
+
+// stateV2 is the current version of the test state. At version 0,
+// it was {"Name": string}; at version 1, {"Names": []string}.
+type stateV2 struct {
+	Names []string
+	Port  int
+}
+
+var stateMigrations = map[int]hook.StateMigration{
+	0: func(data json.RawMessage) (json.RawMessage, error) {
+		var old struct {
+			Name string
+		}
+		if err := json.Unmarshal(data, &old); err != nil {
+			return nil, err
+		}
+		return json.Marshal(map[string]interface{}{
+			"Names": strings.Fields(old.Name),
+		})
+	},
+	1: func(data json.RawMessage) (json.RawMessage, error) {
+		var st map[string]interface{}
+		if err := json.Unmarshal(data, &st); err != nil {
+			return nil, err
+		}
+		st["Port"] = 80
+		return json.Marshal(st)
+	},
+}
+
+func registerVersionedState(loaded *stateV2) func(r *hook.Registry) {
+	return func(r *hook.Registry) {
+		var st stateV2
+		r = r.Clone("sub")
+		r.RegisterContextVersioned(func(ctxt *hook.Context) error {
+			*loaded = st
+			return nil
+		}, &st, 2, stateMigrations)
+	}
+}
+
+func (*versionSuite) TestMigrateOnLoad(c *gc.C) {
+	// Save some state before the state was versioned.
+	runner := &hooktest.Runner{
+		HookStateDir: c.MkDir(),
+		RegisterHooks: func(r *hook.Registry) {
+			st := struct{ Name string }{"a b"}
+			r.Clone("sub").RegisterContext(func(*hook.Context) error {
+				return nil
+			}, &st)
+		},
+		Logger: c,
+	}
+	err := runner.RunHook("install", "", "")
+	c.Assert(err, gc.IsNil)
+
+	var loaded stateV2
+	runner.RegisterHooks = registerVersionedState(&loaded)
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(loaded, jc.DeepEquals, stateV2{
+		Names: []string{"a", "b"},
+		Port:  80,
+	})
+	state := runner.State.(hooktest.MemState)
+	c.Assert(string(state["root.sub"]), gc.Equals, `{"gocharm-state-version":2,"state":{"Names":["a","b"],"Port":80}}`)
+
+	// State saved by a later version is not lost.
+	state["root.sub"] = []byte(`{"gocharm-state-version":3,"state":{}}`)
+	err = runner.RunHook("start", "", "")
+	c.Assert(err, gc.ErrorMatches, `cannot unmarshal state for root.sub: state version 3 is newer than current version 2`)
+	c.Assert(string(state["root.sub"]), gc.Equals, `{"gocharm-state-version":3,"state":{}}`)
+}
+
+func (*versionSuite) TestRegisterContextVersionedPanics(c *gc.C) {
+	var st stateV2
+	setter := func(*hook.Context) error { return nil }
+	r := hook.NewRegistry()
+	c.Assert(func() {
+		r.RegisterContextVersioned(setter, &st, 0, nil)
+	}, gc.PanicMatches, `invalid state version 0`)
+	c.Assert(func() {
+		r.RegisterContextVersioned(setter, &st, 2, map[int]hook.StateMigration{
+			2: stateMigrations[1],
+		})
+	}, gc.PanicMatches, `migration from version 2 registered for state at version 2`)
+}
+
+func (*versionSuite) TestCheckStateMigrations(c *gc.C) {
+	var loaded stateV2
+	err := hooktest.CheckStateMigrations(registerVersionedState(&loaded), "root.sub", map[int]string{
+		0: `{"Name": "x y"}`,
+		1: `{"Names": ["x", "y"]}`,
+		2: `{"Names": ["x", "y"], "Port": 80}`,
+	})
+	c.Assert(err, gc.IsNil)
+
+	// The state is checked after each step.
+	err = hooktest.CheckStateMigrations(registerVersionedState(&loaded), "root.sub", map[int]string{
+		0: `{"Name": "x y"}`,
+		1: `{"Names": ["x"]}`,
+	})
+	c.Assert(err, gc.ErrorMatches, `state at version 0: state migrated to version 1 is {"Names":\["x","y"\]}; want {"Names": \["x"\]}`)
+
+	// A migration that leaves behind old fields is caught.
+	err = hooktest.CheckStateMigrations(registerVersionedState(&loaded), "root.sub", map[int]string{
+		1: `{"Names": ["z"], "Name": "z"}`,
+	})
+	c.Assert(err, gc.ErrorMatches, `state at version 1: migrated state does not match \*hook_test.stateV2: json: unknown field "Name"`)
+}